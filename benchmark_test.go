@@ -31,7 +31,7 @@ func BenchmarkWritePageBuffer(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		err := pb.Write(data)
+		_, err := pb.Write(data)
 		if err != nil {
 			b.Error("failed to write to PageBuffer:", err)
 		}
@@ -57,7 +57,10 @@ func BenchmarkTree(b *testing.B) {
 		customEntry[i] = byte(i%26) + 'a'
 	}
 
-	t := db.NewTree(pg)
+	t, err := db.NewTree(pg)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create tree: %v", err))
+	}
 	for i := 0; i < b.N; i++ {
 		err = t.Insert([]byte(fmt.Sprintf("test_%d", i)), entry)
 		if err != nil {
@@ -78,16 +81,19 @@ func BenchmarkLeafFind(b *testing.B) {
 	}
 
 	entry := []byte{'0'}
-	page := pg.Alloc(0, db.PageTypeLeaf)
+	page, err := pg.Alloc(0, db.PageTypeLeaf)
+	if err != nil {
+		panic(fmt.Sprintf("failed to allocate page: %v", err))
+	}
 	leaf := page.Leaf()
 
 	for i := 0; i < 256; i++ {
-		_ = leaf.Insert([]byte(fmt.Sprintf("%d", i)), entry)
+		_ = leaf.Insert([]byte(fmt.Sprintf("%d", i)), entry, db.Bytewise)
 	}
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_ = leaf.Find([]byte("255"))
+		_ = leaf.Find([]byte("255"), db.Bytewise)
 	}
 }
 
@@ -101,14 +107,17 @@ func BenchmarkLeafInsert(b *testing.B) {
 	}
 
 	entry := []byte{'0'}
-	page := pg.Alloc(0, db.PageTypeLeaf)
+	page, err := pg.Alloc(0, db.PageTypeLeaf)
+	if err != nil {
+		panic(fmt.Sprintf("failed to allocate page: %v", err))
+	}
 	leaf := page.Leaf()
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		err = leaf.Insert([]byte(fmt.Sprintf("%d", i)), entry)
+		err = leaf.Insert([]byte(fmt.Sprintf("%d", i)), entry, db.Bytewise)
 		if err != nil {
-			page = pg.Alloc(0, db.PageTypeLeaf)
+			page, _ = pg.Alloc(0, db.PageTypeLeaf)
 			leaf = page.Leaf()
 		}
 	}
@@ -70,7 +70,10 @@ func main() {
 		customEntry[i] = byte(i%26) + 'a'
 	}
 
-	t := db.NewTree(pg)
+	t, err := db.NewTree(pg)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create tree: %v", err))
+	}
 	for i := 0; i < 1000; i++ {
 		if i == 941 || i == 0 || i == 5555 || i == 9999 {
 			err = t.Insert(append([]byte("test_"), []byte(strconv.Itoa(i))...), customEntry)
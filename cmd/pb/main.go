@@ -71,7 +71,7 @@ func main() {
 	go func() {
 		defer wg.Done()
 		for i := 0; i < 10; i++ {
-			err := w.Write(b100)
+			_, err := w.Write(b100)
 			if err != nil {
 				fmt.Println("Error appending entry:", err)
 				return
@@ -82,7 +82,7 @@ func main() {
 	go func() {
 		defer wg.Done()
 		for i := 0; i < 10; i++ {
-			err := w.Write(b1m)
+			_, err := w.Write(b1m)
 			if err != nil {
 				fmt.Println("Error appending entry:", err)
 				return
@@ -93,7 +93,7 @@ func main() {
 	go func() {
 		defer wg.Done()
 		for i := 0; i < 3; i++ {
-			err := w.Write(b100m)
+			_, err := w.Write(b100m)
 			if err != nil {
 				fmt.Println("Error appending entry:", err)
 				return
@@ -46,7 +46,7 @@ func main() {
 
 	syncInterval := 2 * time.Second
 	pb, err := storage.NewPageBuffer(ctx, syncInterval, resolver.NewWriter(args))
-	w := log.NewLog(pb)
+	w := log.NewLog(pb, nil)
 
 	if err != nil {
 		fmt.Println("Error creating page buffer:", err)
@@ -26,3 +26,11 @@ type WriterReaderSeekerCloser interface {
 	ReaderCloser
 	Seeker
 }
+
+type ReaderAt interface {
+	ReadAt(b []byte, off int64) (n int, err error)
+}
+
+type WriterAt interface {
+	WriteAt(b []byte, off int64) (n int, err error)
+}
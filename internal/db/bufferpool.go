@@ -0,0 +1,138 @@
+package db
+
+import (
+	"container/list"
+	"slices"
+)
+
+const (
+	defaultCacheSize = 1 << 10
+)
+
+// frame is a page cached by the buffer pool.
+type frame struct {
+	page Page
+
+	pins  int
+	dirty bool
+
+	// loading is closed once the page is read from the file, the frame is
+	// pinned and its page is empty until then
+	loading chan struct{}
+
+	elem *list.Element // position in the lru list
+}
+
+// bufferPool keeps recently used pages in memory and evicts the least
+// recently used unpinned one when it grows over capacity. Dirty pages stay
+// until the pager writes them back, see Pager.WriteBack.
+type bufferPool struct {
+	capacity int
+
+	frames map[uint64]*frame
+	lru    *list.List // front is the most recently used page id
+}
+
+func newBufferPool(capacity int) *bufferPool {
+	return &bufferPool{
+		capacity: max(1, capacity),
+		frames:   make(map[uint64]*frame),
+		lru:      list.New(),
+	}
+}
+
+func (bp *bufferPool) get(id uint64) (*frame, bool) {
+	f, ok := bp.frames[id]
+	if !ok {
+		return nil, false
+	}
+
+	bp.lru.MoveToFront(f.elem)
+
+	return f, true
+}
+
+// put caches a copy of p. The frame is returned to pin it before the next
+// eviction.
+func (bp *bufferPool) put(p *Page, dirty bool) *frame {
+	id := p.ID()
+
+	f, ok := bp.get(id)
+	if !ok {
+		f = &frame{}
+		f.elem = bp.lru.PushFront(id)
+		bp.frames[id] = f
+	}
+
+	if len(f.page) != len(*p) {
+		f.page = make(Page, len(*p))
+	}
+
+	copy(f.page, *p)
+	f.dirty = f.dirty || dirty
+
+	return f
+}
+
+// reserve caches an empty pinned frame for the page being read from the file,
+// so readers of the same page wait for it instead of reading it again.
+func (bp *bufferPool) reserve(id uint64) *frame {
+	f := &frame{pins: 1, loading: make(chan struct{})}
+	f.elem = bp.lru.PushFront(id)
+	bp.frames[id] = f
+
+	return f
+}
+
+// loaded fills the reserved frame with the page read from the file, or drops
+// it if the read failed, and wakes up the readers waiting for it.
+func (bp *bufferPool) loaded(id uint64, f *frame, p *Page) {
+	if p != nil {
+		f.page = *p
+	} else {
+		bp.lru.Remove(f.elem)
+		delete(bp.frames, id)
+	}
+
+	f.pins--
+	close(f.loading)
+	f.loading = nil
+}
+
+// shrink removes clean frames over capacity. Pinned and dirty frames are never
+// evicted, so the pool may temporarily exceed its capacity, dirty ones leave
+// it once the pager writes them back.
+func (bp *bufferPool) shrink() {
+	for e := bp.lru.Back(); e != nil && len(bp.frames) > bp.capacity; {
+		prev := e.Prev()
+
+		id := e.Value.(uint64)
+		f := bp.frames[id]
+		if f.pins == 0 && !f.dirty {
+			bp.lru.Remove(e)
+			delete(bp.frames, id)
+		}
+
+		e = prev
+	}
+}
+
+// dirty returns dirty frames in page order.
+func (bp *bufferPool) dirty() []*frame {
+	var res []*frame
+	for _, f := range bp.frames {
+		if f.dirty {
+			res = append(res, f)
+		}
+	}
+
+	slices.SortFunc(res, func(a, b *frame) int {
+		if a.page.ID() < b.page.ID() {
+			return -1
+		}
+
+		return 1
+	})
+
+	return res
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	comparatorNameSize = 64
+)
+
+// Comparator orders keys of a Tree. The name is persisted in the meta page,
+// so a file is never opened with an ordering it was not built with.
+type Comparator interface {
+	Name() string
+	Compare(a, b Key) int
+}
+
+var (
+	// Bytewise orders keys lexicographically, it is the default.
+	Bytewise Comparator = NewComparator("bytewise", bytes.Compare)
+
+	// Reverse orders keys lexicographically in descending order.
+	Reverse Comparator = NewComparator("reverse", func(a, b []byte) int {
+		return bytes.Compare(b, a)
+	})
+
+	// BigEndian orders keys as unsigned big-endian integers of any length,
+	// equal numbers with more leading zeros go after.
+	BigEndian Comparator = NewComparator("bigendian", func(a, b []byte) int {
+		res := compareLengthFirst(bytes.TrimLeft(a, "\x00"), bytes.TrimLeft(b, "\x00"))
+		if res != 0 {
+			return res
+		}
+
+		return compareLengthFirst(a, b)
+	})
+
+	// LengthFirst orders shorter keys first and keys of the same length
+	// lexicographically. Files created before comparators were persisted use it.
+	LengthFirst Comparator = NewComparator("lengthfirst", compareLengthFirst)
+)
+
+var builtinComparators = map[string]Comparator{
+	Bytewise.Name():    Bytewise,
+	Reverse.Name():     Reverse,
+	BigEndian.Name():   BigEndian,
+	LengthFirst.Name(): LengthFirst,
+}
+
+type comparator struct {
+	name string
+	fn   func(a, b []byte) int
+}
+
+// NewComparator returns a comparator with a custom ordering.
+// Trees opened with it must always use the same name and ordering.
+func NewComparator(name string, fn func(a, b []byte) int) Comparator {
+	return &comparator{
+		name: name,
+		fn:   fn,
+	}
+}
+
+func (c *comparator) Name() string {
+	return c.name
+}
+
+func (c *comparator) Compare(a, b Key) int {
+	return c.fn(a, b)
+}
+
+func compareLengthFirst(a, b []byte) int {
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+
+		return 1
+	}
+
+	return bytes.Compare(a, b)
+}
+
+func validComparatorName(name string) error {
+	if len(name) == 0 || len(name) > comparatorNameSize {
+		return fmt.Errorf("%w: name %q should be 1..%d bytes long", errInvalidComparator, name, comparatorNameSize)
+	}
+
+	return nil
+}
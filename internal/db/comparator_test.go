@@ -0,0 +1,196 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/sergei-durkin/armtracer"
+)
+
+func TestTreeComparator(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	writer, size, err := NewWriterReaderSeekerCloser()
+	if err != nil {
+		panic(fmt.Sprintf("failed to create writer: %v", err))
+	}
+	defer ClearDB()
+	defer writer.Close()
+
+	pg, err := NewPager(writer, uint64(size))
+	if err != nil {
+		panic(fmt.Sprintf("failed to create pager: %v", err))
+	}
+
+	tree, err := NewTree(pg, WithComparator(Reverse))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range rand.Perm(300) {
+		err = tree.Insert(Key(fmt.Sprintf("key_%d", i)), []byte{'0'})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var prev Key
+	cnt := 0
+	err = tree.Range(nil, nil, func(k Key, v []byte) bool {
+		if prev != nil && Bytewise.Compare(prev, k) <= 0 {
+			t.Fatalf("keys should be in descending order: %q before %q", prev, k)
+		}
+
+		prev = append(prev[:0], k...)
+		cnt++
+
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cnt != 300 {
+		t.Fatalf("range should return 300 keys, got %d", cnt)
+	}
+
+	err = pg.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	end, err := writer.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pg, err = NewPager(writer, uint64(end))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewTree(pg, WithComparator(Bytewise))
+	if !errors.Is(err, ErrComparatorMismatch) {
+		t.Fatalf("file should be rejected with another comparator, got %v", err)
+	}
+
+	tree, err = NewTree(pg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tree.cmp != Reverse {
+		t.Fatalf("persisted comparator should be used, got %q", tree.cmp.Name())
+	}
+
+	_, err = tree.Find(Key("key_42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTreeCustomComparator(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	writer, size, err := NewWriterReaderSeekerCloser()
+	if err != nil {
+		panic(fmt.Sprintf("failed to create writer: %v", err))
+	}
+	defer ClearDB()
+	defer writer.Close()
+
+	pg, err := NewPager(writer, uint64(size))
+	if err != nil {
+		panic(fmt.Sprintf("failed to create pager: %v", err))
+	}
+
+	// keys are little-endian integers
+	cmp := NewComparator("uint64le", func(a, b []byte) int {
+		x, y := binary.LittleEndian.Uint64(a), binary.LittleEndian.Uint64(b)
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+
+		return 0
+	})
+
+	tree, err := NewTree(pg, WithComparator(cmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range rand.Perm(500) {
+		k := binary.LittleEndian.AppendUint64(nil, uint64(i))
+
+		err = tree.Insert(k, []byte{'0'})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	i := uint64(0)
+	err = tree.Range(nil, nil, func(k Key, v []byte) bool {
+		if binary.LittleEndian.Uint64(k) != i {
+			t.Fatalf("key %d should be %d", binary.LittleEndian.Uint64(k), i)
+		}
+		i++
+
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if i != 500 {
+		t.Fatalf("range should return 500 keys, got %d", i)
+	}
+
+	err = pg.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	end, err := writer.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pg, err = NewPager(writer, uint64(end))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewTree(pg)
+	if !errors.Is(err, ErrComparatorMismatch) {
+		t.Fatalf("custom comparator should be passed explicitly, got %v", err)
+	}
+}
+
+func TestBigEndianComparator(t *testing.T) {
+	cases := []struct {
+		a, b Key
+		res  int
+	}{
+		{Key{0x01}, Key{0x00, 0x01}, -1},
+		{Key{0x02}, Key{0x01, 0x00}, -1},
+		{Key{0xff, 0xff}, Key{0x01, 0x00, 0x00}, -1},
+		{Key{0x01, 0x02}, Key{0x01, 0x01}, 1},
+		{Key{0x00, 0x05}, Key{0x05}, 1},
+	}
+
+	for _, c := range cases {
+		res := BigEndian.Compare(c.a, c.b)
+		if res != c.res {
+			t.Fatalf("compare %x with %x should be %d, got %d", c.a, c.b, c.res, res)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/sergei-durkin/armtracer"
+)
+
+// Cursor walks the leaf chain of a Tree in key order.
+//
+// Keys and values returned by a Cursor point into page memory and are valid
+// only until the next movement of the cursor. A cursor is not safe for
+// concurrent use, but the tree may be modified between its movements: the
+// cursor then seeks its current key again.
+type Cursor struct {
+	t *Tree
+
+	leaf    *Page
+	idx     int
+	version uint64 // version of the tree the leaf was read at
+
+	err error
+}
+
+func (t *Tree) Cursor() *Cursor {
+	return &Cursor{t: t}
+}
+
+// First moves the cursor to the smallest key of the tree.
+func (c *Cursor) First() bool {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	c.t.mu.RLock()
+	defer c.t.mu.RUnlock()
+
+	return c.first()
+}
+
+func (c *Cursor) first() bool {
+	p, err := c.t.edgeLeaf(false)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	c.load(p)
+	c.idx = 0
+
+	return c.forward()
+}
+
+// Last moves the cursor to the greatest key of the tree.
+func (c *Cursor) Last() bool {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	c.t.mu.RLock()
+	defer c.t.mu.RUnlock()
+
+	return c.last()
+}
+
+func (c *Cursor) last() bool {
+	p, err := c.t.edgeLeaf(true)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	c.load(p)
+	c.idx = c.leaf.Leaf().Len() - 1
+
+	return c.backward()
+}
+
+// Seek moves the cursor to the first key that is greater than or equal to k.
+func (c *Cursor) Seek(k Key) bool {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	c.t.mu.RLock()
+	defer c.t.mu.RUnlock()
+
+	return c.seek(k)
+}
+
+func (c *Cursor) seek(k Key) bool {
+	p, _, err := c.t.findLeaf(k)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	c.load(p)
+	c.idx, _ = p.Leaf().search(k, c.t.cmp)
+
+	return c.forward()
+}
+
+func (c *Cursor) Next() bool {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	if !c.Valid() {
+		return false
+	}
+
+	c.t.mu.RLock()
+	defer c.t.mu.RUnlock()
+
+	if c.version != c.t.version {
+		// the leaf may be split or merged, find the current key again
+		k := c.Key()
+		if !c.seek(k) {
+			return false
+		}
+
+		if c.t.cmp.Compare(c.Key(), k) != 0 {
+			return true // the current key is deleted, the cursor is already past it
+		}
+	}
+
+	c.idx++
+
+	return c.forward()
+}
+
+func (c *Cursor) Prev() bool {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	if !c.Valid() {
+		return false
+	}
+
+	c.t.mu.RLock()
+	defer c.t.mu.RUnlock()
+
+	if c.version != c.t.version {
+		// the leaf may be split or merged, find the current key again
+		if !c.seek(c.Key()) {
+			return c.last()
+		}
+	}
+
+	c.idx--
+
+	return c.backward()
+}
+
+func (c *Cursor) Valid() bool {
+	return c.err == nil && c.leaf != nil && c.idx >= 0 && c.idx < c.leaf.Leaf().Len()
+}
+
+func (c *Cursor) Key() Key {
+	if !c.Valid() {
+		return nil
+	}
+
+	return c.leaf.Leaf().key(c.idx)
+}
+
+// Value returns the value under the cursor, reading the overflow chain if needed.
+func (c *Cursor) Value() ([]byte, error) {
+	if !c.Valid() {
+		return nil, ErrNotFound
+	}
+
+	c.t.mu.RLock()
+	defer c.t.mu.RUnlock()
+
+	e := c.leaf.Leaf().entry(c.idx)
+
+	if c.version != c.t.version {
+		// the overflow chain may be freed, look the key up again
+		// without moving the cursor
+		p, _, err := c.t.findLeaf(c.Key())
+		if err != nil {
+			return nil, err
+		}
+
+		e = p.Leaf().Find(c.Key(), c.t.cmp)
+		if e == nil {
+			return nil, ErrNotFound
+		}
+	}
+
+	return c.t.resolve(e)
+}
+
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// forward skips exhausted leaves to the right until an entry is found.
+func (c *Cursor) forward() bool {
+	for c.idx >= c.leaf.Leaf().Len() {
+		right := c.leaf.Leaf().right
+		if right == 0 {
+			c.leaf = nil
+			return false
+		}
+
+		p, err := c.t.pager.Read(right)
+		if err != nil {
+			return c.fail(fmt.Errorf("failed to read right leaf %d: %w", right, err))
+		}
+
+		c.load(p)
+		c.idx = 0
+	}
+
+	return true
+}
+
+// backward skips exhausted leaves to the left until an entry is found.
+func (c *Cursor) backward() bool {
+	for c.idx < 0 {
+		left := c.leaf.Leaf().left
+		if left == 0 {
+			c.leaf = nil
+			return false
+		}
+
+		p, err := c.t.pager.Read(left)
+		if err != nil {
+			return c.fail(fmt.Errorf("failed to read left leaf %d: %w", left, err))
+		}
+
+		c.load(p)
+		c.idx = c.leaf.Leaf().Len() - 1
+	}
+
+	return true
+}
+
+func (c *Cursor) load(p *Page) {
+	if p == c.t.root {
+		// the root is modified in place by writers
+		p = p.clone()
+	}
+
+	c.leaf = p
+	c.version = c.t.version
+}
+
+func (c *Cursor) fail(err error) bool {
+	c.err = err
+	c.leaf = nil
+
+	return false
+}
+
+// Range calls fn for every key in [start, end) in key order until fn returns false.
+// A nil start begins from the first key, a nil end runs to the last one.
+func (t *Tree) Range(start, end Key, fn func(k Key, v []byte) bool) error {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	c := t.Cursor()
+
+	var ok bool
+	if start == nil {
+		ok = c.First()
+	} else {
+		ok = c.Seek(start)
+	}
+
+	for ; ok; ok = c.Next() {
+		k := c.Key()
+		if end != nil && t.cmp.Compare(k, end) >= 0 {
+			break
+		}
+
+		v, err := c.Value()
+		if errors.Is(err, ErrNotFound) {
+			continue // deleted by a concurrent writer
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read value of %q: %w", k, err)
+		}
+
+		if !fn(k, v) {
+			return nil
+		}
+	}
+
+	return c.Err()
+}
+
+// Prefix calls fn for every key starting with prefix in key order until fn returns false.
+func (t *Tree) Prefix(prefix Key, fn func(k Key, v []byte) bool) error {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	// Keys sharing the prefix are contiguous and start at the prefix only in
+	// bytewise order, any other comparator has to scan the whole tree.
+	bytewise := t.cmp == Bytewise
+
+	c := t.Cursor()
+
+	var ok bool
+	if bytewise {
+		ok = c.Seek(prefix)
+	} else {
+		ok = c.First()
+	}
+
+	for ; ok; ok = c.Next() {
+		k := c.Key()
+
+		if !bytes.HasPrefix(k, prefix) {
+			if bytewise {
+				break
+			}
+
+			continue
+		}
+
+		v, err := c.Value()
+		if errors.Is(err, ErrNotFound) {
+			continue // deleted by a concurrent writer
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read value of %q: %w", k, err)
+		}
+
+		if !fn(k, v) {
+			return nil
+		}
+	}
+
+	return c.Err()
+}
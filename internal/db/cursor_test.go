@@ -0,0 +1,259 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/sergei-durkin/armtracer"
+)
+
+func newCursorTree(t *testing.T, cnt int) (*Tree, []Key) {
+	t.Helper()
+
+	writer, size, err := NewWriterReaderSeekerCloser()
+	if err != nil {
+		panic(fmt.Sprintf("failed to create writer: %v", err))
+	}
+	t.Cleanup(ClearDB)
+	t.Cleanup(func() { writer.Close() })
+
+	pg, err := NewPager(writer, uint64(size))
+	if err != nil {
+		panic(fmt.Sprintf("failed to create pager: %v", err))
+	}
+
+	tree, err := NewTree(pg)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create tree: %v", err))
+	}
+
+	keys := make([]Key, cnt)
+	for i := range cnt {
+		keys[i] = Key(fmt.Sprintf("key_%04d", i))
+	}
+
+	for _, i := range rand.Perm(cnt) {
+		err = tree.Insert(keys[i], []byte(fmt.Sprintf("value_%04d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Less(keys[j])
+	})
+
+	return tree, keys
+}
+
+func TestCursorForward(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	tree, keys := newCursorTree(t, 1000)
+
+	c := tree.Cursor()
+
+	i := 0
+	for ok := c.First(); ok; ok = c.Next() {
+		if i >= len(keys) {
+			t.Fatalf("cursor returned more than %d keys", len(keys))
+		}
+
+		if c.Key().Compare(keys[i]) != 0 {
+			t.Fatalf("key %d should be %q, got %q", i, keys[i], c.Key())
+		}
+
+		v, err := c.Value()
+		if err != nil {
+			t.Fatalf("failed to read value of %q: %s", c.Key(), err.Error())
+		}
+
+		expected := bytes.Replace(keys[i], []byte("key"), []byte("value"), 1)
+		if !bytes.Equal(v, expected) {
+			t.Fatalf("value of %q should be %q, got %q", keys[i], expected, v)
+		}
+
+		i++
+	}
+
+	if c.Err() != nil {
+		t.Fatalf("unexpected err %s", c.Err().Error())
+	}
+
+	if i != len(keys) {
+		t.Fatalf("cursor returned %d keys, want %d", i, len(keys))
+	}
+}
+
+func TestCursorBackward(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	tree, keys := newCursorTree(t, 1000)
+
+	c := tree.Cursor()
+
+	i := len(keys) - 1
+	for ok := c.Last(); ok; ok = c.Prev() {
+		if i < 0 {
+			t.Fatalf("cursor returned more than %d keys", len(keys))
+		}
+
+		if c.Key().Compare(keys[i]) != 0 {
+			t.Fatalf("key %d should be %q, got %q", i, keys[i], c.Key())
+		}
+
+		i--
+	}
+
+	if c.Err() != nil {
+		t.Fatalf("unexpected err %s", c.Err().Error())
+	}
+
+	if i != -1 {
+		t.Fatalf("cursor stopped at %d", i)
+	}
+}
+
+func TestCursorSeek(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	tree, keys := newCursorTree(t, 500)
+
+	c := tree.Cursor()
+	if !c.Seek(keys[123]) {
+		t.Fatalf("seek to %q failed", keys[123])
+	}
+
+	if c.Key().Compare(keys[123]) != 0 {
+		t.Fatalf("cursor should be at %q, got %q", keys[123], c.Key())
+	}
+
+	if !c.Prev() || c.Key().Compare(keys[122]) != 0 {
+		t.Fatalf("cursor should be at %q, got %q", keys[122], c.Key())
+	}
+
+	// key_012a is between key_0129 and key_0130
+	if !c.Seek(Key("key_012a")) {
+		t.Fatal("seek to missing key failed")
+	}
+
+	if c.Key().Compare(keys[130]) != 0 {
+		t.Fatalf("cursor should be at %q, got %q", keys[130], c.Key())
+	}
+
+	if c.Seek(Key("key_9999999")) {
+		t.Fatalf("seek after the last key should fail, got %q", c.Key())
+	}
+}
+
+func TestTreeRange(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	tree, keys := newCursorTree(t, 500)
+
+	var res []Key
+	err := tree.Range(keys[100], keys[200], func(k Key, v []byte) bool {
+		res = append(res, append(Key{}, k...))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res) != 100 {
+		t.Fatalf("range should return 100 keys, got %d", len(res))
+	}
+
+	for i := range res {
+		if res[i].Compare(keys[100+i]) != 0 {
+			t.Fatalf("key %d should be %q, got %q", i, keys[100+i], res[i])
+		}
+	}
+
+	cnt := 0
+	err = tree.Range(nil, nil, func(k Key, v []byte) bool {
+		cnt++
+		return cnt < 10
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cnt != 10 {
+		t.Fatalf("range should stop after 10 keys, got %d", cnt)
+	}
+}
+
+func TestTreePrefix(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	tree, _ := newCursorTree(t, 500)
+
+	for _, k := range []string{"key_01", "key_012"} {
+		err := tree.Insert(Key(k), []byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var res []string
+	err := tree.Prefix(Key("key_01"), func(k Key, v []byte) bool {
+		res = append(res, string(k))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// key_01, key_012 and key_0100..key_0199
+	if len(res) != 102 {
+		t.Fatalf("prefix should return 102 keys, got %d: %v", len(res), res)
+	}
+
+	if !sort.StringsAreSorted(res) {
+		t.Fatalf("prefix should return keys in order, got %v", res)
+	}
+
+	if res[0] != "key_01" || res[21] != "key_012" {
+		t.Fatalf("keys should be ordered bytewise, got %v", res[:22])
+	}
+}
+
+func TestCursorOverflow(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	tree, keys := newCursorTree(t, 50)
+
+	entry := make([]byte, 1<<16)
+	for i := range entry {
+		entry[i] = byte(i%26) + 'a'
+	}
+
+	err := tree.Update(keys[10], entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := tree.Cursor()
+	if !c.Seek(keys[10]) {
+		t.Fatalf("seek to %q failed", keys[10])
+	}
+
+	v, err := c.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(v, entry) {
+		t.Fatal("overflow value should be resolved")
+	}
+}
@@ -81,17 +81,10 @@ func (k Key) Valid() bool {
 	return len(k) <= int(maxKeySize)
 }
 
+// Compare compares keys bytewise, use the Comparator of the tree for ordering.
 func (k Key) Compare(other Key) (res int) {
 	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	if len(k) != len(other) {
-		if len(k) < len(other) {
-			return -1
-		} else {
-			return 1
-		}
-	}
-
 	return bytes.Compare(k, other)
 }
 
@@ -5,6 +5,29 @@ import "fmt"
 var (
 	errShortWrite     = fmt.Errorf("short write")
 	errNotEnoughSpace = fmt.Errorf("not enough space")
-	errNotFound       = fmt.Errorf("not found")
-	errAlreadyExists  = fmt.Errorf("key already exists")
+	ErrNotFound       = fmt.Errorf("not found")
+	ErrAlreadyExists  = fmt.Errorf("key already exists")
+
+	ErrComparatorMismatch = fmt.Errorf("comparator mismatch")
+	errInvalidComparator  = fmt.Errorf("invalid comparator")
+
+	ErrLayoutMismatch = fmt.Errorf("page layout mismatch")
+	errInvalidLayout  = fmt.Errorf("invalid page layout")
+
+	ErrCorrupted = fmt.Errorf("page is corrupted")
 )
+
+// CorruptionError is returned when a page read from the file does not match its checksum.
+type CorruptionError struct {
+	ID       uint64
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%s: page %d checksum %08x != %08x", ErrCorrupted, e.ID, e.Actual, e.Expected)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return ErrCorrupted
+}
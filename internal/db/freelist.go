@@ -0,0 +1,70 @@
+package db
+
+import "unsafe"
+
+const (
+	freeListHeaderSize = unsafe.Sizeof(FreeList{})
+)
+
+// FreeList is a trunk page of the persistent free list rooted at Meta.freeMap.
+// Every trunk keeps ids of free pages and a link to the next trunk.
+type FreeList struct {
+	header
+
+	next  uint64
+	count uint64
+
+	// followed by ids up to the end of the page
+}
+
+// freeListCap returns the number of ids a trunk of the given page size keeps.
+func freeListCap(size int) int {
+	return (size - int(freeListHeaderSize)) / int(unsafe.Sizeof(uint64(0)))
+}
+
+func (f *FreeList) Page() *Page {
+	return f.header.page()
+}
+
+func (f *FreeList) init() {
+	f.next = 0
+	f.count = 0
+}
+
+func (f *FreeList) Len() int {
+	return int(f.count)
+}
+
+func (f *FreeList) IsFull() bool {
+	return f.count >= uint64(freeListCap(int(f.size)))
+}
+
+func (f *FreeList) Push(id uint64) bool {
+	if f.IsFull() {
+		return false
+	}
+
+	f.ids()[f.count] = id
+	f.count++
+
+	return true
+}
+
+func (f *FreeList) Pop() (id uint64, ok bool) {
+	if f.count == 0 {
+		return 0, false
+	}
+
+	ids := f.ids()
+
+	f.count--
+	id = ids[f.count]
+	ids[f.count] = 0
+
+	return id, true
+}
+
+func (f *FreeList) ids() []uint64 {
+	ptr := unsafe.Add(unsafe.Pointer(f), freeListHeaderSize)
+	return unsafe.Slice((*uint64)(ptr), freeListCap(int(f.size)))
+}
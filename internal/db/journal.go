@@ -0,0 +1,148 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"wal"
+)
+
+// The journal holds the pages of the last write-back, see WithDoubleWrite:
+//
+//	magic    uint64
+//	pageSize uint32
+//	count    uint32
+//	checksum uint32 // crc32 of the pages
+//	pages    [count][pageSize]byte at journalHeaderSize
+//
+// The pages are written in place only once the journal is synced, so a
+// write-back torn by a crash is found complete in the journal, and a torn
+// journal means the file was not touched yet.
+const (
+	journalMagic      = 0x6c616e72756f6a // "journal"
+	journalHeaderSize = 32
+)
+
+// writeJournal writes the dirty pages to the journal and syncs it.
+func (pg *Pager) writeJournal(dirty []*frame) error {
+	buff := make([]byte, journalHeaderSize+len(dirty)*pg.pageSize)
+	for i, f := range dirty {
+		copy(buff[journalHeaderSize+i*pg.pageSize:], f.page)
+	}
+
+	binary.LittleEndian.PutUint64(buff[0:], journalMagic)
+	binary.LittleEndian.PutUint32(buff[8:], uint32(pg.pageSize))
+	binary.LittleEndian.PutUint32(buff[12:], uint32(len(dirty)))
+	binary.LittleEndian.PutUint32(buff[16:], crc32.ChecksumIEEE(buff[journalHeaderSize:]))
+
+	err := writeFull(pg.journal, buff, 0)
+	if err != nil {
+		return fmt.Errorf("could not write journal: %w", err)
+	}
+
+	return pg.journal.Sync()
+}
+
+// recoverJournal writes the pages of the last write-back found complete in the
+// journal in place again and clears it. It returns the id following the last
+// page written.
+func (pg *Pager) recoverJournal() (uint64, error) {
+	if pg.journal == nil {
+		return 0, nil
+	}
+
+	header := make([]byte, journalHeaderSize)
+
+	err := readFull(pg.journal, header, 0)
+	if err != nil || binary.LittleEndian.Uint64(header) != journalMagic {
+		return 0, nil // empty or torn, the file was not touched
+	}
+
+	size := int(binary.LittleEndian.Uint32(header[8:]))
+	count := int(binary.LittleEndian.Uint32(header[12:]))
+
+	err = validLayout(size, 0)
+	if err != nil {
+		return 0, nil
+	}
+
+	buff := make([]byte, journalHeaderSize+count*size)
+
+	err = readFull(pg.journal, buff, 0)
+	if err != nil || crc32.ChecksumIEEE(buff[journalHeaderSize:]) != binary.LittleEndian.Uint32(header[16:]) {
+		return 0, nil
+	}
+
+	pages := buff[journalHeaderSize:]
+
+	end := uint64(0)
+	for i := range count {
+		p := Page(pages[i*size : (i+1)*size])
+
+		err = writeFull(pg.w, p, int64(p.ID())*int64(size))
+		if err != nil {
+			return 0, fmt.Errorf("could not write page %d: %w", p.ID(), err)
+		}
+
+		end = max(end, p.ID()+1)
+	}
+
+	err = pg.w.Sync()
+	if err != nil {
+		return 0, err
+	}
+
+	// the pages are in place, later writes must not be undone by them
+	err = writeFull(pg.journal, make([]byte, journalHeaderSize), 0)
+	if err != nil {
+		return 0, fmt.Errorf("could not clear journal: %w", err)
+	}
+
+	return end, pg.journal.Sync()
+}
+
+func readFull(f wal.WriterReaderSeekerCloser, buff []byte, off int64) error {
+	var (
+		n   int
+		err error
+	)
+
+	if r, ok := f.(wal.ReaderAt); ok {
+		n, err = r.ReadAt(buff, off)
+	} else {
+		f.Seek(off, 0)
+		n, err = f.Read(buff)
+	}
+
+	if n == len(buff) && errors.Is(err, io.EOF) {
+		err = nil
+	}
+
+	if err == nil && n != len(buff) {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+func writeFull(f wal.WriterReaderSeekerCloser, buff []byte, off int64) error {
+	var (
+		n   int
+		err error
+	)
+
+	if w, ok := f.(wal.WriterAt); ok {
+		n, err = w.WriteAt(buff, off)
+	} else {
+		f.Seek(off, 0)
+		n, err = f.Write(buff)
+	}
+
+	if err == nil && n != len(buff) {
+		err = errShortWrite
+	}
+
+	return err
+}
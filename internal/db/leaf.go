@@ -12,29 +12,36 @@ import (
 )
 
 const (
-	leafDataSize = pageDataSize - 3*unsafe.Sizeof(int64(0))
+	leafHeaderSize = unsafe.Sizeof(Leaf{})
 
 	keyLenSize   = unsafe.Sizeof(uint16(0))
 	entryLenSize = unsafe.Sizeof(uint32(0))
 
-	maxKeySize   = 1 << 10
-	maxEntrySize = (leafDataSize-2*entryLenSize)/2 - (maxKeySize + keyLenSize)
+	maxKeySize = 1 << 10
 )
 
 func init() {
-	if maxEntrySize <= 0 {
+	if leafMaxEntrySize(minPageSize) <= 0 {
 		panic("page size too small")
 	}
 }
 
+// leafMaxEntrySize returns the size of the largest entry kept in a leaf of the
+// given page size, a leaf holds at least two entries of the maximum size.
+func leafMaxEntrySize(size int) int {
+	dataSize := size - int(leafHeaderSize)
+
+	return (dataSize-2*int(slotSize+entryLenSize))/2 - int(maxKeySize+keyLenSize)
+}
+
 type Leaf struct {
 	header
 
 	left, right uint64
 	count       uint64
 
-	// | l,r,count | [len | key] | .... | [value | len] |
-	data [leafDataSize]byte
+	// followed by the data up to the end of the page:
+	// | l,r,count | [slot] | .... | [len | key | len | value] |
 }
 
 func (l *Leaf) init() {
@@ -43,43 +50,54 @@ func (l *Leaf) init() {
 }
 
 func (l *Leaf) Page() *Page {
-	return (*Page)(unsafe.Pointer(l))
+	return l.header.page()
+}
+
+func (l *Leaf) data() []byte {
+	return l.body(leafHeaderSize)
+}
+
+func (l *Leaf) dataSize() int {
+	return int(l.size) - int(leafHeaderSize)
 }
 
-func (l *Leaf) Find(k Key) (e Entry) {
+func (l *Leaf) maxEntrySize() int {
+	return leafMaxEntrySize(int(l.size))
+}
+
+func (l *Leaf) Find(k Key, cmp Comparator) (e Entry) {
 	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	o, ok := l.find(k)
+	i, ok := l.search(k, cmp)
 	if !ok {
 		return nil
 	}
 
-	return l.entryByOffset(o.entry)
+	return l.entry(i)
 }
 
-func (l *Leaf) find(k Key) (o dataOffset, ok bool) {
+// search returns the position of the first key that is greater than or equal
+// to k and whether it is equal to k.
+func (l *Leaf) search(k Key, cmp Comparator) (i int, found bool) {
 	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	offsets := l.offsets()
-	for i := 0; i < len(offsets); i++ {
-		o := offsets[i]
+	n := int(l.count)
 
-		if k.Compare(l.keyByOffset(o.key)) == 0 {
-			return o, true
-		}
-	}
+	i = sort.Search(n, func(i int) bool {
+		return cmp.Compare(l.key(i), k) >= 0
+	})
 
-	return dataOffset{}, false
+	return i, i < n && cmp.Compare(l.key(i), k) == 0
 }
 
 func (l *Leaf) Len() int {
 	return int(l.count)
 }
 
-func (l *Leaf) Insert(k Key, e Entry) (err error) {
+func (l *Leaf) Insert(k Key, e Entry, cmp Comparator) (err error) {
 	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	if l.count >= maxDegree {
+	if int(l.count) >= l.maxDegree() {
 		return errNotEnoughSpace
 	}
 
@@ -87,151 +105,124 @@ func (l *Leaf) Insert(k Key, e Entry) (err error) {
 		panic("key too big")
 	}
 
-	if len(e) > int(maxEntrySize) {
+	if len(e) > l.maxEntrySize() {
 		panic("entry too big")
 	}
 
-	keyPtr := int(l.head)
-	entryPtr := int(leafDataSize) - int(l.tail)
-
-	var h, t uint32
-	{ // check overflow
-		keySize := len(k) + int(keyLenSize)
-		entrySize := len(e) + int(entryLenSize)
-
-		h, t = l.head+uint32(keySize), l.tail+uint32(entrySize)
-
-		if h+t > uint32(leafDataSize) {
-			return errNotEnoughSpace
-		}
+	if l.head+l.tail+uint32(slotSize)+uint32(leafCellSize(k, e)) > uint32(l.dataSize()) {
+		return errNotEnoughSpace
 	}
 
-	l.head = h
-	l.tail = t
-
-	keyPtr = writeKey(l.data[:], k, keyPtr)
-	entryPtr = writeLeafEntry(l.data[:], e, entryPtr)
+	i, _ := l.search(k, cmp)
+	l.insertCell(i, k, e)
 
-	l.count++
 	return nil
 }
 
-func (l *Leaf) Update(k Key, e Entry) (err error) {
+func (l *Leaf) Update(k Key, e Entry, cmp Comparator) (err error) {
 	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	if len(e) > int(maxEntrySize) {
+	if len(e) > l.maxEntrySize() {
 		panic("entry too big")
 	}
 
-	var (
-		offset dataOffset
-		ok     bool
-	)
-
-	offsets := l.offsets()
-	for i := 0; i < len(offsets); i++ {
-		o := offsets[i]
-
-		if k.Compare(l.keyByOffset(o.key)) == 0 {
-			offset = offsets[i]
-			ok = true
-
-			// remove key
-			offsets[i], offsets[len(offsets)-1] = offsets[len(offsets)-1], offsets[i]
-			offsets = offsets[:len(offsets)-1]
-
-			break
-		}
-	}
+	i, ok := l.search(k, cmp)
 	if !ok {
-		return errNotFound
+		return ErrNotFound
 	}
 
-	{ // check overflow
-		tail := l.tail - uint32(offset.entry.len)
-		tail = l.tail + uint32(len(e))
+	o := l.cell(i)
+	if o.entry.len == len(e) {
+		copy(l.entryByOffset(o.entry), e)
+		return nil
+	}
 
-		if l.head+tail > uint32(leafDataSize) {
+	{ // check overflow
+		old := leafCellSize(l.keyByOffset(o.key), l.entryByOffset(o.entry))
+		if l.head+l.tail-uint32(old)+uint32(leafCellSize(k, e)) > uint32(l.dataSize()) {
 			return errNotEnoughSpace
 		}
 	}
 
-	data := make([]byte, leafDataSize)
+	l.remove(i)
+	l.insertCell(i, k, e)
 
-	// write as new entry
-	keyPtr := writeKey(data, k, 0)
-	entryPtr := writeLeafEntry(data, e, int(leafDataSize))
+	return nil
+}
 
-	for i := 0; i < len(offsets); i++ {
-		o := offsets[i]
+func (l *Leaf) Delete(k Key, cmp Comparator) (err error) {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-		keyPtr = writeKey(data, l.keyByOffset(o.key), keyPtr)
-		entryPtr = writeLeafEntry(data, l.entryByOffset(o.entry), entryPtr)
+	i, ok := l.search(k, cmp)
+	if !ok {
+		return ErrNotFound
 	}
 
-	copy(l.data[:], data)
-
-	l.tail = uint32(leafDataSize) - uint32(entryPtr)
+	l.remove(i)
 
 	return nil
 }
 
-func (l *Leaf) Delete(k Key) (err error) {
-	defer armtracer.EndTrace(armtracer.BeginTrace(""))
-
-	var ok bool
+func (l *Leaf) Write(data []byte) (n int, err error) {
+	if len(data) > l.dataSize() {
+		return 0, errNotEnoughSpace
+	}
 
-	offsets := l.offsets()
-	for i := 0; i < len(offsets); i++ {
-		o := offsets[i]
+	return copy(l.data(), data), nil
+}
 
-		if k.Compare(l.keyByOffset(o.key)) == 0 {
-			ok = true
+func (l *Leaf) IsFull() bool {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-			// remove key
-			offsets[i], offsets[len(offsets)-1] = offsets[len(offsets)-1], offsets[i]
-			offsets = offsets[:len(offsets)-1]
+	return int(l.count) >= l.maxDegree() || l.head+l.tail >= uint32(l.dataSize())/2
+}
 
-			break
-		}
-	}
-	if !ok {
-		return errNotFound
-	}
+// IsUnderflow reports whether the leaf should borrow from or merge with a sibling.
+func (l *Leaf) IsUnderflow() bool {
+	return int(l.count) < l.minDegree() && l.head+l.tail < uint32(l.dataSize())/4
+}
 
-	data := make([]byte, leafDataSize)
+// items returns copies of keys and entries in key order.
+func (l *Leaf) items() (keys []Key, entries []Entry) {
+	keys = make([]Key, l.count)
+	entries = make([]Entry, l.count)
+	for i := 0; i < int(l.count); i++ {
+		o := l.cell(i)
 
-	keyPtr := 0
-	entryPtr := int(leafDataSize)
+		keys[i] = append(Key{}, l.keyByOffset(o.key)...)
+		entries[i] = append(Entry{}, l.entryByOffset(o.entry)...)
+	}
 
-	for i := 0; i < len(offsets); i++ {
-		o := offsets[i]
+	return keys, entries
+}
 
-		keyPtr = writeKey(data, l.keyByOffset(o.key), keyPtr)
-		entryPtr = writeLeafEntry(data, l.entryByOffset(o.entry), entryPtr)
+// reset replaces the content of the leaf with keys and entries in key order.
+func (l *Leaf) reset(keys []Key, entries []Entry) error {
+	if len(keys) > l.maxDegree() || leafSize(keys, entries) > l.dataSize() {
+		return errNotEnoughSpace
 	}
 
-	copy(l.data[:], data)
+	l.head, l.tail, l.count = 0, 0, 0
 
-	l.head = uint32(keyPtr)
-	l.tail = uint32(leafDataSize) - uint32(entryPtr)
+	for i := 0; i < len(keys); i++ {
+		l.insertCell(i, keys[i], entries[i])
+	}
 
-	l.count--
 	return nil
 }
 
-func (l *Leaf) Write(data []byte) (n int, err error) {
-	if len(data) > len(l.data) {
-		return 0, errNotEnoughSpace
+// leafSize returns the number of bytes keys and entries take in a leaf.
+func leafSize(keys []Key, entries []Entry) int {
+	size := 0
+	for i := 0; i < len(keys); i++ {
+		size += int(slotSize) + leafCellSize(keys[i], entries[i])
 	}
 
-	return copy(l.data[:], data), nil
+	return size
 }
 
-func (l *Leaf) IsFull() bool {
-	defer armtracer.EndTrace(armtracer.BeginTrace(""))
-
-	return l.count >= maxDegree || l.head+l.tail >= uint32(leafDataSize)/2
+func leafCellSize(k Key, e Entry) int {
+	return int(keyLenSize) + len(k) + int(entryLenSize) + len(e)
 }
 
 func (src *Leaf) Split(dst *Leaf) (pivot Key) {
@@ -250,110 +241,113 @@ func (src *Leaf) Split(dst *Leaf) (pivot Key) {
 	src.right = dst.id
 	dst.left = src.id
 
-	offsets := src.sortedOffsets()
+	keys, entries := src.items()
 
-	mid := (len(offsets) + 1) / 2
-	midOffset := offsets[mid]
-	midKey := src.keyByOffset(midOffset.key)
-	midEntry := src.entryByOffset(midOffset.entry)
-
-	src.count = 0
-	dst.count = 1 // mid entry
-
-	{ // offsets[mid:len(offsets)) dst keys
-		keyPtr := 0
-		entryPtr := int(leafDataSize)
+	// halve the keys, then move the middle while a half is still full: entries
+	// of different sizes may fill one half alone
+	mid := (len(keys) + 1) / 2
+	for mid > 1 && leafFull(src, keys[:mid], entries[:mid]) {
+		mid--
+	}
+	for mid < len(keys)-1 && leafFull(src, keys[mid:], entries[mid:]) && !leafFull(src, keys[:mid+1], entries[:mid+1]) {
+		mid++
+	}
 
-		data := dst.data[:]
+	// [mid:len(keys)) dst keys, [0:mid) src keys
+	if dst.reset(keys[mid:], entries[mid:]) != nil || src.reset(keys[:mid], entries[:mid]) != nil {
+		panic("inconsistent leaf page")
+	}
 
-		keyPtr = writeKey(data, midKey, keyPtr)
-		entryPtr = writeLeafEntry(data, midEntry, entryPtr)
+	return dst.key(0)
+}
 
-		pivot = data[keyPtr-len(midKey) : keyPtr]
+// insertCell writes the cell of k and e and puts its slot at position i.
+// The caller checks that the leaf has enough space.
+func (l *Leaf) insertCell(i int, k Key, e Entry) {
+	size := leafCellSize(k, e)
+	off := l.dataSize() - int(l.tail) - size
 
-		for i := mid + 1; i < len(offsets); i++ {
-			o := offsets[i]
+	ptr := writeKey(l.data(), k, off)
+	ptr = pack.Uint32(l.data(), uint32(len(e)), ptr)
+	copy(l.data()[ptr:ptr+len(e)], e)
 
-			keyPtr = writeKey(data, src.keyByOffset(o.key), keyPtr)
-			entryPtr = writeLeafEntry(data, src.entryByOffset(o.entry), entryPtr)
-			dst.count++
-		}
+	insertSlot(l.data(), int(l.count), i, off)
 
-		dst.head = uint32(keyPtr)
-		dst.tail = uint32(leafDataSize) - uint32(entryPtr)
-	}
+	l.head += uint32(slotSize)
+	l.tail += uint32(size)
+	l.count++
+}
 
-	{ // offsets[0:mid) src keys
-		keyPtr := 0
-		entryPtr := int(leafDataSize)
+// remove drops the i-th slot and compacts the remaining cells.
+func (l *Leaf) remove(i int) {
+	deleteSlot(l.data(), int(l.count), i)
 
-		data := make([]byte, leafDataSize)
-		for i := 0; i < mid; i++ {
-			o := offsets[i]
+	l.head -= uint32(slotSize)
+	l.count--
 
-			keyPtr = writeKey(data, src.keyByOffset(o.key), keyPtr)
-			entryPtr = writeLeafEntry(data, src.entryByOffset(o.entry), entryPtr)
-			src.count++
-		}
+	data := make([]byte, l.dataSize())
 
-		copy(src.data[:], data)
+	ptr := l.dataSize()
+	for j := 0; j < int(l.count); j++ {
+		off := readSlot(l.data(), j)
+		o := l.cell(j)
+		end := o.entry.offset + o.entry.len
 
-		src.head = uint32(keyPtr)
-		src.tail = uint32(leafDataSize) - uint32(entryPtr)
+		ptr -= end - off
+		copy(data[ptr:], l.data()[off:end])
+		writeSlot(data, j, ptr)
 	}
 
-	return pivot
-}
-
-func (l *Leaf) offsets() []dataOffset {
-	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+	copy(l.data(), data)
 
-	res := make([]dataOffset, l.count)
+	l.tail = uint32(l.dataSize()) - uint32(ptr)
+}
 
-	keyPtr := 0
-	entryPtr := len(l.data)
+// cell decodes the cell of the i-th slot.
+func (l *Leaf) cell(i int) (o dataOffset) {
+	var (
+		lnKey   uint16
+		lnEntry uint32
+	)
 
-	for i := 0; i < int(l.count); i++ {
-		var (
-			lnKey   uint16
-			lnEntry uint32
-			o       dataOffset
-		)
+	ptr := readSlot(l.data(), i)
 
-		lnKey, keyPtr = unpack.Uint16(l.data[:], keyPtr)
-		o.key = keyOffset{len: int(lnKey), offset: keyPtr}
-		keyPtr += int(lnKey)
+	lnKey, ptr = unpack.Uint16(l.data(), ptr)
+	o.key = keyOffset{len: int(lnKey), offset: ptr}
+	ptr += int(lnKey)
 
-		entryPtr -= int(entryLenSize)
-		lnEntry, _ = unpack.Uint32(l.data[entryPtr:], 0)
+	lnEntry, ptr = unpack.Uint32(l.data(), ptr)
+	o.entry = entryOffset{len: int(lnEntry), offset: ptr}
 
-		entryPtr -= int(lnEntry)
-		o.entry = entryOffset{len: int(lnEntry), offset: entryPtr}
+	return o
+}
 
-		res[i] = o
-	}
+func (l *Leaf) key(i int) Key {
+	return l.keyByOffset(l.cell(i).key)
+}
 
-	return res
+func (l *Leaf) entry(i int) Entry {
+	return l.entryByOffset(l.cell(i).entry)
 }
 
-func (l *Leaf) sortedOffsets() []dataOffset {
+// offsets returns the cells in key order.
+func (l *Leaf) offsets() []dataOffset {
 	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	offsets := l.offsets()
-
-	sort.Slice(offsets, func(i, j int) bool {
-		return l.keyByOffset(offsets[i].key).Less(l.keyByOffset(offsets[j].key))
-	})
+	res := make([]dataOffset, l.count)
+	for i := 0; i < int(l.count); i++ {
+		res[i] = l.cell(i)
+	}
 
-	return offsets
+	return res
 }
 
 func (l *Leaf) keyByOffset(o keyOffset) Key {
-	return l.data[o.offset : o.offset+o.len]
+	return l.data()[o.offset : o.offset+o.len]
 }
 
 func (l *Leaf) entryByOffset(o entryOffset) Entry {
-	return l.data[o.offset : o.offset+o.len]
+	return l.data()[o.offset : o.offset+o.len]
 }
 
 func writeKey(dst []byte, src []byte, ptr int) int {
@@ -366,25 +360,10 @@ func writeKey(dst []byte, src []byte, ptr int) int {
 }
 
 func (l *Leaf) Print(level []byte) {
-	offsets := l.sortedOffsets()
-
-	for _, o := range offsets {
-		k := string(l.data[o.key.offset : o.key.offset+o.key.len])
-		e := Entry(l.data[o.entry.offset : o.entry.offset+o.entry.len])
+	for _, o := range l.offsets() {
+		k := string(l.keyByOffset(o.key))
+		e := l.entryByOffset(o.entry)
 
 		fmt.Fprintf(os.Stderr, "%s key: %s, entry: %s\n", level, k, e.Format())
 	}
-
-}
-
-func writeLeafEntry(dst, src []byte, ptr int) int {
-	ln := len(src)
-
-	ptr -= int(entryLenSize)
-	pack.Uint32(dst[ptr:], uint32(ln), 0)
-
-	ptr -= ln
-	copy(dst[ptr:ptr+ln], src)
-
-	return ptr
 }
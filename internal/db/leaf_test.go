@@ -2,7 +2,10 @@ package db
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/sergei-durkin/armtracer"
@@ -21,7 +24,7 @@ func TestLeafInsert(t *testing.T) {
 	k := []byte("key")
 	e := []byte("entry")
 
-	err := p.Leaf().Insert(k, e)
+	err := p.Leaf().Insert(k, e, LengthFirst)
 	if err != nil {
 		t.Fatal(fmt.Errorf("insert error: %w", err))
 	}
@@ -53,7 +56,7 @@ func TestLeafInsert(t *testing.T) {
 	k2 := []byte("anotherKey")
 	e2 := []byte("anotherEntry")
 
-	err = p.Leaf().Insert(k2, e2)
+	err = p.Leaf().Insert(k2, e2, LengthFirst)
 	if err != nil {
 		t.Fatal(fmt.Errorf("insert error: %w", err))
 	}
@@ -70,7 +73,7 @@ func TestLeafSplit(t *testing.T) {
 	k := []byte("key")
 	e := []byte("entry")
 
-	err := src.Leaf().Insert(k, e)
+	err := src.Leaf().Insert(k, e, LengthFirst)
 	if err != nil {
 		t.Fatal(fmt.Errorf("insert error: %w", err))
 	}
@@ -78,7 +81,7 @@ func TestLeafSplit(t *testing.T) {
 	k2 := []byte("anotherKey")
 	e2 := []byte("anotherEntry")
 
-	err = src.Leaf().Insert(k2, e2)
+	err = src.Leaf().Insert(k2, e2, LengthFirst)
 	if err != nil {
 		t.Fatal(fmt.Errorf("insert error: %w", err))
 	}
@@ -86,7 +89,7 @@ func TestLeafSplit(t *testing.T) {
 	k3 := []byte("otherKey")
 	e3 := []byte("otherEntry")
 
-	err = src.Leaf().Insert(k3, e3)
+	err = src.Leaf().Insert(k3, e3, LengthFirst)
 	if err != nil {
 		t.Fatal(fmt.Errorf("insert error: %w", err))
 	}
@@ -116,7 +119,7 @@ func TestLeafSplit(t *testing.T) {
 	k4 := []byte("awesomeKey")
 	e4 := []byte("awesomeEntry")
 
-	err = src.Leaf().Insert(k4, e4)
+	err = src.Leaf().Insert(k4, e4, LengthFirst)
 	if err != nil {
 		t.Fatalf("insert return an error: %s", err.Error())
 	}
@@ -208,7 +211,7 @@ func TestLeafSplitEq(t *testing.T) {
 	k := []byte("key")
 	e := []byte("entry")
 
-	err := src.Leaf().Insert(k, e)
+	err := src.Leaf().Insert(k, e, LengthFirst)
 	if err != nil {
 		t.Fatal(fmt.Errorf("insert error: %w", err))
 	}
@@ -216,7 +219,7 @@ func TestLeafSplitEq(t *testing.T) {
 	k2 := []byte("anotherKey")
 	e2 := []byte("anotherEntry")
 
-	err = src.Leaf().Insert(k2, e2)
+	err = src.Leaf().Insert(k2, e2, LengthFirst)
 	if err != nil {
 		t.Fatal(fmt.Errorf("insert error: %w", err))
 	}
@@ -224,7 +227,7 @@ func TestLeafSplitEq(t *testing.T) {
 	k3 := []byte("otherKey")
 	e3 := []byte("otherEntry")
 
-	err = src.Leaf().Insert(k3, e3)
+	err = src.Leaf().Insert(k3, e3, LengthFirst)
 	if err != nil {
 		t.Fatal(fmt.Errorf("insert error: %w", err))
 	}
@@ -251,7 +254,7 @@ func TestLeafSplitEq(t *testing.T) {
 	*/
 	e4 := []byte("awesomeEntry")
 
-	err = src.Leaf().Update(k2, e4)
+	err = src.Leaf().Update(k2, e4, LengthFirst)
 	if err != nil {
 		t.Fatalf("insert return an error: %s", err.Error())
 	}
@@ -320,3 +323,72 @@ func TestLeafSplitEq(t *testing.T) {
 		t.Fatalf("right src neighbor should be dst: %d != %d", src.Leaf().right, 6)
 	}
 }
+
+func TestLeafSlots(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	p := NewPage(5, 5, PageTypeLeaf)
+	l := p.Leaf()
+
+	order := []int{7, 2, 9, 0, 5, 3, 8, 1, 6, 4}
+	for _, i := range order {
+		err := l.Insert(Key("key_"+strconv.Itoa(i)), Entry(strings.Repeat("v", i+1)), Bytewise)
+		if err != nil {
+			t.Fatal(fmt.Errorf("insert error: %w", err))
+		}
+	}
+
+	// grow and shrink entries so that cells are moved
+	err := l.Update(Key("key_3"), Entry(strings.Repeat("u", 100)), Bytewise)
+	if err != nil {
+		t.Fatal(fmt.Errorf("update error: %w", err))
+	}
+
+	err = l.Update(Key("key_9"), Entry("u"), Bytewise)
+	if err != nil {
+		t.Fatal(fmt.Errorf("update error: %w", err))
+	}
+
+	for _, i := range []int{0, 5, 9} {
+		err = l.Delete(Key("key_"+strconv.Itoa(i)), Bytewise)
+		if err != nil {
+			t.Fatal(fmt.Errorf("delete error: %w", err))
+		}
+	}
+
+	err = l.Delete(Key("key_5"), Bytewise)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleted key should not be found, got %v", err)
+	}
+
+	expected := []int{1, 2, 3, 4, 6, 7, 8}
+
+	keys, entries := l.items()
+	if len(keys) != len(expected) {
+		t.Fatalf("leaf should have %d keys, got %d", len(expected), len(keys))
+	}
+
+	size := 0
+	for j, i := range expected {
+		k := Key("key_" + strconv.Itoa(i))
+		if keys[j].Compare(k) != 0 {
+			t.Fatalf("keys should be sorted: %q != %q at %d", keys[j], k, j)
+		}
+
+		e := Entry(strings.Repeat("v", i+1))
+		if i == 3 {
+			e = Entry(strings.Repeat("u", 100))
+		}
+
+		if !bytes.Equal(entries[j], e) || !bytes.Equal(l.Find(k, Bytewise), e) {
+			t.Fatalf("unexpected entry of %q: %q", k, entries[j])
+		}
+
+		size += int(slotSize) + leafCellSize(k, e)
+	}
+
+	if int(l.head+l.tail) != size {
+		t.Fatalf("deleted cells should be compacted: %d bytes used, expected %d", l.head+l.tail, size)
+	}
+}
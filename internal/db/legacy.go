@@ -0,0 +1,129 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"wal/internal/binary/unpack"
+)
+
+// Pages of files before slotVersion keep keys from the start of the data and
+// entries from its end in insertion order:
+//
+//	| [len | key] | .... | [value | len] |
+//
+// legacyItems and legacyChildren decode them for the migration.
+
+func (l *Leaf) legacyItems(cmp Comparator) (keys []Key, entries []Entry) {
+	keyPtr := 0
+	entryPtr := l.dataSize()
+
+	for i := 0; i < int(l.count); i++ {
+		var (
+			lnKey   uint16
+			lnEntry uint32
+		)
+
+		lnKey, keyPtr = unpack.Uint16(l.data(), keyPtr)
+		keys = append(keys, append(Key{}, l.data()[keyPtr:keyPtr+int(lnKey)]...))
+		keyPtr += int(lnKey)
+
+		entryPtr -= int(entryLenSize)
+		lnEntry, _ = unpack.Uint32(l.data()[entryPtr:], 0)
+
+		entryPtr -= int(lnEntry)
+		entries = append(entries, append(Entry{}, l.data()[entryPtr:entryPtr+int(lnEntry)]...))
+	}
+
+	sort.Sort(legacyItems{keys: keys, entries: entries, cmp: cmp})
+
+	return keys, entries
+}
+
+func (n *Node) legacyChildren(cmp Comparator) (keys []Key, ids []uint64) {
+	var children []Entry
+
+	keyPtr := 0
+	entryPtr := n.dataSize()
+
+	for i := 0; i < int(n.count); i++ {
+		var lnKey uint16
+
+		lnKey, keyPtr = unpack.Uint16(n.data(), keyPtr)
+		keys = append(keys, append(Key{}, n.data()[keyPtr:keyPtr+int(lnKey)]...))
+		keyPtr += int(lnKey)
+
+		entryPtr -= int(nodeEntrySize)
+		children = append(children, append(Entry{}, n.data()[entryPtr:entryPtr+int(nodeEntrySize)]...))
+	}
+
+	sort.Sort(legacyItems{keys: keys, entries: children, cmp: cmp})
+
+	ids = append(ids, n.less)
+	for i := 0; i < len(children); i++ {
+		id, _ := unpack.Uint64(children[i], 0)
+		ids = append(ids, id)
+	}
+
+	return keys, ids
+}
+
+// migrateSlots converts a file written before slotVersion, see
+// Pager.migrateSlots. Entries that didn't fit their leaf with the slots are
+// inserted again, splitting it. Write-back is held until the whole file is
+// converted and synced, so the file never has a part of the migration.
+func (t *Tree) migrateSlots() error {
+	t.pager.Hold()
+
+	spill, migrated, err := t.pager.migrateSlots(t.cmp)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(spill.keys); i++ {
+		p, path, err := t.findLeaf(spill.keys[i])
+		if err != nil {
+			return err
+		}
+
+		pages, freed, err := t.put(p, path, spill.keys[i], spill.entries[i], false, nil, nil)
+		if err != nil {
+			return fmt.Errorf("could not insert spilled key: %w", err)
+		}
+
+		err = t.flush(0, pages, freed)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = t.pager.Release()
+	if err != nil {
+		return err
+	}
+
+	if !migrated {
+		return nil
+	}
+
+	return t.pager.Sync()
+}
+
+// legacyItems sorts keys and their entries together.
+type legacyItems struct {
+	keys    []Key
+	entries []Entry
+	cmp     Comparator
+}
+
+func (s legacyItems) Len() int {
+	return len(s.keys)
+}
+
+func (s legacyItems) Less(i, j int) bool {
+	return s.cmp.Compare(s.keys[i], s.keys[j]) < 0
+}
+
+func (s legacyItems) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
+}
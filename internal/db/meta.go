@@ -1,9 +1,14 @@
 package db
 
 import (
+	"bytes"
 	"unsafe"
 )
 
+const (
+	metaSize = unsafe.Sizeof(Meta{})
+)
+
 type Meta struct {
 	header
 
@@ -12,15 +17,42 @@ type Meta struct {
 	root    uint64
 	freeMap uint64
 
-	_ [pageDataSize - 4*unsafe.Sizeof(int64(0))]byte
+	// name of the comparator, empty in files created before it was persisted
+	comparator [comparatorNameSize]byte
+
+	// layout of every page of the file, zero in files created before it was
+	// configurable
+	pageSize uint32
+	degree   uint32
 }
 
 func (m *Meta) Page() *Page {
-	return (*Page)(unsafe.Pointer(m))
+	return m.header.page()
 }
 
 func (m *Meta) init() {
 	m.version = DB_VERSION
 	m.root = 0
 	m.freeMap = 0
+	m.comparator = [comparatorNameSize]byte{}
+	m.pageSize = m.size
+	m.degree = uint32(m.header.degree)
+}
+
+func (m *Meta) Comparator() string {
+	return string(bytes.TrimRight(m.comparator[:], "\x00"))
+}
+
+// layout returns the page size and the degree of the file.
+func (m *Meta) layout() (size int, degree int) {
+	size, degree = int(m.pageSize), int(m.degree)
+	if size == 0 {
+		size = defaultPageSize
+	}
+
+	if degree == 0 {
+		degree = defaultDegree
+	}
+
+	return size, degree
 }
@@ -10,21 +10,41 @@ import (
 )
 
 const (
-	nodeEntrySize = unsafe.Sizeof(uint64(0))
-	nodeDataSize  = pageDataSize - 2*unsafe.Sizeof(uint64(0))
+	nodeHeaderSize = unsafe.Sizeof(Node{})
+	nodeEntrySize  = unsafe.Sizeof(uint64(0))
+
+	// a split moves the middle key up and leaves a key on either side
+	minSplitKeys = 3
 )
 
+func init() {
+	// a node that is not full yet takes one more key, so it must fit
+	// minSplitKeys keys of the maximum size
+	maxCell := int(slotSize) + int(keyLenSize) + maxKeySize + int(nodeEntrySize)
+	if minSplitKeys*maxCell > minPageSize-int(nodeHeaderSize) {
+		panic("page size too small")
+	}
+}
+
 type Node struct {
 	header
 
 	count uint64
 	less  uint64 // pageID of less child
 
-	data [nodeDataSize]byte
+	// followed by the data up to the end of the page
 }
 
 func (n *Node) Page() *Page {
-	return (*Page)(unsafe.Pointer(n))
+	return n.header.page()
+}
+
+func (n *Node) data() []byte {
+	return n.body(nodeHeaderSize)
+}
+
+func (n *Node) dataSize() int {
+	return int(n.size) - int(nodeHeaderSize)
 }
 
 func (n *Node) init() {
@@ -36,126 +56,195 @@ func (n *Node) Len() int {
 }
 
 func (n *Node) Entries() []uint64 {
-	offsets := n.sortedOffsets()
-
-	res := make([]uint64, 0, len(offsets)+1)
+	res := make([]uint64, 0, n.count+1)
 	res = append(res, n.less)
-	for i := 0; i < len(offsets); i++ {
-		res = append(res, n.entryByOffset(offsets[i].entry))
+	for i := 0; i < int(n.count); i++ {
+		res = append(res, n.child(i))
 	}
 
 	return res
 }
 
-func (n *Node) Find(k Key) (next uint64, found bool) {
+func (n *Node) Find(k Key, cmp Comparator) (next uint64, found bool) {
 	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	prev := n.less
-	offsets := n.sortedOffsets()
-	for i := 0; i < len(offsets); i++ {
-		o := offsets[i]
-
-		if k.Less(n.keyByOffset(o.key)) {
-			return prev, prev > 0
-		}
+	// the first key greater than k, the child before it holds k
+	i := sort.Search(int(n.count), func(i int) bool {
+		return cmp.Compare(k, n.key(i)) < 0
+	})
 
-		prev = n.entryByOffset(o.entry)
+	next = n.less
+	if i > 0 {
+		next = n.child(i - 1)
 	}
 
-	return prev, prev > 0
+	return next, next > 0
 }
 
-func (n *Node) DeleteByChildID(e uint64) (err error) {
+// search returns the position of the first key that is greater than or equal
+// to k and whether it is equal to k.
+func (n *Node) search(k Key, cmp Comparator) (i int, found bool) {
 	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	offsets := n.offsets()
-	for i := 0; i < len(offsets); i++ {
-		o := offsets[i]
+	cnt := int(n.count)
 
-		if e == n.entryByOffset(o.entry) {
-			// remove key
-			offsets[i], offsets[len(offsets)-1] = offsets[len(offsets)-1], offsets[i]
-			offsets = offsets[:len(offsets)-1]
-		}
-	}
+	i = sort.Search(cnt, func(i int) bool {
+		return cmp.Compare(n.key(i), k) >= 0
+	})
 
-	data := make([]byte, nodeDataSize)
+	return i, i < cnt && cmp.Compare(n.key(i), k) == 0
+}
 
-	keyPtr := 0
-	entryPtr := int(nodeDataSize)
+func (n *Node) DeleteByChildID(e uint64) (err error) {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	for i := 0; i < len(offsets); i++ {
-		o := offsets[i]
+	i := -1
+	if e == n.less {
+		if n.count == 0 {
+			return ErrNotFound
+		}
 
-		keyPtr = writeKey(data, n.keyByOffset(o.key), keyPtr)
-		entryPtr = writeNodeEntry(data, n.entryByOffset(o.entry), entryPtr)
+		// less < k0 <= c0 < k1 ... => c0 < k1 ...
+		n.less = n.child(0)
+		i = 0
+	} else {
+		for j := 0; j < int(n.count); j++ {
+			if e == n.child(j) {
+				i = j
+				break
+			}
+		}
+	}
+	if i < 0 {
+		return ErrNotFound
 	}
 
-	copy(n.data[:], data)
-
-	n.head = uint32(keyPtr)
-	n.tail = uint32(nodeDataSize) - uint32(entryPtr)
+	n.remove(i)
 
-	n.count--
 	return nil
 }
 
-func (n *Node) Insert(k Key, e uint64) (err error) {
+// ReplaceChild points the link to child old at child e instead.
+func (n *Node) ReplaceChild(old, e uint64) (err error) {
 	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	if n.count >= maxDegree {
-		return errNotEnoughSpace
+	if n.less == old {
+		n.less = e
+		return nil
+	}
+
+	for i := 0; i < int(n.count); i++ {
+		o := n.cell(i)
+		if n.entryByOffset(o.entry) == old {
+			pack.Uint64(n.data()[o.entry.offset:], e, 0)
+			return nil
+		}
 	}
 
-	keyPtr := int(n.head)
-	entryPtr := int(len(n.data)) - int(n.tail)
+	return ErrNotFound
+}
 
-	keySize := len(k) + int(keyLenSize)
-	entrySize := int(nodeEntrySize)
+func (n *Node) Insert(k Key, e uint64, cmp Comparator) (err error) {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	if keyPtr+keySize >= entryPtr-entrySize {
+	if int(n.count) >= n.maxDegree() {
 		return errNotEnoughSpace
 	}
 
-	n.head += uint32(keySize)
-	n.tail += uint32(entrySize)
-
-	keyPtr = writeKey(n.data[:], k, keyPtr)
+	if n.head+n.tail+uint32(slotSize)+uint32(nodeCellSize(k)) > uint32(n.dataSize()) {
+		return errNotEnoughSpace
+	}
 
-	entryPtr -= entrySize
-	pack.Uint64(n.data[entryPtr:], e, 0)
+	i, _ := n.search(k, cmp)
+	n.insertCell(i, k, e)
 
-	n.count++
 	return nil
 }
 
-func (n *Node) Update(k Key, e uint64) (err error) {
+func (n *Node) Update(k Key, e uint64, cmp Comparator) (err error) {
 	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	offsets := n.offsets()
-	for i := 0; i < len(offsets); i++ {
-		o := offsets[i]
-		if k.Compare(n.keyByOffset(o.key)) == 0 {
-			pack.Uint64(n.data[o.entry.offset:], e, 0)
-			return
-		}
+	i, ok := n.search(k, cmp)
+	if !ok {
+		return ErrNotFound
 	}
 
-	return errNotFound
+	pack.Uint64(n.data()[n.cell(i).entry.offset:], e, 0)
+
+	return nil
 }
 
 func (n *Node) Write(data []byte) (cnt int, err error) {
-	if len(data) > len(n.data) {
+	if len(data) > n.dataSize() {
 		return 0, errNotEnoughSpace
 	}
 
-	return copy(n.data[:], data), nil
+	return copy(n.data(), data), nil
 }
 
+// IsFull reports whether the node should split. A node filled by bytes splits
+// only once it holds the three keys a split needs, the page keeps room for
+// them even with keys of the maximum size, see init.
 func (n *Node) IsFull() bool {
 	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	return n.count >= maxDegree || n.head+n.tail >= uint32(nodeDataSize)/2
+	return int(n.count) >= n.maxDegree() || n.count >= minSplitKeys && n.head+n.tail >= uint32(n.dataSize())/2
+}
+
+// IsUnderflow reports whether the node should borrow from or merge with a sibling.
+func (n *Node) IsUnderflow() bool {
+	return int(n.count) < n.minDegree() && n.head+n.tail < uint32(n.dataSize())/4
+}
+
+// children returns copies of keys in key order and the children around them,
+// the first child is less than every key.
+func (n *Node) children() (keys []Key, ids []uint64) {
+	keys = make([]Key, n.count)
+	ids = make([]uint64, 0, n.count+1)
+
+	ids = append(ids, n.less)
+	for i := 0; i < int(n.count); i++ {
+		o := n.cell(i)
+
+		keys[i] = append(Key{}, n.keyByOffset(o.key)...)
+		ids = append(ids, n.entryByOffset(o.entry))
+	}
+
+	return keys, ids
+}
+
+// reset replaces the content of the node with keys and children as returned by children.
+func (n *Node) reset(keys []Key, ids []uint64) error {
+	if len(ids) != len(keys)+1 {
+		panic("inconsistent node children")
+	}
+
+	if len(keys) > n.maxDegree() || nodeSize(keys) > n.dataSize() {
+		return errNotEnoughSpace
+	}
+
+	n.head, n.tail, n.count = 0, 0, 0
+	n.less = ids[0]
+
+	for i := 0; i < len(keys); i++ {
+		n.insertCell(i, keys[i], ids[i+1])
+	}
+
+	return nil
+}
+
+// nodeSize returns the number of bytes keys and their children take in a node.
+func nodeSize(keys []Key) int {
+	size := 0
+	for i := 0; i < len(keys); i++ {
+		size += int(slotSize) + nodeCellSize(keys[i])
+	}
+
+	return size
+}
+
+func nodeCellSize(k Key) int {
+	return int(keyLenSize) + len(k) + int(nodeEntrySize)
 }
 
 func (src *Node) Split(dst *Node) (pivot Key) {
@@ -165,117 +254,105 @@ func (src *Node) Split(dst *Node) (pivot Key) {
 		panic("dst node is not empty")
 	}
 
-	if src.count <= 2 {
+	if src.count < minSplitKeys {
 		panic("inconsistent node")
 	}
 
-	offsets := src.sortedOffsets()
+	keys, ids := src.children()
 
-	mid := len(offsets) / 2
-	midOffset := offsets[mid]
-	midKey := src.keyByOffset(midOffset.key)
-	midEntry := src.entryByOffset(midOffset.entry)
+	mid := len(keys) / 2
+	pivot = keys[mid]
+
+	// keys(mid:len(keys)) dst keys, keys[0:mid) src keys, the child of the
+	// pivot becomes the less child of dst
+	if dst.reset(keys[mid+1:], ids[mid+1:]) != nil || src.reset(keys[:mid], ids[:mid+1]) != nil {
+		panic("inconsistent node")
+	}
 
-	pivot = append([]byte{}, midKey...)
-	dst.less = midEntry
+	return pivot
+}
 
-	src.count = 0
-	dst.count = 0
+// insertCell writes the cell of k and e and puts its slot at position i.
+// The caller checks that the node has enough space.
+func (n *Node) insertCell(i int, k Key, e uint64) {
+	size := nodeCellSize(k)
+	off := n.dataSize() - int(n.tail) - size
 
-	{ // offsets(mid:len(offsets)) dst keys
-		keyPtr := 0
-		entryPtr := int(nodeDataSize)
+	ptr := writeKey(n.data(), k, off)
+	pack.Uint64(n.data(), e, ptr)
 
-		data := dst.data[:]
-		for i := mid + 1; i < len(offsets); i++ {
-			o := offsets[i]
+	insertSlot(n.data(), int(n.count), i, off)
 
-			keyPtr = writeKey(data, src.keyByOffset(o.key), keyPtr)
+	n.head += uint32(slotSize)
+	n.tail += uint32(size)
+	n.count++
+}
 
-			entryPtr = writeNodeEntry(data, src.entryByOffset(o.entry), entryPtr)
+// remove drops the i-th slot and compacts the remaining cells.
+func (n *Node) remove(i int) {
+	deleteSlot(n.data(), int(n.count), i)
 
-			dst.count++
-		}
+	n.head -= uint32(slotSize)
+	n.count--
 
-		dst.head = uint32(keyPtr)
-		dst.tail = uint32(nodeDataSize) - uint32(entryPtr)
+	data := make([]byte, n.dataSize())
+
+	ptr := n.dataSize()
+	for j := 0; j < int(n.count); j++ {
+		off := readSlot(n.data(), j)
+		o := n.cell(j)
+		end := o.entry.offset + o.entry.len
+
+		ptr -= end - off
+		copy(data[ptr:], n.data()[off:end])
+		writeSlot(data, j, ptr)
 	}
 
-	{ // offsets[0:mid) src keys
-		keyPtr := 0
-		entryPtr := int(nodeDataSize)
+	copy(n.data(), data)
 
-		data := make([]byte, nodeDataSize)
-		for i := 0; i < mid; i++ {
-			o := offsets[i]
+	n.tail = uint32(n.dataSize()) - uint32(ptr)
+}
 
-			keyPtr = writeKey(data, src.keyByOffset(o.key), keyPtr)
+// cell decodes the cell of the i-th slot.
+func (n *Node) cell(i int) (o dataOffset) {
+	var lnKey uint16
 
-			entryPtr = writeNodeEntry(data, src.entryByOffset(o.entry), entryPtr)
+	ptr := readSlot(n.data(), i)
 
-			src.count++
-		}
+	lnKey, ptr = unpack.Uint16(n.data(), ptr)
+	o.key = keyOffset{len: int(lnKey), offset: ptr}
+	ptr += int(lnKey)
 
-		copy(src.data[:], data)
+	o.entry = entryOffset{len: int(nodeEntrySize), offset: ptr}
 
-		src.head = uint32(keyPtr)
-		src.tail = uint32(nodeDataSize) - uint32(entryPtr)
-	}
+	return o
+}
 
-	return pivot
+func (n *Node) key(i int) Key {
+	return n.keyByOffset(n.cell(i).key)
+}
+
+func (n *Node) child(i int) uint64 {
+	return n.entryByOffset(n.cell(i).entry)
 }
 
+// offsets returns the cells in key order.
 func (n *Node) offsets() []dataOffset {
 	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
 	res := make([]dataOffset, n.count)
-
-	keyPtr := 0
-	entryPtr := len(n.data)
-
 	for i := 0; i < int(n.count); i++ {
-		var (
-			lnKey uint16
-			o     dataOffset
-		)
-
-		lnKey, keyPtr = unpack.Uint16(n.data[:], keyPtr)
-		o.key = keyOffset{len: int(lnKey), offset: keyPtr}
-		keyPtr += int(lnKey)
-
-		entryPtr -= int(nodeEntrySize)
-		o.entry = entryOffset{len: int(nodeEntrySize), offset: entryPtr}
-
-		res[i] = o
+		res[i] = n.cell(i)
 	}
 
 	return res
 }
 
-func (n *Node) sortedOffsets() []dataOffset {
-	defer armtracer.EndTrace(armtracer.BeginTrace(""))
-
-	offsets := n.offsets()
-
-	sort.Slice(offsets, func(i, j int) bool {
-		return n.keyByOffset(offsets[i].key).Less(n.keyByOffset(offsets[j].key))
-	})
-
-	return offsets
-}
-
 func (n *Node) keyByOffset(o keyOffset) Key {
-	return n.data[o.offset : o.offset+o.len]
+	return n.data()[o.offset : o.offset+o.len]
 }
 
 func (n *Node) entryByOffset(o entryOffset) uint64 {
-	res, _ := unpack.Uint64(n.data[o.offset:], 0)
+	res, _ := unpack.Uint64(n.data()[o.offset:], 0)
 	return res
 }
-
-func writeNodeEntry(dst []byte, src uint64, ptr int) int {
-	ptr -= int(nodeEntrySize)
-	pack.Uint64(dst[ptr:], src, 0)
-
-	return ptr
-}
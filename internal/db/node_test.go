@@ -21,7 +21,7 @@ func TestNodeInsert(t *testing.T) {
 	k := []byte("key")
 	e := uint64(15)
 
-	err := p.Node().Insert(k, e)
+	err := p.Node().Insert(k, e, LengthFirst)
 	if err != nil {
 		t.Fatal(fmt.Errorf("insert error: %w", err))
 	}
@@ -53,7 +53,7 @@ func TestNodeInsert(t *testing.T) {
 	k2 := []byte("anotherKey")
 	e2 := uint64(100)
 
-	err = p.Node().Insert(k2, e2)
+	err = p.Node().Insert(k2, e2, LengthFirst)
 	if err != nil {
 		t.Fatal(fmt.Errorf("insert error: %w", err))
 	}
@@ -68,7 +68,7 @@ func TestNodeSplit(t *testing.T) {
 	k := []byte("key")
 	e := uint64(15)
 
-	err := src.Node().Insert(k, e)
+	err := src.Node().Insert(k, e, LengthFirst)
 	if err != nil {
 		t.Fatal(fmt.Errorf("insert error: %w", err))
 	}
@@ -76,7 +76,7 @@ func TestNodeSplit(t *testing.T) {
 	k2 := []byte("anotherKey")
 	e2 := uint64(100)
 
-	err = src.Node().Insert(k2, e2)
+	err = src.Node().Insert(k2, e2, LengthFirst)
 	if err != nil {
 		t.Fatal(fmt.Errorf("insert error: %w", err))
 	}
@@ -84,7 +84,7 @@ func TestNodeSplit(t *testing.T) {
 	k3 := []byte("otherKey")
 	e3 := uint64(500)
 
-	err = src.Node().Insert(k3, e3)
+	err = src.Node().Insert(k3, e3, LengthFirst)
 	if err != nil {
 		t.Fatal(fmt.Errorf("insert error: %w", err))
 	}
@@ -113,7 +113,7 @@ func TestNodeSplit(t *testing.T) {
 	k4 := []byte("awesomeKey")
 	e4 := uint64(1024)
 
-	err = src.Node().Insert(k4, e4)
+	err = src.Node().Insert(k4, e4, LengthFirst)
 	if err != nil {
 		t.Errorf("insert return an error: %s", err.Error())
 	}
@@ -180,7 +180,7 @@ func TestNodeSplitEq(t *testing.T) {
 	k := []byte("key")
 	e := uint64(15)
 
-	err := src.Node().Insert(k, e)
+	err := src.Node().Insert(k, e, LengthFirst)
 	if err != nil {
 		t.Fatal(fmt.Errorf("insert error: %w", err))
 	}
@@ -188,7 +188,7 @@ func TestNodeSplitEq(t *testing.T) {
 	k2 := []byte("anotherKey")
 	e2 := uint64(100)
 
-	err = src.Node().Insert(k2, e2)
+	err = src.Node().Insert(k2, e2, LengthFirst)
 	if err != nil {
 		t.Fatal(fmt.Errorf("insert error: %w", err))
 	}
@@ -196,7 +196,7 @@ func TestNodeSplitEq(t *testing.T) {
 	k3 := []byte("otherKey")
 	e3 := uint64(500)
 
-	err = src.Node().Insert(k3, e3)
+	err = src.Node().Insert(k3, e3, LengthFirst)
 	if err != nil {
 		t.Fatal(fmt.Errorf("insert error: %w", err))
 	}
@@ -224,7 +224,7 @@ func TestNodeSplitEq(t *testing.T) {
 
 	e4 := uint64(1024)
 
-	err = src.Node().Update(k2, e4)
+	err = src.Node().Update(k2, e4, LengthFirst)
 	if err != nil {
 		t.Errorf("insert return an error: %s", err.Error())
 	}
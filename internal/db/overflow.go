@@ -2,21 +2,30 @@ package db
 
 import "unsafe"
 
+const (
+	overflowHeaderSize = unsafe.Sizeof(Overflow{})
+)
+
 type Overflow struct {
 	header
 
 	next uint64
 	len  uint32
 
-	data [pageDataSize - unsafe.Sizeof(uint64(0)) - unsafe.Sizeof(uint32(0))]byte
+	// followed by the data up to the end of the page
+}
+
+// overflowCap returns the number of bytes an overflow page of the given size holds.
+func overflowCap(size int) int {
+	return size - int(overflowHeaderSize)
 }
 
 func (o *Overflow) Page() *Page {
-	return (*Page)(unsafe.Pointer(o))
+	return o.header.page()
 }
 
 func (o *Overflow) Write(data []byte) (n int, _ error) {
-	n = copy(o.data[:], data)
+	n = copy(o.data(), data)
 	o.len = uint32(n)
 
 	return n, nil
@@ -27,5 +36,9 @@ func (o *Overflow) Data() []byte {
 		return nil
 	}
 
-	return o.data[:o.len]
+	return o.data()[:o.len]
+}
+
+func (o *Overflow) data() []byte {
+	return o.body(overflowHeaderSize)
 }
@@ -2,33 +2,48 @@ package db
 
 import (
 	"fmt"
+	"hash/crc32"
+	"math"
 	"unsafe"
 
 	"github.com/sergei-durkin/armtracer"
 )
 
+// Page size and degree are chosen when the file is created and kept in its
+// meta page. Every page carries them in its header, so layouts know their
+// capacity without the pager.
 const (
-	pageSize  = 1 << 13
-	maxDegree = 1 << 4
+	defaultPageSize = 1 << 13
+	minPageSize     = 1 << 12
+	maxPageSize     = 1 << 16
 
-	headerSize   = unsafe.Sizeof(header{})
-	pageDataSize = pageSize - headerSize
+	defaultDegree = 1 << 4
+	lowestDegree  = 3
+	highestDegree = math.MaxUint16
+
+	headerSize = unsafe.Sizeof(header{})
+
+	checksumOffset = unsafe.Offsetof(header{}.checksum)
+	checksumSize   = unsafe.Sizeof(uint32(0))
 )
 
 func init() {
-	if maxDegree < 3 {
-		panic(fmt.Errorf("maxDegree should be >= 3, actual %d", maxDegree))
+	if headerSize != 64 {
+		panic(fmt.Errorf("header size should be 64, actual %d", headerSize))
 	}
+}
 
-	p := len(Page{})
-	l := len((&Leaf{}).Page())
-	n := len((&Node{}).Page())
-	o := len((&Overflow{}).Page())
-	m := len((&Meta{}).Page())
+// validLayout checks the page size and the degree, zero stands for the default.
+func validLayout(size, degree int) error {
+	if size != 0 && (size < minPageSize || size > maxPageSize || size&(size-1) != 0) {
+		return fmt.Errorf("%w: page size %d should be a power of two in %d..%d", errInvalidLayout, size, minPageSize, maxPageSize)
+	}
 
-	if p != l || p != n || p != o || p != m {
-		panic(fmt.Errorf("Pages has inconsistent sizes: Page = %d, Leaf = %d, Node = %d, Overflow = %d, Meta = %d", p, l, n, o, m))
+	if degree != 0 && (degree < lowestDegree || degree > highestDegree) {
+		return fmt.Errorf("%w: degree %d should be in %d..%d", errInvalidLayout, degree, lowestDegree, highestDegree)
 	}
+
+	return nil
 }
 
 type PageType uint16
@@ -38,6 +53,7 @@ const (
 	PageTypeLeaf     PageType = 2
 	PageTypeNode     PageType = 3
 	PageTypeOverflow PageType = 4
+	PageTypeFreeList PageType = 5
 )
 
 const (
@@ -55,41 +71,81 @@ type header struct {
 	magic uint16
 	used  bool
 
-	_ [32]byte // padding
+	checksum uint32 // crc32 of the page with the checksum itself zeroed
+
+	// zero in files created before they were configurable
+	size   uint32
+	degree uint16
+
+	_ [18]byte // padding
 }
 
-type Page [pageSize]byte
+// page returns the page the header belongs to.
+func (h *header) page() *Page {
+	p := Page(unsafe.Slice((*byte)(unsafe.Pointer(h)), h.size))
+	return &p
+}
+
+// body returns the bytes of the page after the first off ones.
+func (h *header) body(off uintptr) []byte {
+	return unsafe.Slice((*byte)(unsafe.Add(unsafe.Pointer(h), off)), uintptr(h.size)-off)
+}
+
+// maxDegree is the number of keys that makes a leaf or a node full.
+func (h *header) maxDegree() int {
+	return int(h.degree)
+}
+
+// minDegree is the number of keys below which a leaf or a node underflows.
+func (h *header) minDegree() int {
+	return int(h.degree)/2 - 1
+}
+
+type Page []byte
 
 func (p *Page) Header() *header {
-	return (*header)(unsafe.Pointer(p))
+	return (*header)(unsafe.Pointer(&(*p)[0]))
 }
 
 func NewPageFromBytes(b []byte) (*Page, error) {
-	if len(b) != pageSize {
+	if validLayout(len(b), 0) != nil {
 		return nil, fmt.Errorf("invalid page size: %d", len(b))
 	}
 
-	p := (*Page)(unsafe.Pointer(&b[0]))
-	if p.Header().magic != magicNumber {
-		return nil, fmt.Errorf("invalid magic number: %x", p.Header().magic)
+	p := Page(b)
+	h := p.Header()
+	if h.magic != magicNumber {
+		return nil, fmt.Errorf("invalid magic number: %x", h.magic)
+	}
+
+	if h.size != 0 && int(h.size) != len(b) {
+		return nil, fmt.Errorf("page size mismatch: expected %d, got %d", len(b), h.size)
 	}
 
-	return p, nil
+	return &p, nil
 }
 
+// NewPage returns a page of the default size and degree.
 func NewPage(id uint64, lsn uint64, typ PageType) *Page {
-	var p Page
+	return newPage(defaultPageSize, defaultDegree, id, lsn, typ)
+}
+
+func newPage(size, degree int, id uint64, lsn uint64, typ PageType) *Page {
+	p := make(Page, size)
 
-	p.init(id, lsn, typ)
+	p.init(id, lsn, typ, degree)
 
 	return &p
 }
 
-func (p *Page) init(id uint64, lsn uint64, typ PageType) {
+func (p *Page) init(id uint64, lsn uint64, typ PageType, degree int) {
 	h := p.Header()
 	h.id = id
 	h.lsn = lsn
 
+	h.size = uint32(len(*p))
+	h.degree = uint16(degree)
+
 	h.head = 0
 	h.tail = 0
 
@@ -108,6 +164,8 @@ func (p *Page) init(id uint64, lsn uint64, typ PageType) {
 		p.Node().init()
 	case PageTypeOverflow:
 		// p.Overflow().init()
+	case PageTypeFreeList:
+		p.FreeList().init()
 	}
 }
 
@@ -128,17 +186,49 @@ func (p *Page) Free() {
 }
 
 func (p *Page) Write(data []byte) (int, error) {
-	if len(data) > len(p) {
-		return 0, fmt.Errorf("data too large for page: %d > %d", len(data), len(p))
+	if len(data) > len(*p) {
+		return 0, fmt.Errorf("data too large for page: %d > %d", len(data), len(*p))
 	}
 
 	return p.Leaf().Write(data)
 }
 
+// clone returns a copy of the page that does not share its bytes.
+func (p *Page) clone() *Page {
+	cp := make(Page, len(*p))
+	copy(cp, *p)
+
+	return &cp
+}
+
+// Pack stamps the checksum and returns the page bytes.
 func (p *Page) Pack() []byte {
 	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	return p[:]
+	p.Header().checksum = p.checksum()
+
+	return *p
+}
+
+// Verify checks the checksum stamped by Pack.
+func (p *Page) Verify() error {
+	expected, actual := p.Header().checksum, p.checksum()
+	if expected != actual {
+		return &CorruptionError{ID: p.ID(), Expected: expected, Actual: actual}
+	}
+
+	return nil
+}
+
+var zeroChecksum [checksumSize]byte
+
+func (p *Page) checksum() uint32 {
+	b := *p
+
+	cks := crc32.ChecksumIEEE(b[:checksumOffset])
+	cks = crc32.Update(cks, crc32.IEEETable, zeroChecksum[:])
+
+	return crc32.Update(cks, crc32.IEEETable, b[checksumOffset+checksumSize:])
 }
 
 func (p *Page) IsMeta() bool {
@@ -151,7 +241,7 @@ func (p *Page) Meta() *Meta {
 		panic(fmt.Sprintf("page is not a meta: %d", h.typ))
 	}
 
-	return (*Meta)(unsafe.Pointer(p))
+	return (*Meta)(unsafe.Pointer(&(*p)[0]))
 }
 
 func (p *Page) IsNode() bool {
@@ -164,7 +254,7 @@ func (p *Page) Node() *Node {
 		panic(fmt.Sprintf("page is not a node: %d", h.typ))
 	}
 
-	return (*Node)(unsafe.Pointer(p))
+	return (*Node)(unsafe.Pointer(&(*p)[0]))
 }
 
 func (p *Page) IsLeaf() bool {
@@ -177,7 +267,7 @@ func (p *Page) Leaf() *Leaf {
 		panic(fmt.Sprintf("page is not a leaf: %d", h.typ))
 	}
 
-	return (*Leaf)(unsafe.Pointer(p))
+	return (*Leaf)(unsafe.Pointer(&(*p)[0]))
 }
 
 func (p *Page) IsOverflow() bool {
@@ -190,5 +280,18 @@ func (p *Page) Overflow() *Overflow {
 		panic(fmt.Sprintf("page is not an overflow: %d", h.typ))
 	}
 
-	return (*Overflow)(unsafe.Pointer(p))
+	return (*Overflow)(unsafe.Pointer(&(*p)[0]))
+}
+
+func (p *Page) IsFreeList() bool {
+	return p.Header().typ == PageTypeFreeList
+}
+
+func (p *Page) FreeList() *FreeList {
+	h := p.Header()
+	if h.typ != PageTypeFreeList {
+		panic(fmt.Sprintf("page is not a free list: %d", h.typ))
+	}
+
+	return (*FreeList)(unsafe.Pointer(&(*p)[0]))
 }
@@ -1,89 +1,626 @@
 package db
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
+	"io"
+	"sync"
+	"unsafe"
 	"wal"
 
 	"github.com/sergei-durkin/armtracer"
 )
 
 const (
-	DB_VERSION = 1
+	DB_VERSION = 3
+
+	// pages of files before this version have no checksum
+	checksumVersion = 2
+
+	// leaves and nodes of files before this version have no slot directory
+	slotVersion = 3
 )
 
 type Pager struct {
 	meta *Meta
+	free *Page // head trunk of the free list
+
+	pool *bufferPool
+
+	// checked is set once the file is known to have checksums on every page
+	checked bool
 
 	w          wal.WriterReaderSeekerCloser
 	freePageID uint64
+
+	// layout of the pages of the file, see Meta.layout
+	pageSize int
+	degree   int
+
+	lsn      uint64                 // the highest LSN pages were stamped with, kept in the meta page on Sync
+	flushLog func(lsn uint64) error // makes the log durable up to lsn, see WithFlushLog
+
+	journal wal.WriterReaderSeekerCloser // double-write file, see WithDoubleWrite
+	holds   int                          // write-back is put off while positive, see Hold
+
+	mu   sync.Mutex
+	seek sync.Mutex // guards the offset of w when it has no ReadAt or WriteAt
+}
+
+type PagerOption func(pg *Pager)
+
+// WithCacheSize sets the number of pages kept in memory.
+func WithCacheSize(pages int) PagerOption {
+	return func(pg *Pager) {
+		pg.pool = newBufferPool(pages)
+	}
+}
+
+// WithPageSize sets the size of pages of a new file, a power of two between
+// 4 KB and 64 KB. An existing file can only be opened with its own page size.
+func WithPageSize(size int) PagerOption {
+	return func(pg *Pager) {
+		pg.pageSize = size
+	}
+}
+
+// WithDegree sets the number of keys that makes a leaf or a node of a new file
+// full. An existing file can only be opened with its own degree.
+func WithDegree(degree int) PagerOption {
+	return func(pg *Pager) {
+		pg.degree = degree
+	}
+}
+
+// WithFlushLog makes the pager call flush before writing a page stamped with
+// an LSN, so the log records of every change in the file reach the disk first.
+func WithFlushLog(flush func(lsn uint64) error) PagerOption {
+	return func(pg *Pager) {
+		pg.flushLog = flush
+	}
+}
+
+// WithDoubleWrite makes every write-back atomic: the dirty pages are written
+// to journal and synced before they are written in place, and on open the
+// pages of a write-back found complete in journal are written again. Without
+// it a crash in the middle of a write-back may leave the file torn.
+func WithDoubleWrite(journal wal.WriterReaderSeekerCloser) PagerOption {
+	return func(pg *Pager) {
+		pg.journal = journal
+	}
 }
 
-func NewPager(w wal.WriterReaderSeekerCloser, size uint64) (*Pager, error) {
+// NewPager opens the file w of the given size. Pages are cached in memory and
+// written to w all at once by WriteBack or Sync. The pager is safe for
+// concurrent use, it reads and writes w with ReadAt and WriteAt when w
+// implements them.
+func NewPager(w wal.WriterReaderSeekerCloser, size uint64, opts ...PagerOption) (*Pager, error) {
 	pg := &Pager{
-		w: w,
+		w:    w,
+		pool: newBufferPool(defaultCacheSize),
+	}
+
+	for _, opt := range opts {
+		opt(pg)
+	}
 
-		freePageID: max(1, size/pageSize),
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	err := validLayout(pg.pageSize, pg.degree)
+	if err != nil {
+		return nil, err
+	}
+
+	// pages written back by the journal may lie past the end of the file
+	end, err := pg.recoverJournal()
+	if err != nil {
+		return nil, fmt.Errorf("could not recover journal: %w", err)
 	}
 
 	{ // Initialize meta page
-		page, err := pg.Read(0)
+		page, err := pg.readMeta()
 		if err != nil {
-			page = NewPage(0, 0, PageTypeMeta)
-			pg.Write(page)
+			return nil, fmt.Errorf("could not read meta: %w", err)
+		}
+
+		if page == nil {
+			pg.pageSize = cmp.Or(pg.pageSize, defaultPageSize)
+			pg.degree = cmp.Or(pg.degree, defaultDegree)
+
+			page = pg.newPage(0, 0, PageTypeMeta)
+			pg.write(page)
 		}
 
 		pg.meta = page.Meta()
+		pg.lsn = pg.meta.lsn
+	}
+
+	pg.freePageID = max(1, size/uint64(pg.pageSize), end)
+
+	if pg.meta.version < checksumVersion {
+		err := pg.migrateChecksums()
+		if err != nil {
+			return nil, fmt.Errorf("could not migrate to version %d: %w", checksumVersion, err)
+		}
+	}
+	pg.checked = true
+
+	if pg.meta.freeMap != 0 {
+		page, err := pg.read(pg.meta.freeMap)
+		if err != nil {
+			return nil, fmt.Errorf("could not read free list %d: %w", pg.meta.freeMap, err)
+		}
+
+		if !page.IsFreeList() {
+			return nil, fmt.Errorf("page %d is not a free list: %d", page.ID(), page.Type())
+		}
+
+		pg.free = page
 	}
 
 	return pg, nil
 }
 
-func (pg *Pager) Alloc(lsn uint64, typ PageType) *Page {
-	p := NewPage(pg.freePageID, lsn, typ)
+// Alloc returns a new page, reusing a free one when the free list is not empty.
+func (pg *Pager) Alloc(lsn uint64, typ PageType) (*Page, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	return pg.alloc(lsn, typ)
+}
+
+func (pg *Pager) alloc(lsn uint64, typ PageType) (*Page, error) {
+	id, err := pg.allocID()
+	if err != nil {
+		return nil, fmt.Errorf("could not allocate page: %w", err)
+	}
+
+	return pg.newPage(id, lsn, typ), nil
+}
+
+func (pg *Pager) newPage(id uint64, lsn uint64, typ PageType) *Page {
+	return newPage(pg.pageSize, pg.degree, id, lsn, typ)
+}
+
+func (pg *Pager) allocID() (uint64, error) {
+	if pg.free == nil {
+		id := pg.freePageID
+		pg.freePageID++
 
-	pg.freePageID++
+		return id, nil
+	}
+
+	head := pg.free
+	fl := head.FreeList()
+	if id, ok := fl.Pop(); ok {
+		return id, pg.write(head)
+	}
+
+	// The head trunk is drained, hand out the trunk page itself. The next
+	// trunk is read before the list changes, pg.mu is released for the read
+	var next *Page
+	if fl.next != 0 {
+		var err error
+
+		next, err = pg.read(fl.next)
+		if err != nil {
+			return 0, fmt.Errorf("could not read free list %d: %w", fl.next, err)
+		}
+	}
+
+	// a page freed or allocated meanwhile changed the head, start over
+	if pg.free != head || fl.Len() > 0 {
+		return pg.allocID()
+	}
 
-	return p
+	pg.meta.freeMap = fl.next
+	pg.free = next
+
+	return head.ID(), pg.write(pg.meta.Page())
 }
 
+// Free returns the page to the free list.
 func (pg *Pager) Free(p *Page) error {
-	p.Free()
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	id := p.ID()
+
+	if pg.free != nil && pg.free.FreeList().Push(id) {
+		p.Free()
+
+		err := pg.write(p)
+		if err != nil {
+			return err
+		}
+
+		return pg.write(pg.free)
+	}
+
+	// The head trunk is full, the freed page becomes the new head
+	head := pg.newPage(id, p.Header().lsn, PageTypeFreeList)
+	head.FreeList().next = pg.meta.freeMap
 
-	return pg.Write(p)
+	err := pg.write(head)
+	if err != nil {
+		return err
+	}
+
+	pg.free = head
+	pg.meta.freeMap = id
+
+	return pg.write(pg.meta.Page())
 }
 
 func (pg *Pager) ReadRoot() (*Page, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
 	pgm := pg.meta
 	if pgm.root == 0 {
-		return pg.Alloc(pg.meta.lsn, PageTypeLeaf), nil
+		return pg.alloc(pg.meta.lsn, PageTypeLeaf)
 	}
 
-	return pg.Read(pgm.root)
+	return pg.read(pgm.root)
 }
 
 func (pg *Pager) WriteRoot(p *Page) error {
-	err := pg.Write(p)
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	err := pg.write(p)
 	if err != nil {
 		return err
 	}
 
 	pg.meta.root = p.ID()
 
-	return pg.Write(pg.meta.Page())
+	return pg.write(pg.meta.Page())
+}
+
+// RootID returns the id of the persisted root, 0 if the tree has none yet.
+func (pg *Pager) RootID() uint64 {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	return pg.meta.root
+}
+
+// PageSize returns the size of pages of the file.
+func (pg *Pager) PageSize() int {
+	return pg.pageSize
+}
+
+// Degree returns the number of keys that makes a leaf or a node full.
+func (pg *Pager) Degree() int {
+	return pg.degree
+}
+
+// LSN returns the highest LSN pages of the file were stamped with.
+func (pg *Pager) LSN() uint64 {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	return pg.lsn
+}
+
+// comparator returns the name of the comparator the file was created with.
+func (pg *Pager) comparator() string {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	name := pg.meta.Comparator()
+	if name == "" && pg.meta.root != 0 {
+		return LengthFirst.Name()
+	}
+
+	return name
 }
 
+func (pg *Pager) setComparator(name string) error {
+	err := validComparatorName(name)
+	if err != nil {
+		return err
+	}
+
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	copy(pg.meta.comparator[:], name)
+
+	return pg.write(pg.meta.Page())
+}
+
+// Read returns a copy of the page, changes are kept only after Write.
 func (pg *Pager) Read(id uint64) (*Page, error) {
 	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	pg.w.Seek(int64(id*pageSize), 0)
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	return pg.read(id)
+}
+
+// Pin returns the cached page itself and keeps it in memory until Unpin.
+// The page is shared with other readers and must not be modified.
+func (pg *Pager) Pin(id uint64) (*Page, error) {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	f, err := pg.frame(id)
+	if err != nil {
+		return nil, err
+	}
+
+	f.pins++
+
+	return &f.page, nil
+}
+
+func (pg *Pager) Unpin(p *Page) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	f, ok := pg.pool.frames[p.ID()]
+	if !ok || f.pins == 0 {
+		panic(fmt.Sprintf("page %d is not pinned", p.ID()))
+	}
+
+	f.pins--
+}
+
+// Write caches the page, it reaches the file with the other dirty pages on
+// WriteBack or Sync.
+func (pg *Pager) Write(p *Page) error {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	return pg.write(p)
+}
+
+// Hold puts write-back off until Release, so the pages changed in between
+// reach the file together, e.g. every change of a transaction.
+func (pg *Pager) Hold() {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	pg.holds++
+}
+
+// Release ends Hold and writes the dirty pages back if they outgrew the cache.
+func (pg *Pager) Release() error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	pg.holds--
+
+	return pg.release()
+}
+
+// WriteBack writes the dirty pages back once they outgrow the cache, unless a
+// Hold is in effect. Pages are written back only here and on Sync, so the tree
+// calls it between changes and the file never has half of a split or a merge.
+func (pg *Pager) WriteBack() error {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	return pg.release()
+}
+
+// Sync writes dirty pages to the file and syncs it.
+func (pg *Pager) Sync() error {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	return pg.sync()
+}
+
+func (pg *Pager) read(id uint64) (*Page, error) {
+	f, err := pg.frame(id)
+	if err != nil {
+		return nil, err
+	}
+
+	pg.pool.shrink()
+
+	return f.page.clone(), nil
+}
+
+func (pg *Pager) write(p *Page) error {
+	pg.lsn = max(pg.lsn, p.Header().lsn)
+
+	pg.loaded(p.ID()) // the page read from the file must not replace p
+
+	f := pg.pool.put(p, true)
+	f.page.Pack()
+
+	pg.pool.shrink()
+
+	return nil
+}
+
+func (pg *Pager) sync() error {
+	err := pg.writeBack()
+	if err != nil {
+		return err
+	}
+
+	return pg.w.Sync()
+}
+
+func (pg *Pager) release() error {
+	if pg.holds > 0 || len(pg.pool.frames) <= pg.pool.capacity {
+		return nil
+	}
+
+	err := pg.writeBack()
+	if err != nil {
+		return fmt.Errorf("could not write back pages: %w", err)
+	}
+
+	pg.pool.shrink()
+
+	return nil
+}
+
+// writeBack writes every dirty page to the file after the log records of
+// their changes, through the journal when there is one.
+func (pg *Pager) writeBack() error {
+	if pg.lsn > pg.meta.lsn {
+		pg.meta.lsn = pg.lsn
+
+		err := pg.write(pg.meta.Page())
+		if err != nil {
+			return err
+		}
+	}
+
+	dirty := pg.pool.dirty()
+	if len(dirty) == 0 {
+		return nil
+	}
+
+	lsn := uint64(0)
+	for _, f := range dirty {
+		lsn = max(lsn, f.page.Header().lsn)
+	}
+
+	if lsn > 0 && pg.flushLog != nil {
+		err := pg.flushLog(lsn)
+		if err != nil {
+			return fmt.Errorf("failed to flush log up to %d: %w", lsn, err)
+		}
+	}
+
+	if pg.journal != nil {
+		err := pg.writeJournal(dirty)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, f := range dirty {
+		err := pg.writePage(&f.page)
+		if err != nil {
+			return fmt.Errorf("could not write page %d: %w", f.page.ID(), err)
+		}
+
+		f.dirty = false
+	}
+
+	// the journal is overwritten by the next write-back
+	if pg.journal != nil {
+		return pg.w.Sync()
+	}
+
+	return nil
+}
+
+// frame returns the cached frame of the page, reading it from the file if
+// needed. The file is read without holding pg.mu, so a miss does not block
+// readers of other pages, and readers of the same page wait for its frame.
+func (pg *Pager) frame(id uint64) (*frame, error) {
+	f, ok := pg.loaded(id)
+	if !ok {
+		f = pg.pool.reserve(id)
+
+		pg.mu.Unlock()
+		p, err := pg.readPage(id)
+		pg.mu.Lock()
+
+		pg.pool.loaded(id, f, p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !f.page.Used() {
+		return nil, fmt.Errorf("page %d is not used", id)
+	}
+
+	return f, nil
+}
+
+// loaded returns the cached frame of the page once it is read from the file.
+func (pg *Pager) loaded(id uint64) (*frame, bool) {
+	for {
+		f, ok := pg.pool.get(id)
+		if !ok || f.loading == nil {
+			return f, ok
+		}
+
+		loading := f.loading
+
+		pg.mu.Unlock()
+		<-loading
+		pg.mu.Lock()
+	}
+}
+
+// readMeta reads the meta page and the layout of the file, it returns nil if
+// the file has no meta page yet.
+func (pg *Pager) readMeta() (*Page, error) {
+	buff := make([]byte, metaSize)
+
+	n, err := pg.readAt(buff, 0)
+	if err != nil || n != len(buff) {
+		return nil, nil
+	}
+
+	m := (*Meta)(unsafe.Pointer(&buff[0]))
+	if m.header.magic != magicNumber || !m.header.used || m.typ != PageTypeMeta {
+		return nil, nil
+	}
+
+	size, degree := m.layout()
+
+	err = validLayout(size, degree)
+	if err != nil {
+		return nil, err
+	}
+
+	if pg.pageSize != 0 && pg.pageSize != size {
+		return nil, fmt.Errorf("%w: file uses page size %d, got %d", ErrLayoutMismatch, size, pg.pageSize)
+	}
+
+	if pg.degree != 0 && pg.degree != degree {
+		return nil, fmt.Errorf("%w: file uses degree %d, got %d", ErrLayoutMismatch, degree, pg.degree)
+	}
+
+	pg.pageSize, pg.degree = size, degree
+
+	page, err := pg.read(0)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := page.Meta()
+	meta.pageSize, meta.degree = uint32(size), uint32(degree)
+
+	return page, nil
+}
+
+func (pg *Pager) readPage(id uint64) (*Page, error) {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	buff := make([]byte, pg.pageSize)
 
-	buff := make([]byte, pageSize)
-	n, err := pg.w.Read(buff)
+	n, err := pg.readAt(buff, int64(id)*int64(pg.pageSize))
 	if err != nil {
 		return nil, fmt.Errorf("could not read page %d: %w", id, err)
 	}
 
-	if n != pageSize {
+	if n != pg.pageSize {
 		return nil, fmt.Errorf("could not read full page, read %d bytes", n)
 	}
 
@@ -92,36 +629,171 @@ func (pg *Pager) Read(id uint64) (*Page, error) {
 		return nil, fmt.Errorf("could not create page from bytes: %w", err)
 	}
 
+	// Pages of files without checksums have zeros in their place
+	if pg.checked || p.Header().checksum != 0 {
+		err = p.Verify()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if p.ID() != id {
 		return nil, fmt.Errorf("page id mismatch: expected %d, got %d", id, p.ID())
 	}
 
-	if !p.Used() {
-		return nil, fmt.Errorf("page %d is not used", id)
+	// Pages of files before the layout was configurable have zeros in its place
+	if h := p.Header(); h.size == 0 {
+		h.size, h.degree = uint32(pg.pageSize), uint16(pg.degree)
+	}
+
+	if int(p.Header().degree) != pg.degree {
+		return nil, fmt.Errorf("page %d degree mismatch: expected %d, got %d", id, pg.degree, p.Header().degree)
 	}
 
 	return p, nil
 }
 
-func (pg *Pager) Write(p *Page) error {
-	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+func (pg *Pager) readAt(buff []byte, off int64) (n int, err error) {
+	if r, ok := pg.w.(wal.ReaderAt); ok {
+		n, err = r.ReadAt(buff, off)
+		if n == len(buff) && errors.Is(err, io.EOF) {
+			err = nil
+		}
+
+		return n, err
+	}
+
+	pg.seek.Lock()
+	defer pg.seek.Unlock()
+
+	pg.w.Seek(off, 0)
+
+	return pg.w.Read(buff)
+}
+
+// migrateChecksums stamps checksums on every page of a file created before they existed.
+func (pg *Pager) migrateChecksums() error {
+	for id := uint64(1); id < pg.freePageID; id++ {
+		p, err := pg.readPage(id)
+		if err != nil {
+			continue // never written
+		}
+
+		p.Pack()
+
+		err = pg.writePage(p)
+		if err != nil {
+			return fmt.Errorf("could not write page %d: %w", id, err)
+		}
+	}
 
-	pg.w.Seek(int64(p.ID()*pageSize), 0)
+	pg.meta.version = checksumVersion
 
-	n, err := pg.w.Write(p.Pack())
+	err := pg.write(pg.meta.Page())
 	if err != nil {
-		return err
+		return fmt.Errorf("could not write meta: %w", err)
 	}
 
-	if n != pageSize {
-		return errShortWrite
+	return pg.sync()
+}
+
+// migrateSlots rewrites leaves and nodes of a file created before the slot
+// directory existed. Keys were stored unsorted, so the comparator of the tree
+// is needed to order them. A leaf filled up in the legacy layout may have no
+// room for the slots, so a full leaf keeps its least entries and the rest are
+// returned to be inserted again, see Tree.migrateSlots. Nothing is synced, the caller holds
+// write-back until the file is converted.
+func (pg *Pager) migrateSlots(cmp Comparator) (spill legacyItems, migrated bool, err error) {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	if pg.meta.version >= slotVersion {
+		return spill, false, nil
 	}
 
-	return nil
+	spill.cmp = cmp
+
+	for id := uint64(1); id < pg.freePageID; id++ {
+		p, err := pg.read(id)
+		if errors.Is(err, ErrCorrupted) {
+			return spill, false, err
+		}
+		if err != nil || !p.Used() {
+			continue // never written or freed
+		}
+
+		switch {
+		case p.IsLeaf():
+			keys, entries := p.Leaf().legacyItems(cmp)
+
+			n := len(keys)
+			if n > 1 && leafFull(p.Leaf(), keys, entries) {
+				// keep the leaf below full as splits do, so it has room for the
+				// spilled entries that come back to it and for later inserts
+				n = 1
+				for n < len(keys) && !leafFull(p.Leaf(), keys[:n+1], entries[:n+1]) {
+					n++
+				}
+			}
+
+			spill.keys = append(spill.keys, keys[n:]...)
+			spill.entries = append(spill.entries, entries[n:]...)
+
+			err = p.Leaf().reset(keys[:n], entries[:n])
+		case p.IsNode():
+			err = p.Node().reset(p.Node().legacyChildren(cmp))
+		default:
+			continue
+		}
+		if err != nil {
+			return spill, false, fmt.Errorf("could not rewrite page %d: %w", id, err)
+		}
+
+		err = pg.write(p)
+		if err != nil {
+			return spill, false, fmt.Errorf("could not write page %d: %w", id, err)
+		}
+	}
+
+	pg.meta.version = slotVersion
+
+	err = pg.write(pg.meta.Page())
+	if err != nil {
+		return spill, false, fmt.Errorf("could not write meta: %w", err)
+	}
+
+	return spill, true, nil
 }
 
-func (pg *Pager) Sync() error {
+// writePage writes the page as is, the checksum is expected to be stamped by Pack.
+func (pg *Pager) writePage(p *Page) error {
 	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	return pg.w.Sync()
+	var (
+		n   int
+		err error
+	)
+
+	off := int64(p.ID()) * int64(pg.pageSize)
+
+	if w, ok := pg.w.(wal.WriterAt); ok {
+		n, err = w.WriteAt(*p, off)
+	} else {
+		pg.seek.Lock()
+		pg.w.Seek(off, 0)
+		n, err = pg.w.Write(*p)
+		pg.seek.Unlock()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if n != pg.pageSize {
+		return errShortWrite
+	}
+
+	return nil
 }
@@ -0,0 +1,1052 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"wal"
+	"wal/internal/binary/pack"
+	"wal/internal/db/writer"
+
+	"github.com/sergei-durkin/armtracer"
+)
+
+func TestPagerFreeList(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	writer, size, err := NewWriterReaderSeekerCloser()
+	if err != nil {
+		panic(fmt.Sprintf("failed to create writer: %v", err))
+	}
+	defer ClearDB()
+	defer writer.Close()
+
+	pg, err := NewPager(writer, uint64(size))
+	if err != nil {
+		panic(fmt.Sprintf("failed to create pager: %v", err))
+	}
+
+	// more than a single trunk can hold
+	cnt := 2*freeListCap(defaultPageSize) + 10
+
+	pages := make([]*Page, cnt)
+	for i := range cnt {
+		pages[i], err = pg.Alloc(0, PageTypeLeaf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = pg.Write(pages[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	last := pg.freePageID
+
+	for i := range cnt {
+		err = pg.Free(pages[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = pg.Read(pages[cnt-1].ID())
+	if err == nil {
+		t.Fatal("freed page should not be readable")
+	}
+
+	err = pg.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	end, err := writer.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen to check that the free list is persisted
+	pg, err = NewPager(writer, uint64(end))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[uint64]bool)
+	for range cnt {
+		p, err := pg.Alloc(0, PageTypeLeaf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if seen[p.ID()] {
+			t.Fatalf("page %d allocated twice", p.ID())
+		}
+		seen[p.ID()] = true
+
+		err = pg.Write(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if pg.freePageID != last {
+		t.Fatalf("free pages should be reused: next page id %d != %d", pg.freePageID, last)
+	}
+
+	if pg.meta.freeMap != 0 {
+		t.Fatalf("free list should be drained, head is %d", pg.meta.freeMap)
+	}
+}
+
+func TestTreeDeleteReusesPages(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	writer, size, err := NewWriterReaderSeekerCloser()
+	if err != nil {
+		panic(fmt.Sprintf("failed to create writer: %v", err))
+	}
+	defer ClearDB()
+	defer writer.Close()
+
+	pg, err := NewPager(writer, uint64(size))
+	if err != nil {
+		panic(fmt.Sprintf("failed to create pager: %v", err))
+	}
+
+	const cnt = 1000
+
+	entry := make([]byte, 1<<8)
+
+	tree, err := NewTree(pg)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create tree: %v", err))
+	}
+	for i := range cnt {
+		err = tree.Insert([]byte("key_"+strconv.Itoa(i)), entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	last := pg.freePageID
+
+	for round := range 3 {
+		for i := range cnt {
+			err = tree.Delete([]byte("key_" + strconv.Itoa(i)))
+			if err != nil {
+				t.Fatalf("round %d: %s", round, err.Error())
+			}
+		}
+
+		for i := range cnt {
+			err = tree.Insert([]byte("key_"+strconv.Itoa(i)), entry)
+			if err != nil {
+				t.Fatalf("round %d: %s", round, err.Error())
+			}
+		}
+	}
+
+	// Pages of the deleted leaves and nodes are handed out again,
+	// the trunks of the free list may take a few extra ones
+	if pg.freePageID > last+2 {
+		t.Fatalf("database should not grow: next page id %d > %d", pg.freePageID, last+2)
+	}
+
+	for i := range cnt {
+		_, err = tree.Find([]byte("key_" + strconv.Itoa(i)))
+		if err != nil {
+			t.Fatalf("key_%d not found: %s", i, err.Error())
+		}
+	}
+}
+
+type countingFile struct {
+	wal.WriterReaderSeekerCloser
+
+	reads, writes, syncs int
+}
+
+func (f *countingFile) Read(b []byte) (int, error) {
+	f.reads++
+	return f.WriterReaderSeekerCloser.Read(b)
+}
+
+func (f *countingFile) Write(b []byte) (int, error) {
+	f.writes++
+	return f.WriterReaderSeekerCloser.Write(b)
+}
+
+func (f *countingFile) Sync() error {
+	f.syncs++
+	return f.WriterReaderSeekerCloser.Sync()
+}
+
+func TestPagerCache(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	f := &countingFile{WriterReaderSeekerCloser: writer.NewInmemory()}
+
+	pg, err := NewPager(f, 0, WithCacheSize(4))
+	if err != nil {
+		panic(fmt.Sprintf("failed to create pager: %v", err))
+	}
+
+	pages := make([]*Page, 10)
+	for i := range pages {
+		pages[i], err = pg.Alloc(0, PageTypeLeaf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = pages[i].Leaf().Insert(Key(strconv.Itoa(i)), NewDataEntry([]byte{byte(i)}), Bytewise)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = pg.Write(pages[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if f.writes != 0 {
+		t.Fatalf("dirty pages should wait for write-back, got %d writes", f.writes)
+	}
+
+	err = pg.WriteBack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.writes < len(pages) || f.syncs != 0 {
+		t.Fatalf("dirty pages over capacity should be written back, got %d writes and %d syncs", f.writes, f.syncs)
+	}
+
+	writes := f.writes
+
+	// the last pages are cached
+	reads := f.reads
+	for _, p := range pages[len(pages)-3:] {
+		_, err = pg.Read(p.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if f.reads != reads {
+		t.Fatalf("cached pages should not be read from the file, got %d reads", f.reads-reads)
+	}
+
+	// the first one was evicted
+	p, err := pg.Read(pages[0].ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.reads != reads+1 {
+		t.Fatalf("evicted page should be read from the file, got %d reads", f.reads-reads)
+	}
+
+	if p.Leaf().Find(Key("0"), Bytewise) == nil {
+		t.Fatal("evicted page should keep its content")
+	}
+
+	pinned, err := pg.Pin(pages[0].ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range pages[1:] {
+		_, err = pg.Read(p.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reads = f.reads
+	_, err = pg.Read(pages[0].ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.reads != reads {
+		t.Fatal("pinned page should not be evicted")
+	}
+
+	pg.Unpin(pinned)
+
+	err = pg.Write(pages[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pg.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.syncs != 1 || f.writes <= writes {
+		t.Fatalf("sync should write dirty pages, got %d writes and %d syncs", f.writes-writes, f.syncs)
+	}
+
+	writes = f.writes
+	for _, p := range pages {
+		_, err = pg.Read(p.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if f.writes != writes {
+		t.Fatalf("clean pages should not be written back, got %d writes", f.writes-writes)
+	}
+}
+
+// slowFile blocks reads of the page at off until release is closed.
+type slowFile struct {
+	wal.WriterReaderSeekerCloser
+
+	off     int64
+	reads   atomic.Int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (f *slowFile) ReadAt(b []byte, off int64) (int, error) {
+	if off == f.off {
+		if f.reads.Add(1) == 1 {
+			close(f.started)
+		}
+
+		<-f.release
+	}
+
+	return f.WriterReaderSeekerCloser.(wal.ReaderAt).ReadAt(b, off)
+}
+
+func TestPagerConcurrentMiss(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	f := writer.NewInmemory()
+
+	pg, err := NewPager(f, 0, WithCacheSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages := make([]*Page, 8)
+	for i := range pages {
+		pages[i], err = pg.Alloc(0, PageTypeLeaf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = pg.Write(pages[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = pg.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slow := &slowFile{
+		WriterReaderSeekerCloser: f,
+		off:                      int64(pages[0].ID()) * defaultPageSize,
+		started:                  make(chan struct{}),
+		release:                  make(chan struct{}),
+	}
+
+	pg, err = NewPager(slow, uint64(len(pages)+1)*defaultPageSize, WithCacheSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			p, err := pg.Pin(pages[0].ID())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			pg.Unpin(p)
+		}()
+	}
+
+	<-slow.started
+
+	// other pages are read while the first one is still loading
+	for _, p := range pages[1:] {
+		_, err = pg.Read(p.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	close(slow.release)
+	wg.Wait()
+
+	if n := slow.reads.Load(); n != 1 {
+		t.Fatalf("the loading page should be read once, got %d reads", n)
+	}
+}
+
+func TestPagerConcurrentFreeListRead(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	f := writer.NewInmemory()
+
+	pg, err := NewPager(f, 0, WithCacheSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a drained head trunk linked to a full one, and a page to free later
+	cnt := freeListCap(defaultPageSize) + 3
+
+	pages := make([]*Page, cnt)
+	for i := range pages {
+		pages[i], err = pg.Alloc(0, PageTypeLeaf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = pg.Write(pages[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, p := range pages[:cnt-1] {
+		err = pg.Free(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = pg.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	end := pages[cnt-1].ID() + 1
+
+	slow := &slowFile{
+		WriterReaderSeekerCloser: f,
+		off:                      int64(pages[0].ID()) * defaultPageSize, // the full trunk
+		started:                  make(chan struct{}),
+		release:                  make(chan struct{}),
+	}
+
+	pg, err = NewPager(slow, end*defaultPageSize, WithCacheSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last, err := pg.Read(pages[cnt-1].ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(chan uint64, 1)
+	go func() {
+		p, err := pg.Alloc(0, PageTypeLeaf)
+		if err != nil {
+			t.Error(err)
+		}
+
+		ids <- p.ID()
+	}()
+
+	<-slow.started
+
+	// freed while the allocation reads the next trunk
+	err = pg.Free(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	close(slow.release)
+
+	seen := map[uint64]bool{<-ids: true}
+	for len(seen) < cnt {
+		p, err := pg.Alloc(0, PageTypeLeaf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if p.ID() >= end || seen[p.ID()] {
+			t.Fatalf("free page %d is lost or handed out twice, got %d after %d pages", last.ID(), p.ID(), len(seen))
+		}
+		seen[p.ID()] = true
+	}
+}
+
+func TestPagerChecksum(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	writer, size, err := NewWriterReaderSeekerCloser()
+	if err != nil {
+		panic(fmt.Sprintf("failed to create writer: %v", err))
+	}
+	defer ClearDB()
+	defer writer.Close()
+
+	pg, err := NewPager(writer, uint64(size))
+	if err != nil {
+		panic(fmt.Sprintf("failed to create pager: %v", err))
+	}
+
+	tree, err := NewTree(pg)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create tree: %v", err))
+	}
+
+	err = tree.Insert(Key("key"), []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pg.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := pg.meta.root
+
+	// flip a bit in the middle of the root leaf
+	off := int64(root*defaultPageSize + defaultPageSize/2)
+
+	b := make([]byte, 1)
+	_, err = writer.Seek(off, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = writer.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b[0] ^= 0x10
+
+	_, err = writer.Seek(off, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = writer.Write(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	end, err := writer.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pg, err = NewPager(writer, uint64(end))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = pg.Read(root)
+
+	var cerr *CorruptionError
+	if !errors.As(err, &cerr) || cerr.ID != root {
+		t.Fatalf("corrupted page %d should be reported, got %v", root, err)
+	}
+
+	_, err = NewTree(pg)
+	if !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("opening the tree should report corruption, got %v", err)
+	}
+}
+
+func TestPagerChecksumMigration(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	f := writer.NewInmemory()
+
+	pg, err := NewPager(f, 0)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create pager: %v", err))
+	}
+
+	tree, err := NewTree(pg)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create tree: %v", err))
+	}
+
+	const cnt = 200
+
+	for i := range cnt {
+		err = tree.Insert(Key("key_"+strconv.Itoa(i)), []byte{'0'})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = pg.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := pg.freePageID
+
+	// turn the file into one written before checksums existed
+	downgrade(t, f, last, 1)
+
+	pg, err = NewPager(f, last*defaultPageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pg.meta.version != checksumVersion {
+		t.Fatalf("meta version should be %d, got %d", checksumVersion, pg.meta.version)
+	}
+
+	for id := range last {
+		p, err := pg.readPage(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if p.Header().checksum == 0 {
+			t.Fatalf("page %d should have a checksum", id)
+		}
+	}
+
+	tree, err = NewTree(pg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range cnt {
+		_, err = tree.Find(Key("key_" + strconv.Itoa(i)))
+		if err != nil {
+			t.Fatalf("key_%d: %s", i, err.Error())
+		}
+	}
+}
+
+func TestPagerSlotMigration(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	f := writer.NewInmemory()
+
+	pg, err := NewPager(f, 0)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create pager: %v", err))
+	}
+
+	tree, err := NewTree(pg)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create tree: %v", err))
+	}
+
+	const cnt = 500
+
+	for _, i := range rand.Perm(cnt) {
+		err = tree.Insert(Key(fmt.Sprintf("key_%04d", i)), []byte(strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = pg.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := pg.freePageID
+
+	// turn the file into one written before the slot directory existed
+	downgrade(t, f, last, checksumVersion)
+
+	pg, err = NewPager(f, last*defaultPageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = NewTree(pg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pg.meta.version != DB_VERSION {
+		t.Fatalf("meta version should be %d, got %d", DB_VERSION, pg.meta.version)
+	}
+
+	checkTree(t, tree)
+
+	for i := range cnt {
+		v, err := tree.Find(Key(fmt.Sprintf("key_%04d", i)))
+		if err != nil {
+			t.Fatalf("key_%04d: %s", i, err.Error())
+		}
+
+		if string(v) != strconv.Itoa(i) {
+			t.Fatalf("key_%04d: unexpected value %q", i, v)
+		}
+	}
+
+	// the migration is done once
+	pg, err = NewPager(f, last*defaultPageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = NewTree(pg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkTree(t, tree)
+}
+
+func TestPagerSlotMigrationFullLeaf(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	f := writer.NewInmemory()
+
+	pg, err := NewPager(f, 0)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create pager: %v", err))
+	}
+
+	tree, err := NewTree(pg)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create tree: %v", err))
+	}
+
+	const cnt = 500
+
+	expected := make(map[string]string, cnt)
+	for _, i := range rand.Perm(cnt) {
+		k, v := fmt.Sprintf("key_%04d", i), strconv.Itoa(i)
+
+		err = tree.Insert(Key(k), []byte(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected[k] = v
+	}
+
+	leaf, _, err := tree.findLeaf(Key("key_0250"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pg.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := pg.freePageID
+
+	downgrade(t, f, last, checksumVersion)
+
+	// fill the legacy leaf up to the last byte with keys of its range
+	p := make(Page, defaultPageSize)
+
+	_, _ = f.Seek(int64(leaf.ID()*defaultPageSize), io.SeekStart)
+	_, err = f.Read(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := p.Leaf()
+	l.size = defaultPageSize // downgrade cleared it
+	keyPtr, entryPtr := int(l.head), l.dataSize()-int(l.tail)
+
+	for i := 0; entryPtr > keyPtr; i++ {
+		k := Key(fmt.Sprintf("key_0250_%04d", i))
+
+		free := entryPtr - keyPtr - leafCellSize(k, NewDataEntry(nil))
+		if free < 0 {
+			t.Fatalf("no room for key %s", k)
+		}
+
+		v := make([]byte, min(free, 32+rand.Intn(64)))
+		if free-len(v) < leafCellSize(k, NewDataEntry(nil))+8 {
+			v = make([]byte, free) // the next key would not fit
+		}
+		for j := range v {
+			v[j] = byte('a' + rand.Intn(26))
+		}
+
+		e := NewDataEntry(v)
+
+		keyPtr = writeKey(l.data(), k, keyPtr)
+
+		entryPtr -= int(entryLenSize)
+		pack.Uint32(l.data(), uint32(len(e)), entryPtr)
+		entryPtr -= len(e)
+		copy(l.data()[entryPtr:], e)
+
+		l.count++
+
+		expected[string(k)] = string(v)
+	}
+
+	l.head, l.tail = uint32(keyPtr), uint32(l.dataSize()-entryPtr)
+	if int(l.head+l.tail) != l.dataSize() {
+		t.Fatalf("leaf should be full, %d of %d bytes used", l.head+l.tail, l.dataSize())
+	}
+
+	l.size = 0
+
+	p.Pack()
+
+	_, _ = f.Seek(int64(leaf.ID()*defaultPageSize), io.SeekStart)
+	_, err = f.Write(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pg, err = NewPager(f, last*defaultPageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = NewTree(pg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pg.meta.version != DB_VERSION {
+		t.Fatalf("meta version should be %d, got %d", DB_VERSION, pg.meta.version)
+	}
+
+	checkTree(t, tree)
+
+	for k, v := range expected {
+		got, err := tree.Find(Key(k))
+		if err != nil {
+			t.Fatalf("%s: %s", k, err.Error())
+		}
+
+		if string(got) != v {
+			t.Fatalf("%s: unexpected value %q", k, got)
+		}
+	}
+
+	// the spilled keys were synced with the migration
+	pg, err = NewPager(f, pg.freePageID*defaultPageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = NewTree(pg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkTree(t, tree)
+
+	for k := range expected {
+		_, err := tree.Find(Key(k))
+		if err != nil {
+			t.Fatalf("%s: %s", k, err.Error())
+		}
+	}
+}
+
+// downgrade rewrites the first last pages of f in the format of the given
+// version: leaves and nodes without the slot directory, keys in reverse order,
+// and no checksums before checksumVersion.
+func downgrade(t *testing.T, f wal.WriterReaderSeekerCloser, last uint64, version uint64) {
+	t.Helper()
+
+	for id := range last {
+		p := make(Page, defaultPageSize)
+
+		_, _ = f.Seek(int64(id*defaultPageSize), io.SeekStart)
+		_, err := f.Read(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch {
+		case p.IsMeta():
+			p.Meta().version = version
+		case p.IsLeaf():
+			l := p.Leaf()
+			keys, entries := l.items()
+
+			data := make([]byte, l.dataSize())
+			keyPtr, entryPtr := 0, l.dataSize()
+			for i := len(keys) - 1; i >= 0; i-- {
+				keyPtr = writeKey(data, keys[i], keyPtr)
+
+				entryPtr -= int(entryLenSize)
+				pack.Uint32(data, uint32(len(entries[i])), entryPtr)
+				entryPtr -= len(entries[i])
+				copy(data[entryPtr:], entries[i])
+			}
+
+			copy(l.data(), data)
+			l.head, l.tail = uint32(keyPtr), uint32(l.dataSize())-uint32(entryPtr)
+		case p.IsNode():
+			n := p.Node()
+			keys, ids := n.children()
+
+			data := make([]byte, n.dataSize())
+			keyPtr, entryPtr := 0, n.dataSize()
+			for i := len(keys) - 1; i >= 0; i-- {
+				keyPtr = writeKey(data, keys[i], keyPtr)
+
+				entryPtr -= int(nodeEntrySize)
+				pack.Uint64(data, ids[i+1], entryPtr)
+			}
+
+			copy(n.data(), data)
+			n.head, n.tail = uint32(keyPtr), uint32(n.dataSize())-uint32(entryPtr)
+		}
+
+		// the layout was not persisted in any of them
+		p.Header().size, p.Header().degree = 0, 0
+		if p.IsMeta() {
+			p.Meta().pageSize, p.Meta().degree = 0, 0
+		}
+
+		if version < checksumVersion {
+			p.Header().checksum = 0
+		} else {
+			p.Pack()
+		}
+
+		_, _ = f.Seek(int64(id*defaultPageSize), io.SeekStart)
+		_, err = f.Write(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPagerLayout(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	f := writer.NewInmemory()
+
+	const (
+		size   = 1 << 12
+		degree = 64
+	)
+
+	pg, err := NewPager(f, 0, WithPageSize(size), WithDegree(degree))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := NewTree(pg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const cnt = 1000
+
+	for i := range cnt {
+		err = tree.Insert(Key("key_"+strconv.Itoa(i)), []byte{'0'})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// spans several overflow pages
+	large := make([]byte, 3*size)
+	err = tree.Insert(Key("large"), large)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pg.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := tree.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*root) != size || root.Header().maxDegree() != degree {
+		t.Fatalf("root should have size %d and degree %d, got %d and %d", size, degree, len(*root), root.Header().maxDegree())
+	}
+
+	// small keys fill leaves up to the degree
+	if h := checkTree(t, tree); h != 2 {
+		t.Fatalf("tree of %d keys with degree %d should have height 2, got %d", cnt, degree, h)
+	}
+
+	last := pg.freePageID
+
+	// the layout is read from the meta page
+	pg, err = NewPager(f, last*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pg.PageSize() != size || pg.Degree() != degree {
+		t.Fatalf("pager should have page size %d and degree %d, got %d and %d", size, degree, pg.PageSize(), pg.Degree())
+	}
+
+	tree, err = NewTree(pg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range cnt {
+		_, err = tree.Find(Key("key_" + strconv.Itoa(i)))
+		if err != nil {
+			t.Fatalf("key_%d: %s", i, err.Error())
+		}
+	}
+
+	v, err := tree.Find(Key("large"))
+	if err != nil || len(v) != len(large) {
+		t.Fatalf("large value should be %d bytes, got %d: %v", len(large), len(v), err)
+	}
+
+	_, err = NewPager(f, last*size, WithPageSize(defaultPageSize))
+	if !errors.Is(err, ErrLayoutMismatch) {
+		t.Fatalf("page size mismatch should be reported, got %v", err)
+	}
+
+	_, err = NewPager(f, last*size, WithDegree(degree+1))
+	if !errors.Is(err, ErrLayoutMismatch) {
+		t.Fatalf("degree mismatch should be reported, got %v", err)
+	}
+
+	for _, opt := range []PagerOption{WithPageSize(size + 1), WithPageSize(1 << 11), WithDegree(2)} {
+		_, err = NewPager(writer.NewInmemory(), 0, opt)
+		if !errors.Is(err, errInvalidLayout) {
+			t.Fatalf("invalid layout should be rejected, got %v", err)
+		}
+	}
+}
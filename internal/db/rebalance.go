@@ -0,0 +1,321 @@
+package db
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/sergei-durkin/armtracer"
+)
+
+// rebalance fixes the underflow of p after a deletion. p borrows a key from a
+// sibling when the sibling can spare one, otherwise it is merged with the
+// sibling. When both siblings are too large to merge with, p is left as it is.
+// Merges remove a separator from the parent, so the parent is rebalanced next,
+// up to the root. A root node left with a single child is
+// replaced by that child.
+func (t *Tree) rebalance(p *Page, path []*Page, pages, freed []*Page) ([]*Page, []*Page, error) {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	var err error
+
+	for len(path) > 0 && isUnderflow(p) {
+		parent := path[len(path)-1]
+		path = path[:len(path)-1]
+
+		keys, ids := parent.Node().children()
+
+		i := slices.Index(ids, p.ID())
+		if i < 0 {
+			return nil, nil, fmt.Errorf("page %d is not a child of %d", p.ID(), parent.ID())
+		}
+
+		if p.IsLeaf() {
+			keys, ids, pages, freed, err = t.rebalanceLeaf(p, keys, ids, i, pages, freed)
+		} else {
+			keys, ids, pages, freed, err = t.rebalanceNode(p, keys, ids, i, pages, freed)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = parent.Node().reset(keys, ids)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to rewrite node %d: %w", parent.ID(), err)
+		}
+
+		pages = append(pages, parent)
+		p = parent
+	}
+
+	for len(path) == 0 && p.IsNode() && p.Node().Len() == 0 { // shrink the tree
+		child := p.Node().less
+		freed = append(freed, p)
+
+		p, err = t.pending(pages, child)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read new root %d: %w", child, err)
+		}
+
+		t.root = p
+	}
+
+	return pages, freed, nil
+}
+
+// rebalanceLeaf fixes the underflow of leaf p, the i-th child of the parent
+// with separators keys and children ids. The updated keys and ids are returned.
+func (t *Tree) rebalanceLeaf(p *Page, keys []Key, ids []uint64, i int, pages, freed []*Page) ([]Key, []uint64, []*Page, []*Page, error) {
+	var (
+		left, right        *Page
+		lkeys, rkeys       []Key
+		lentries, rentries []Entry
+		err                error
+	)
+
+	pkeys, pentries := p.Leaf().items()
+
+	if i > 0 {
+		left, err = t.pending(pages, ids[i-1])
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("failed to read left sibling %d: %w", ids[i-1], err)
+		}
+
+		lkeys, lentries = left.Leaf().items()
+
+		last := len(lkeys) - 1
+		if last > 0 &&
+			!leafUnderflow(p.Leaf(), lkeys[:last], lentries[:last]) &&
+			!leafFull(p.Leaf(), append([]Key{lkeys[last]}, pkeys...), append([]Entry{lentries[last]}, pentries...)) {
+			// borrow the greatest key of the left sibling
+			pkeys = append([]Key{lkeys[last]}, pkeys...)
+			pentries = append([]Entry{lentries[last]}, pentries...)
+			keys[i-1] = pkeys[0]
+
+			pages, err = t.resetLeaves(pages, left, lkeys[:last], lentries[:last], p, pkeys, pentries)
+
+			return keys, ids, pages, freed, err
+		}
+	}
+
+	if i < len(ids)-1 {
+		right, err = t.pending(pages, ids[i+1])
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("failed to read right sibling %d: %w", ids[i+1], err)
+		}
+
+		rkeys, rentries = right.Leaf().items()
+
+		if len(rkeys) > 1 &&
+			!leafUnderflow(p.Leaf(), rkeys[1:], rentries[1:]) &&
+			!leafFull(p.Leaf(), append(pkeys, rkeys[0]), append(pentries, rentries[0])) {
+			// borrow the smallest key of the right sibling
+			pkeys = append(pkeys, rkeys[0])
+			pentries = append(pentries, rentries[0])
+			keys[i] = rkeys[1]
+
+			pages, err = t.resetLeaves(pages, p, pkeys, pentries, right, rkeys[1:], rentries[1:])
+
+			return keys, ids, pages, freed, err
+		}
+	}
+
+	var (
+		dst, src *Page
+		dkeys    []Key
+		dentries []Entry
+		sep      int
+	)
+
+	switch {
+	case left != nil && !leafFull(p.Leaf(), append(lkeys, pkeys...), append(lentries, pentries...)):
+		dst, src, sep = left, p, i-1
+		dkeys, dentries = append(lkeys, pkeys...), append(lentries, pentries...)
+
+	case right != nil && !leafFull(p.Leaf(), append(pkeys, rkeys...), append(pentries, rentries...)):
+		dst, src, sep = p, right, i
+		dkeys, dentries = append(pkeys, rkeys...), append(pentries, rentries...)
+
+	default: // siblings are too large to merge with
+		return keys, ids, append(pages, p), freed, nil
+	}
+
+	err = dst.Leaf().reset(dkeys, dentries)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to merge leaf %d into %d: %w", src.ID(), dst.ID(), err)
+	}
+
+	// dst<->src<->anyGreater => dst<->anyGreater
+	dst.Leaf().right = src.Leaf().right
+	if next := src.Leaf().right; next != 0 {
+		r, err := t.pending(pages, next)
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("failed to read right leaf %d: %w", next, err)
+		}
+
+		r.Leaf().left = dst.ID()
+		pages = append(pages, r)
+	}
+
+	keys = slices.Delete(keys, sep, sep+1)
+	ids = slices.Delete(ids, sep+1, sep+2)
+
+	return keys, ids, append(pages, dst), append(freed, src), nil
+}
+
+// rebalanceNode fixes the underflow of node p, the i-th child of the parent
+// with separators keys and children ids. The updated keys and ids are returned.
+func (t *Tree) rebalanceNode(p *Page, keys []Key, ids []uint64, i int, pages, freed []*Page) ([]Key, []uint64, []*Page, []*Page, error) {
+	var (
+		left, right  *Page
+		lkeys, rkeys []Key
+		lids, rids   []uint64
+		err          error
+	)
+
+	pkeys, pids := p.Node().children()
+
+	if i > 0 {
+		left, err = t.pending(pages, ids[i-1])
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("failed to read left sibling %d: %w", ids[i-1], err)
+		}
+
+		lkeys, lids = left.Node().children()
+
+		last := len(lkeys) - 1
+		if last > 0 && !nodeUnderflow(p.Node(), lkeys[:last]) && !nodeFull(p.Node(), append([]Key{keys[i-1]}, pkeys...)) {
+			// rotate the greatest child of the left sibling through the parent
+			pkeys = append([]Key{keys[i-1]}, pkeys...)
+			pids = append([]uint64{lids[last+1]}, pids...)
+			keys[i-1] = lkeys[last]
+
+			pages, err = t.resetNodes(pages, left, lkeys[:last], lids[:last+1], p, pkeys, pids)
+
+			return keys, ids, pages, freed, err
+		}
+	}
+
+	if i < len(ids)-1 {
+		right, err = t.pending(pages, ids[i+1])
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("failed to read right sibling %d: %w", ids[i+1], err)
+		}
+
+		rkeys, rids = right.Node().children()
+
+		if len(rkeys) > 1 && !nodeUnderflow(p.Node(), rkeys[1:]) && !nodeFull(p.Node(), append(pkeys, keys[i])) {
+			// rotate the smallest child of the right sibling through the parent
+			pkeys = append(pkeys, keys[i])
+			pids = append(pids, rids[0])
+			keys[i] = rkeys[0]
+
+			pages, err = t.resetNodes(pages, p, pkeys, pids, right, rkeys[1:], rids[1:])
+
+			return keys, ids, pages, freed, err
+		}
+	}
+
+	var (
+		dst, src *Page
+		dkeys    []Key
+		dids     []uint64
+		sep      int
+	)
+
+	switch {
+	case left != nil && !nodeFull(p.Node(), concatKeys(lkeys, keys[i-1], pkeys)):
+		dst, src, sep = left, p, i-1
+		dkeys, dids = concatKeys(lkeys, keys[i-1], pkeys), append(lids, pids...)
+
+	case right != nil && !nodeFull(p.Node(), concatKeys(pkeys, keys[i], rkeys)):
+		dst, src, sep = p, right, i
+		dkeys, dids = concatKeys(pkeys, keys[i], rkeys), append(pids, rids...)
+
+	default: // siblings are too large to merge with
+		return keys, ids, append(pages, p), freed, nil
+	}
+
+	err = dst.Node().reset(dkeys, dids)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to merge node %d into %d: %w", src.ID(), dst.ID(), err)
+	}
+
+	keys = slices.Delete(keys, sep, sep+1)
+	ids = slices.Delete(ids, sep+1, sep+2)
+
+	return keys, ids, append(pages, dst), append(freed, src), nil
+}
+
+func (t *Tree) resetLeaves(pages []*Page, a *Page, akeys []Key, aentries []Entry, b *Page, bkeys []Key, bentries []Entry) ([]*Page, error) {
+	err := a.Leaf().reset(akeys, aentries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rewrite leaf %d: %w", a.ID(), err)
+	}
+
+	err = b.Leaf().reset(bkeys, bentries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rewrite leaf %d: %w", b.ID(), err)
+	}
+
+	return append(pages, a, b), nil
+}
+
+func (t *Tree) resetNodes(pages []*Page, a *Page, akeys []Key, aids []uint64, b *Page, bkeys []Key, bids []uint64) ([]*Page, error) {
+	err := a.Node().reset(akeys, aids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rewrite node %d: %w", a.ID(), err)
+	}
+
+	err = b.Node().reset(bkeys, bids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rewrite node %d: %w", b.ID(), err)
+	}
+
+	return append(pages, a, b), nil
+}
+
+// pending returns the page with the given id, preferring a modified copy that is not written yet.
+func (t *Tree) pending(pages []*Page, id uint64) (*Page, error) {
+	for i := len(pages) - 1; i >= 0; i-- {
+		if pages[i].ID() == id {
+			return pages[i], nil
+		}
+	}
+
+	return t.pager.Read(id)
+}
+
+func isUnderflow(p *Page) bool {
+	if p.IsLeaf() {
+		return p.Leaf().IsUnderflow()
+	}
+
+	return p.Node().IsUnderflow()
+}
+
+// leafFull, leafUnderflow, nodeFull and nodeUnderflow check keys against the
+// layout of l or n as IsFull and IsUnderflow do.
+
+func leafFull(l *Leaf, keys []Key, entries []Entry) bool {
+	return len(keys) >= l.maxDegree() || leafSize(keys, entries) >= l.dataSize()/2
+}
+
+func leafUnderflow(l *Leaf, keys []Key, entries []Entry) bool {
+	return len(keys) < l.minDegree() && leafSize(keys, entries) < l.dataSize()/4
+}
+
+func nodeFull(n *Node, keys []Key) bool {
+	return len(keys) >= n.maxDegree() || len(keys) >= minSplitKeys && nodeSize(keys) >= n.dataSize()/2
+}
+
+func nodeUnderflow(n *Node, keys []Key) bool {
+	return len(keys) < n.minDegree() && nodeSize(keys) < n.dataSize()/4
+}
+
+func concatKeys(a []Key, sep Key, b []Key) []Key {
+	res := make([]Key, 0, len(a)+len(b)+1)
+	res = append(res, a...)
+	res = append(res, sep)
+
+	return append(res, b...)
+}
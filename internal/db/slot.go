@@ -0,0 +1,42 @@
+package db
+
+import (
+	"unsafe"
+	"wal/internal/binary/pack"
+	"wal/internal/binary/unpack"
+)
+
+// Leaf and Node pages keep a slot directory in front of their data:
+//
+//	| slot 0 | slot 1 | ... -> free space <- ... | cell 1 | cell 0 |
+//
+// A slot is the offset of its cell in the data, slots are sorted by the key
+// of their cells, so the i-th key of a page is found without decoding the
+// others and lookups use binary search. head is the size of the slot
+// directory and tail is the size of the cells.
+
+const (
+	slotSize = unsafe.Sizeof(uint32(0))
+)
+
+func readSlot(data []byte, i int) int {
+	off, _ := unpack.Uint32(data, i*int(slotSize))
+	return int(off)
+}
+
+func writeSlot(data []byte, i int, off int) {
+	pack.Uint32(data, uint32(off), i*int(slotSize))
+}
+
+// insertSlot shifts slots [i, count) to the right and puts off at i.
+func insertSlot(data []byte, count int, i int, off int) {
+	s := int(slotSize)
+	copy(data[(i+1)*s:(count+1)*s], data[i*s:count*s])
+	writeSlot(data, i, off)
+}
+
+// deleteSlot shifts slots (i, count) to the left over i.
+func deleteSlot(data []byte, count int, i int) {
+	s := int(slotSize)
+	copy(data[i*s:(count-1)*s], data[(i+1)*s:count*s])
+}
@@ -3,19 +3,81 @@ package db
 import (
 	"fmt"
 	"os"
+	"sync"
 
 	"github.com/sergei-durkin/armtracer"
 )
 
+// Tree is safe for concurrent use: readers share the tree while a writer
+// holds it exclusively.
 type Tree struct {
 	root  *Page
 	pager *Pager
+	cmp   Comparator
+
+	mu      sync.RWMutex
+	version uint64 // incremented by every modification, see Cursor
 }
 
-func NewTree(pg *Pager) *Tree {
-	return &Tree{
+type TreeOption func(t *Tree)
+
+// WithComparator sets the ordering of keys. Files keep the name of the
+// comparator they were created with and can't be opened with another one.
+func WithComparator(cmp Comparator) TreeOption {
+	return func(t *Tree) {
+		t.cmp = cmp
+	}
+}
+
+// NewTree opens the tree stored in pg. Without WithComparator a new file is
+// ordered bytewise and an existing one uses its persisted built-in comparator.
+func NewTree(pg *Pager, opts ...TreeOption) (*Tree, error) {
+	t := &Tree{
 		pager: pg,
 	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	stored := pg.comparator()
+
+	if t.cmp == nil {
+		t.cmp = Bytewise
+
+		if stored != "" {
+			cmp, ok := builtinComparators[stored]
+			if !ok {
+				return nil, fmt.Errorf("%w: file uses custom comparator %q", ErrComparatorMismatch, stored)
+			}
+
+			t.cmp = cmp
+		}
+	}
+
+	if stored != "" && stored != t.cmp.Name() {
+		return nil, fmt.Errorf("%w: file uses %q, got %q", ErrComparatorMismatch, stored, t.cmp.Name())
+	}
+
+	if stored == "" {
+		err := pg.setComparator(t.cmp.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to persist comparator: %w", err)
+		}
+	}
+
+	err := t.migrateSlots()
+	if err != nil {
+		return nil, fmt.Errorf("could not migrate to version %d: %w", slotVersion, err)
+	}
+
+	// read the root eagerly, so readers never initialize it
+	_, err = t.Root()
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
 }
 
 func (t *Tree) Root() (*Page, error) {
@@ -34,146 +96,183 @@ func (t *Tree) Root() (*Page, error) {
 func (t *Tree) Insert(k Key, v []byte) error {
 	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	oldRoot, err := t.Root()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.version++
+
+	_, err := t.Root()
 	if err != nil {
 		return fmt.Errorf("failed to get root: %w", err)
 	}
 
-	newRoot, newPages, err := t.upsert(k, v, false)
+	pages, freed, err := t.upsert(k, v, false)
 	if err != nil {
 		return fmt.Errorf("insertion failed: %w", err)
 	}
 
-	for i := 0; i < len(newPages); i++ {
-		t.pager.Write(newPages[i])
-	}
-
-	if newRoot != nil && oldRoot != newRoot {
-		t.pager.WriteRoot(newRoot)
-	}
-
-	return nil
+	return t.flush(0, pages, freed)
 }
 
 func (t *Tree) Update(k Key, v []byte) error {
+	return t.UpdateAt(0, k, v)
+}
+
+// UpdateAt is Update stamping the changed pages with the LSN of the log record
+// that made the change, see LSN.
+func (t *Tree) UpdateAt(lsn uint64, k Key, v []byte) error {
 	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	oldRoot, err := t.Root()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.version++
+
+	_, err := t.Root()
 	if err != nil {
 		return fmt.Errorf("failed to get root: %w", err)
 	}
 
-	newRoot, newPages, err := t.upsert(k, v, true)
+	pages, freed, err := t.upsert(k, v, true)
 	if err != nil {
 		return fmt.Errorf("insertion failed: %w", err)
 	}
 
-	for i := 0; i < len(newPages); i++ {
-		t.pager.Write(newPages[i])
-	}
-
-	if newRoot != nil && oldRoot != newRoot {
-		t.pager.WriteRoot(newRoot)
-	}
-
-	return nil
+	return t.flush(lsn, pages, freed)
 }
 
 func (t *Tree) Delete(k Key) error {
+	return t.DeleteAt(0, k)
+}
+
+// DeleteAt is Delete stamping the changed pages with lsn, see UpdateAt.
+func (t *Tree) DeleteAt(lsn uint64, k Key) error {
 	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	oldRoot, err := t.Root()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.version++
+
+	_, err := t.Root()
 	if err != nil {
 		return fmt.Errorf("failed to get root: %w", err)
 	}
 
-	newRoot, newPages, err := t.delete(k)
+	pages, freed, err := t.delete(k)
 	if err != nil {
-		return fmt.Errorf("insertion failed: %w", err)
+		return fmt.Errorf("deletion failed: %w", err)
 	}
 
-	for i := 0; i < len(newPages); i++ {
-		t.pager.Write(newPages[i])
-	}
+	return t.flush(lsn, pages, freed)
+}
+
+// LSN returns the LSN the leaf k belongs to is stamped with. Every change
+// logged at or before it is already in the leaf.
+func (t *Tree) LSN(k Key) (uint64, error) {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	if newRoot != nil && oldRoot != newRoot {
-		t.pager.WriteRoot(newRoot)
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	p, _, err := t.findLeaf(k)
+	if err != nil {
+		return 0, err
 	}
 
-	return nil
+	return p.Header().lsn, nil
 }
 
-func (t *Tree) delete(k Key) (*Page, []*Page, error) {
+// flush writes modified pages stamped with lsn, returns orphaned pages to the
+// free list and persists the root if it has changed. Stamps never go back, a
+// zero lsn leaves them as they are. Pages are written back to the file only
+// after the whole change is cached.
+func (t *Tree) flush(lsn uint64, pages []*Page, freed []*Page) error {
 	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	var (
-		pages []*Page
-	)
+	for i := 0; i < len(pages); i++ {
+		h := pages[i].Header()
+		h.lsn = max(h.lsn, lsn)
 
-	p, path, err := t.findLeaf(k)
-	if p == nil {
-		return nil, nil, fmt.Errorf("failed to find leaf")
+		err := t.pager.Write(pages[i])
+		if err != nil {
+			return fmt.Errorf("failed to write page %d: %w", pages[i].ID(), err)
+		}
 	}
 
-	existsEntry := p.Leaf().Find(k)
-	if existsEntry == nil {
-		return nil, nil, errNotFound
+	for i := 0; i < len(freed); i++ {
+		err := t.pager.Free(freed[i])
+		if err != nil {
+			return fmt.Errorf("failed to free page %d: %w", freed[i].ID(), err)
+		}
 	}
 
-	err = p.Leaf().Delete(k)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to delete key: %w", err)
+	if t.root.ID() != t.pager.RootID() {
+		err := t.pager.WriteRoot(t.root)
+		if err != nil {
+			return fmt.Errorf("failed to write root: %w", err)
+		}
 	}
 
-	if p.Leaf().Len() != 0 {
-		pages = append(pages, p)
-		return t.root, pages, nil
-	}
+	// every page of the change is in the cache, they may reach the file now
+	return t.pager.WriteBack()
+}
 
-	p.Free()
-	pages = append(pages, p)
+func (t *Tree) delete(k Key) (pages []*Page, freed []*Page, err error) {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
-	next := p.ID()
-	for len(path) > 0 {
-		parent := path[len(path)-1]
-		path = path[:len(path)-1]
+	p, path, err := t.findLeaf(k)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		err = parent.Node().DeleteByChildID(next)
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to delete child from parent: %w", err)
-		}
+	existsEntry := p.Leaf().Find(k, t.cmp)
+	if existsEntry == nil {
+		return nil, nil, ErrNotFound
+	}
 
-		if parent.Node().Len() != 0 {
-			return nil, append(pages, parent), nil
+	if existsEntry.IsOverflow() {
+		freed, err = t.overflowChain(existsEntry.GetNext())
+		if err != nil {
+			return nil, nil, err
 		}
-
-		next = parent.ID()
-		parent.Free()
-		pages = append(pages, parent)
 	}
 
-	{ // remove until root
-		t.root = t.pager.Alloc(0, PageTypeLeaf)
+	err = p.Leaf().Delete(k, t.cmp)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to delete key: %w", err)
 	}
 
-	return t.root, pages, nil
+	return t.rebalance(p, path, append(pages, p), freed)
 }
 
-func (t *Tree) upsert(k Key, v []byte, upsert bool) (*Page, []*Page, error) {
+func (t *Tree) upsert(k Key, v []byte, upsert bool) (pages []*Page, freed []*Page, err error) {
 	defer armtracer.EndTrace(armtracer.BeginTrace(""))
 
 	var (
-		err   error
-		e     Entry
-		pages []*Page
+		e Entry
 	)
 
 	p, path, err := t.findLeaf(k)
-	if p == nil {
-		return nil, nil, fmt.Errorf("failed to find leaf")
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if len(v)+1 > int(maxEntrySize) {
+	exists := p.Leaf().Find(k, t.cmp)
+	if exists != nil {
+		if !upsert {
+			return nil, nil, ErrAlreadyExists
+		}
+
+		if exists.IsOverflow() { // the old chain is replaced
+			freed, err = t.overflowChain(exists.GetNext())
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	if len(v)+1 > p.Leaf().maxEntrySize() {
 		pages, err = t.writeOverflow(p.Header().lsn, v)
 		if err != nil {
 			return nil, nil, err
@@ -184,45 +283,98 @@ func (t *Tree) upsert(k Key, v []byte, upsert bool) (*Page, []*Page, error) {
 		e = NewDataEntry(v)
 	}
 
-	if p.Leaf().Find(k) != nil {
-		if !upsert {
-			return nil, nil, errAlreadyExists
-		}
+	return t.put(p, path, k, e, exists != nil, pages, freed)
+}
+
+// put stores e under k in the leaf p found at path and splits the pages that
+// fill up, update replaces the entry k already has.
+func (t *Tree) put(p *Page, path []*Page, k Key, e Entry, update bool, pages []*Page, freed []*Page) ([]*Page, []*Page, error) {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	var err error
 
-		err = p.Leaf().Update(k, e)
+	if update {
+		err = p.Leaf().Update(k, e, t.cmp)
 	} else {
-		err = p.Leaf().Insert(k, e)
+		err = p.Leaf().Insert(k, e, t.cmp)
 	}
 	if nil != err {
 		return nil, nil, err
 	}
 
-	if !p.Leaf().IsFull() {
+	if !p.Leaf().IsFull() || p.Leaf().Len() == 1 {
 		pages = append(pages, p)
-		return t.root, pages, nil
+		return pages, freed, nil
 	}
 
-	extra := t.pager.Alloc(p.Header().lsn, PageTypeLeaf)
-	pivot := p.Leaf().Split(extra.Leaf())
+	for {
+		var extra *Page
+
+		extra, pages, err = t.splitLeaf(p, path, pages)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// a large entry between small ones leaves one of the halves full
+		switch {
+		case p.Leaf().IsFull() && p.Leaf().Len() > 1:
+		case extra.Leaf().IsFull() && extra.Leaf().Len() > 1:
+			p = extra
+		default:
+			return pages, freed, nil
+		}
+
+		path, err = t.pendingPath(p.Leaf().key(0), pages)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// splitLeaf moves the greater keys of leaf p to a new leaf and inserts its
+// separator into the nodes of path, splitting the ones that fill up.
+func (t *Tree) splitLeaf(p *Page, path []*Page, pages []*Page) (*Page, []*Page, error) {
+	leaf, err := t.pager.Alloc(p.Header().lsn, PageTypeLeaf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pivot := p.Leaf().Split(leaf.Leaf())
 
 	pages = append(pages, p)
-	pages = append(pages, extra)
+	pages = append(pages, leaf)
+
+	if right := leaf.Leaf().right; right != 0 { // anyGreater.left = leaf
+		r, err := t.pending(pages, right)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read right leaf %d: %w", right, err)
+		}
+
+		r.Leaf().left = leaf.ID()
+		pages = append(pages, r)
+	}
+
+	extra := leaf
 
 	for len(path) > 0 {
 		next := extra.ID()
 		parent := path[len(path)-1]
 		path = path[:len(path)-1]
 
-		err = parent.Node().Insert(pivot, next)
+		err = parent.Node().Insert(pivot, next, t.cmp)
 		if err != nil {
 			return nil, nil, err
 		}
 
 		if !parent.Node().IsFull() {
-			return nil, pages, nil
+			return leaf, append(pages, parent), nil
+		}
+
+		extra, err = t.pager.Alloc(0, PageTypeNode)
+		if err != nil {
+			return nil, nil, err
 		}
 
-		extra = t.pager.Alloc(0, PageTypeNode)
 		pivot = parent.Node().Split(extra.Node())
 
 		pages = append(pages, parent)
@@ -230,9 +382,13 @@ func (t *Tree) upsert(k Key, v []byte, upsert bool) (*Page, []*Page, error) {
 	}
 
 	{ // split root
-		r := t.pager.Alloc(0, PageTypeNode)
+		r, err := t.pager.Alloc(0, PageTypeNode)
+		if err != nil {
+			return nil, nil, err
+		}
+
 		r.Node().less = t.root.ID()
-		err = r.Node().Insert(pivot, extra.ID())
+		err = r.Node().Insert(pivot, extra.ID(), t.cmp)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -240,7 +396,29 @@ func (t *Tree) upsert(k Key, v []byte, upsert bool) (*Page, []*Page, error) {
 		t.root = r
 	}
 
-	return t.root, pages, nil
+	return leaf, pages, nil
+}
+
+// pendingPath returns the nodes from the root down to the leaf of k, preferring
+// modified copies that are not written yet, see pending.
+func (t *Tree) pendingPath(k Key, pages []*Page) (path []*Page, err error) {
+	p := t.root
+
+	for p.IsNode() {
+		path = append(path, p)
+
+		next, ok := p.Node().Find(k, t.cmp)
+		if !ok {
+			return nil, fmt.Errorf("failed to find leaf")
+		}
+
+		p, err = t.pending(pages, next)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read page %d: %w", next, err)
+		}
+	}
+
+	return path, nil
 }
 
 func (t *Tree) findLeaf(k Key) (p *Page, path []*Page, err error) {
@@ -254,76 +432,129 @@ func (t *Tree) findLeaf(k Key) (p *Page, path []*Page, err error) {
 	for p.IsNode() {
 		path = append(path, p)
 
-		next, ok := p.Node().Find(k)
+		next, ok := p.Node().Find(k, t.cmp)
 		if !ok {
 			return nil, nil, fmt.Errorf("failed to find leaf")
 		}
 
 		p, err = t.pager.Read(next)
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to read next")
+			return nil, nil, fmt.Errorf("failed to read page %d: %w", next, err)
 		}
 	}
 
-	if p == nil {
-		return nil, nil, fmt.Errorf("failed to find leaf")
-	}
-
-	return p, path, err
+	return p, path, nil
 }
 
+// Find returns a copy of the value stored under k. Pages on the way are
+// pinned in the cache instead of being copied.
 func (t *Tree) Find(k Key) (e Entry, err error) {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
 	p, err := t.Root()
 	if err != nil {
 		return nil, err
 	}
 
+	var pinned *Page
+	defer func() {
+		if pinned != nil {
+			t.pager.Unpin(pinned)
+		}
+	}()
+
 	for p != nil {
 		if p.IsLeaf() {
-			e = p.Leaf().Find(k)
+			e = p.Leaf().Find(k, t.cmp)
 			if e == nil {
-				return nil, errNotFound
+				return nil, ErrNotFound
 			}
 
 			if e.IsData() {
-				return e[1:], nil
+				return append(Entry{}, e[1:]...), nil
 			}
 
-			if e.IsOverflow() {
-				next := e.GetNext()
-
-				e, err = t.readOverflow(next)
-				if err != nil {
-					return nil, fmt.Errorf("read overflow page %d failed: %w", next, err)
-				}
-
-				return e, nil
-			}
-
-			panic("unknown entry type")
+			return t.resolve(e)
 		}
 
 		if p.IsNode() {
-			next, ok := p.Node().Find(k)
+			next, ok := p.Node().Find(k, t.cmp)
 			if !ok {
-				return nil, errNotFound
+				return nil, ErrNotFound
 			}
 
-			p, err = t.pager.Read(next)
+			p, err = t.pager.Pin(next)
 			if err != nil {
 				return nil, fmt.Errorf("failed to read page: %w", err)
 			}
 
+			if pinned != nil {
+				t.pager.Unpin(pinned)
+			}
+			pinned = p
+
 			continue
 		}
 
 		panic(fmt.Errorf("unexpected page type: %d", p.Type()))
 	}
 
-	return nil, errNotFound
+	return nil, ErrNotFound
+}
+
+// resolve returns the value stored in the leaf entry e.
+func (t *Tree) resolve(e Entry) ([]byte, error) {
+	if e.IsData() {
+		return e[1:], nil
+	}
+
+	if e.IsOverflow() {
+		next := e.GetNext()
+
+		v, err := t.readOverflow(next)
+		if err != nil {
+			return nil, fmt.Errorf("read overflow page %d failed: %w", next, err)
+		}
+
+		return v, nil
+	}
+
+	panic("unknown entry type")
+}
+
+// edgeLeaf returns the leftmost or the rightmost leaf of the tree.
+func (t *Tree) edgeLeaf(rightmost bool) (p *Page, err error) {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	p, err = t.Root()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get root: %w", err)
+	}
+
+	for p.IsNode() {
+		next := p.Node().Entries()
+
+		id := next[0]
+		if rightmost {
+			id = next[len(next)-1]
+		}
+
+		p, err = t.pager.Read(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read page %d: %w", id, err)
+		}
+	}
+
+	return p, nil
 }
 
 func (t *Tree) Print() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
 	root, err := t.Root()
 	if err != nil {
 		return err
@@ -371,7 +602,7 @@ func (t *Tree) Print() error {
 }
 
 func (t *Tree) readOverflow(next uint64) (e Entry, err error) {
-	overflow := make([]byte, 0, maxEntrySize)
+	overflow := make([]byte, 0, t.pager.PageSize())
 
 	for next > 0 {
 		op, err := t.pager.Read(next)
@@ -386,10 +617,35 @@ func (t *Tree) readOverflow(next uint64) (e Entry, err error) {
 	return overflow, nil
 }
 
+// overflowChain returns all pages of the overflow chain starting at next.
+func (t *Tree) overflowChain(next uint64) (chain []*Page, err error) {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	for next > 0 {
+		op, err := t.pager.Read(next)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read overflow page with id %d: %w", next, err)
+		}
+
+		if !op.IsOverflow() {
+			return nil, fmt.Errorf("page %d is not an overflow: %d", next, op.Type())
+		}
+
+		chain = append(chain, op)
+		next = op.Overflow().next
+	}
+
+	return chain, nil
+}
+
 func (t *Tree) writeOverflow(lsn uint64, v []byte) (chain []*Page, err error) {
-	chain = make([]*Page, 0, len(v)/int(maxEntrySize))
+	chain = make([]*Page, 0, len(v)/overflowCap(t.pager.PageSize())+1)
+
+	p, err := t.pager.Alloc(lsn, PageTypeOverflow)
+	if err != nil {
+		return nil, err
+	}
 
-	p := t.pager.Alloc(lsn, PageTypeOverflow)
 	for len(v) > 0 {
 		chain = append(chain, p)
 
@@ -404,7 +660,11 @@ func (t *Tree) writeOverflow(lsn uint64, v []byte) (chain []*Page, err error) {
 
 		v = v[n:]
 
-		next := t.pager.Alloc(lsn, PageTypeOverflow)
+		next, err := t.pager.Alloc(lsn, PageTypeOverflow)
+		if err != nil {
+			return nil, err
+		}
+
 		p.Overflow().next = next.ID()
 
 		p = next
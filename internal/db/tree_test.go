@@ -2,12 +2,16 @@ package db
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"strconv"
+	"sync"
 	"testing"
 	"wal"
+	"wal/internal/db/writer"
 
 	"github.com/sergei-durkin/armtracer"
 )
@@ -36,7 +40,10 @@ func TestTree(t *testing.T) {
 		entry[i] = byte(i%26) + 'a'
 	}
 
-	tree := NewTree(pg)
+	tree, err := NewTree(pg)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create tree: %v", err))
+	}
 	tree.Insert(key, entry)
 
 	e, err := tree.Find(key)
@@ -93,7 +100,10 @@ func TestTreeOverflow(t *testing.T) {
 		entry[i] = byte(i%26) + 'a'
 	}
 
-	tree := NewTree(pg)
+	tree, err := NewTree(pg)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create tree: %v", err))
+	}
 	tree.Insert(key, entry)
 
 	e, err := tree.Find(key)
@@ -106,6 +116,394 @@ func TestTreeOverflow(t *testing.T) {
 	}
 }
 
+func TestTreeOverflowReclaim(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	writer, size, err := NewWriterReaderSeekerCloser()
+	if err != nil {
+		panic(fmt.Sprintf("failed to create writer: %v", err))
+	}
+	defer ClearDB()
+	defer writer.Close()
+
+	pg, err := NewPager(writer, uint64(size))
+	if err != nil {
+		panic(fmt.Sprintf("failed to create pager: %v", err))
+	}
+
+	const entrySize = 100 << 10 // 100Kb
+
+	key := []byte("the_key")
+	entry := make([]byte, entrySize)
+
+	tree, err := NewTree(pg)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create tree: %v", err))
+	}
+	err = tree.Insert(key, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := pg.freePageID
+
+	for i := range 20 {
+		for j := range entry {
+			entry[j] = byte((i+j)%26) + 'a'
+		}
+
+		err = tree.Update(key, entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e, err := tree.Find(key)
+		if err != nil {
+			t.Fatalf("key %q not found: %s", key, err.Error())
+		}
+
+		if !bytes.Equal(e, entry) {
+			t.Fatalf("update %d: e and entry not equal", i)
+		}
+	}
+
+	// One extra chain may be allocated while the old one is still referenced,
+	// plus a free list trunk
+	chain := uint64(entrySize/overflowCap(defaultPageSize) + 1)
+	if pg.freePageID > last+chain+1 {
+		t.Fatalf("overflow chains should be reused: next page id %d > %d", pg.freePageID, last+chain+1)
+	}
+
+	err = tree.Update(key, []byte("small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tree.Update(key, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tree.Delete(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	free := 0
+	for id := pg.meta.freeMap; id != 0; {
+		p, err := pg.Read(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		free += p.FreeList().Len() + 1
+		id = p.FreeList().next
+	}
+
+	if uint64(free) < chain {
+		t.Fatalf("deleted overflow chain should be freed: %d free pages < %d", free, chain)
+	}
+}
+
+func TestTreeDeleteRebalance(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	writer, size, err := NewWriterReaderSeekerCloser()
+	if err != nil {
+		panic(fmt.Sprintf("failed to create writer: %v", err))
+	}
+	defer ClearDB()
+	defer writer.Close()
+
+	pg, err := NewPager(writer, uint64(size))
+	if err != nil {
+		panic(fmt.Sprintf("failed to create pager: %v", err))
+	}
+
+	tree, err := NewTree(pg)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create tree: %v", err))
+	}
+
+	const cnt = 3000
+
+	for _, i := range rand.Perm(cnt) {
+		err = tree.Insert([]byte(fmt.Sprintf("key_%04d", i)), []byte{'0'})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	height := checkTree(t, tree)
+	if height < 3 {
+		t.Fatalf("tree of %d keys should have at least 3 levels, got %d", cnt, height)
+	}
+
+	deleted := make(map[int]bool)
+	for n, i := range rand.Perm(cnt)[:cnt-10] {
+		err = tree.Delete([]byte(fmt.Sprintf("key_%04d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleted[i] = true
+
+		if n%100 == 0 {
+			checkTree(t, tree)
+		}
+	}
+
+	height = checkTree(t, tree)
+	if height != 1 {
+		t.Fatalf("tree of 10 keys should be a single leaf, got %d levels", height)
+	}
+
+	for i := range cnt {
+		_, err = tree.Find([]byte(fmt.Sprintf("key_%04d", i)))
+		if deleted[i] != errors.Is(err, ErrNotFound) {
+			t.Fatalf("key_%04d: deleted %t, find returned %v", i, deleted[i], err)
+		}
+	}
+}
+
+func TestTreeMaxKeys(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	pg, err := NewPager(writer.NewInmemory(), 0, WithPageSize(minPageSize))
+	if err != nil {
+		panic(fmt.Sprintf("failed to create pager: %v", err))
+	}
+
+	tree, err := NewTree(pg)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create tree: %v", err))
+	}
+
+	const cnt = 300
+
+	// a couple of keys of the maximum size fill half of a node
+	key := func(i int) Key {
+		k := make(Key, maxKeySize)
+		copy(k, fmt.Sprintf("key_%04d", i))
+
+		return k
+	}
+
+	for _, i := range rand.Perm(cnt) {
+		err = tree.Insert(key(i), []byte{'0'})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	height := checkTree(t, tree)
+	if height < 3 {
+		t.Fatalf("tree of %d keys should have at least 3 levels, got %d", cnt, height)
+	}
+
+	deleted := make(map[int]bool)
+	for _, i := range rand.Perm(cnt)[:cnt/2] {
+		err = tree.Delete(key(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleted[i] = true
+	}
+
+	checkTree(t, tree)
+
+	for i := range cnt {
+		_, err = tree.Find(key(i))
+		if deleted[i] != errors.Is(err, ErrNotFound) {
+			t.Fatalf("key_%04d: deleted %t, find returned %v", i, deleted[i], err)
+		}
+	}
+}
+
+func TestTreeVariableValues(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	for _, size := range []int{defaultPageSize, maxPageSize} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			pg, err := NewPager(writer.NewInmemory(), 0, WithPageSize(size))
+			if err != nil {
+				panic(fmt.Sprintf("failed to create pager: %v", err))
+			}
+
+			tree, err := NewTree(pg)
+			if err != nil {
+				panic(fmt.Sprintf("failed to create tree: %v", err))
+			}
+
+			const cnt = 1000
+
+			// large values go to overflow pages and leave small entries behind,
+			// so leaves end up with very different sizes
+			value := func(i int) []byte {
+				v := make([]byte, 900)
+				if rand.Intn(4) == 0 {
+					v = make([]byte, 20<<10)
+				}
+				copy(v, strconv.Itoa(i))
+
+				return v
+			}
+
+			expected := make(map[int][]byte)
+			for range 5 * cnt {
+				i := rand.Intn(cnt)
+				k := Key(fmt.Sprintf("key_%04d", i))
+
+				if _, ok := expected[i]; ok && rand.Intn(2) == 0 {
+					err = tree.Delete(k)
+					delete(expected, i)
+				} else {
+					v := value(i)
+					err = tree.Update(k, v)
+					expected[i] = v
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			checkTree(t, tree)
+
+			for i := range cnt {
+				v, err := tree.Find(Key(fmt.Sprintf("key_%04d", i)))
+				if _, ok := expected[i]; !ok {
+					if !errors.Is(err, ErrNotFound) {
+						t.Fatalf("key_%04d: should be deleted, got %v", i, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("key_%04d: %s", i, err.Error())
+				}
+				if !bytes.Equal(v, expected[i]) {
+					t.Fatalf("key_%04d: unexpected value of %d bytes", i, len(v))
+				}
+			}
+
+			n := 0
+			err = tree.Range(nil, nil, func(k Key, v []byte) bool {
+				i, _ := strconv.Atoi(string(k[len("key_"):]))
+				if !bytes.Equal(v, expected[i]) {
+					t.Fatalf("%s: unexpected value of %d bytes", k, len(v))
+				}
+				n++
+
+				return true
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(expected) {
+				t.Fatalf("range should return %d keys, got %d", len(expected), n)
+			}
+
+			c := tree.Cursor()
+			for ok := c.Last(); ok; ok = c.Prev() {
+				n--
+			}
+			if c.Err() != nil {
+				t.Fatal(c.Err())
+			}
+			if n != 0 {
+				t.Fatalf("reverse scan should return %d keys, got %d", len(expected), len(expected)-n)
+			}
+		})
+	}
+}
+
+// checkTree verifies separators, fill factor and leaf links of the tree and returns its height.
+// Pages may underflow, rebalance leaves them so when the siblings are too large
+// to merge with, but a leaf is split once it is full unless it holds one key.
+func checkTree(t *testing.T, tree *Tree) int {
+	t.Helper()
+
+	root, err := tree.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		leaves []uint64
+		walk   func(p *Page, lo, hi Key, depth int) int
+	)
+
+	walk = func(p *Page, lo, hi Key, depth int) int {
+		if p.IsLeaf() {
+			if p.Leaf().IsFull() && p.Leaf().Len() > 1 {
+				t.Fatalf("leaf %d is full", p.ID())
+			}
+
+			keys, _ := p.Leaf().items()
+			for _, k := range keys {
+				if lo != nil && tree.cmp.Compare(k, lo) < 0 || hi != nil && tree.cmp.Compare(k, hi) >= 0 {
+					t.Fatalf("key %q of leaf %d is out of [%q, %q)", k, p.ID(), lo, hi)
+				}
+			}
+
+			leaves = append(leaves, p.ID())
+
+			return depth
+		}
+
+		keys, ids := p.Node().children()
+
+		height := -1
+		for i, id := range ids {
+			c, err := tree.pager.Read(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			clo, chi := lo, hi
+			if i > 0 {
+				clo = keys[i-1]
+			}
+			if i < len(keys) {
+				chi = keys[i]
+			}
+
+			h := walk(c, clo, chi, depth+1)
+			if height >= 0 && h != height {
+				t.Fatalf("leaves of node %d are at different depth", p.ID())
+			}
+			height = h
+		}
+
+		return height
+	}
+
+	height := walk(root, nil, nil, 1)
+
+	for i, id := range leaves {
+		p, err := tree.pager.Read(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var left, right uint64
+		if i > 0 {
+			left = leaves[i-1]
+		}
+		if i < len(leaves)-1 {
+			right = leaves[i+1]
+		}
+
+		if p.Leaf().left != left || p.Leaf().right != right {
+			t.Fatalf("leaf %d is linked to %d and %d, want %d and %d", id, p.Leaf().left, p.Leaf().right, left, right)
+		}
+	}
+
+	return height
+}
+
 func TestTreeGen(t *testing.T) {
 	armtracer.Begin()
 	defer armtracer.End()
@@ -127,7 +525,10 @@ func TestTreeGen(t *testing.T) {
 		cnt       = 1 << 4
 	)
 
-	tree := NewTree(pg)
+	tree, err := NewTree(pg)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create tree: %v", err))
+	}
 	rows := Generate(cnt, entrySize)
 
 	for i := 0; i < cnt; i++ {
@@ -202,3 +603,214 @@ func NewWriterReaderSeekerCloser() (wal.WriterReaderSeekerCloser, int64, error)
 
 	return f, stat.Size(), nil
 }
+
+func TestTreeConcurrent(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	pg, err := NewPager(writer.NewInmemory(), 0, WithCacheSize(16))
+	if err != nil {
+		panic(fmt.Sprintf("failed to create pager: %v", err))
+	}
+
+	tree, err := NewTree(pg)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create tree: %v", err))
+	}
+
+	const cnt = 2000
+
+	key := func(i int) Key {
+		return Key(fmt.Sprintf("key_%04d", i))
+	}
+
+	// even keys are stable, odd ones are inserted and deleted by the writer
+	for i := 0; i < cnt; i += 2 {
+		err = tree.Insert(key(i), key(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+		errs = make(chan error, 8)
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+
+		for round := range 3 {
+			for i := 1; i < cnt; i += 2 {
+				err := tree.Insert(key(i), key(i))
+				if err != nil {
+					errs <- fmt.Errorf("round %d: insert %s: %w", round, key(i), err)
+					return
+				}
+			}
+
+			for i := 1; i < cnt; i += 2 {
+				err := tree.Delete(key(i))
+				if err != nil {
+					errs <- fmt.Errorf("round %d: delete %s: %w", round, key(i), err)
+					return
+				}
+			}
+		}
+	}()
+
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				i := 2 * rand.Intn(cnt/2)
+				v, err := tree.Find(key(i))
+				if err != nil || !bytes.Equal(v, key(i)) {
+					errs <- fmt.Errorf("find %s: %q, %v", key(i), v, err)
+					return
+				}
+
+				var (
+					prev Key
+					even int
+				)
+				err = tree.Range(nil, nil, func(k Key, v []byte) bool {
+					if prev != nil && bytes.Compare(prev, k) >= 0 {
+						err = fmt.Errorf("range is out of order: %s after %s", k, prev)
+						return false
+					}
+					prev = append(prev[:0], k...)
+
+					if !bytes.Equal(k, v) {
+						err = fmt.Errorf("range returned %q for %s", v, k)
+						return false
+					}
+
+					n, _ := strconv.Atoi(string(k[len("key_"):]))
+					if n%2 == 0 {
+						even++
+					}
+
+					return true
+				})
+				if err == nil && even != cnt/2 {
+					err = fmt.Errorf("range should return every stable key, got %d", even)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	checkTree(t, tree)
+}
+
+func TestTreeCorruptedLeaf(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	writer, size, err := NewWriterReaderSeekerCloser()
+	if err != nil {
+		panic(fmt.Sprintf("failed to create writer: %v", err))
+	}
+	defer ClearDB()
+	defer writer.Close()
+
+	pg, err := NewPager(writer, uint64(size))
+	if err != nil {
+		panic(fmt.Sprintf("failed to create pager: %v", err))
+	}
+
+	tree, err := NewTree(pg)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create tree: %v", err))
+	}
+
+	for i := range 1000 {
+		err = tree.Insert(Key(fmt.Sprintf("key_%04d", i)), []byte(fmt.Sprintf("value_%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = pg.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := Key("key_0500")
+
+	leaf, path, err := tree.findLeaf(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(path) == 0 {
+		t.Fatal("tree should have more than one level")
+	}
+
+	// flip a bit in the middle of the leaf holding k
+	off := int64(leaf.ID()*defaultPageSize + defaultPageSize/2)
+
+	b := make([]byte, 1)
+	_, _ = writer.Seek(off, io.SeekStart)
+	_, _ = writer.Read(b)
+	b[0] ^= 0x10
+	_, _ = writer.Seek(off, io.SeekStart)
+	_, _ = writer.Write(b)
+
+	end, err := writer.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pg, err = NewPager(writer, uint64(end))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = NewTree(pg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(op string, err error) {
+		t.Helper()
+
+		var cerr *CorruptionError
+		if !errors.As(err, &cerr) || cerr.ID != leaf.ID() {
+			t.Fatalf("%s should report corrupted page %d, got %v", op, leaf.ID(), err)
+		}
+	}
+
+	check("Update", tree.Update(k, []byte("updated")))
+	check("Insert", tree.Insert(Key("key_0500a"), []byte("inserted")))
+	check("Delete", tree.Delete(k))
+
+	_, err = tree.LSN(k)
+	check("LSN", err)
+
+	c := tree.Cursor()
+	c.Seek(k)
+	check("Cursor.Seek", c.Err())
+}
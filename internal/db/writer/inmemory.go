@@ -1,10 +1,15 @@
 package writer
 
-import "wal"
+import (
+	"sync"
+	"wal"
+)
 
 type stubFile struct {
 	cur   int64
 	pages map[int64][]byte
+
+	mu sync.Mutex
 }
 
 func NewInmemory() wal.WriterReaderSeekerCloser {
@@ -14,24 +19,40 @@ func NewInmemory() wal.WriterReaderSeekerCloser {
 }
 
 func (s *stubFile) Seek(offset int64, _ int) (ret int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.cur = offset
 
 	return 0, nil
 }
 
 func (s *stubFile) Read(b []byte) (n int, err error) {
-	res, ok := s.pages[s.cur]
-	if !ok {
-		return 0, nil
-	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	return copy(b, res), nil
+	return s.readAt(b, s.cur)
+}
+
+func (s *stubFile) ReadAt(b []byte, off int64) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.readAt(b, off)
 }
 
 func (s *stubFile) Write(p []byte) (n int, err error) {
-	s.pages[s.cur] = p
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	return len(p), nil
+	return s.writeAt(p, s.cur)
+}
+
+func (s *stubFile) WriteAt(p []byte, off int64) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.writeAt(p, off)
 }
 
 func (s *stubFile) Close() error {
@@ -41,3 +62,18 @@ func (s *stubFile) Close() error {
 func (s *stubFile) Sync() error {
 	return nil
 }
+
+func (s *stubFile) readAt(b []byte, off int64) (n int, err error) {
+	res, ok := s.pages[off]
+	if !ok {
+		return 0, nil
+	}
+
+	return copy(b, res), nil
+}
+
+func (s *stubFile) writeAt(p []byte, off int64) (n int, err error) {
+	s.pages[off] = append([]byte{}, p...)
+
+	return len(p), nil
+}
@@ -0,0 +1,118 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultCheckpointInterval = time.Minute
+	defaultCheckpointVolume   = 64 << 20
+)
+
+type checkpointer struct {
+	interval time.Duration
+	volume   uint64
+	remove   func(segment uint64) error
+}
+
+type CheckpointerOption func(*checkpointer)
+
+// WithCheckpointInterval sets the time between checkpoints.
+func WithCheckpointInterval(interval time.Duration) CheckpointerOption {
+	return func(c *checkpointer) {
+		c.interval = interval
+	}
+}
+
+// WithCheckpointVolume checkpoints as soon as the given number of bytes is
+// logged since the last checkpoint, before the interval is over.
+func WithCheckpointVolume(bytes uint64) CheckpointerOption {
+	return func(c *checkpointer) {
+		c.volume = bytes
+	}
+}
+
+// WithTruncate calls remove after every checkpoint with the log segment
+// holding the checkpoint record, the segments before it are not needed for
+// recovery any more, see resolver.Segments.Remove.
+func WithTruncate(remove func(segment uint64) error) CheckpointerOption {
+	return func(c *checkpointer) {
+		c.remove = remove
+	}
+}
+
+// RunCheckpointer checkpoints the database in the background until ctx is
+// done, every interval and whenever the log grows by the volume threshold,
+// and truncates the log after each checkpoint. Transactions are not waited
+// for, see log.Log.Checkpoint. It returns the first error.
+func (d *DB) RunCheckpointer(ctx context.Context, opts ...CheckpointerOption) error {
+	c := &checkpointer{
+		interval: defaultCheckpointInterval,
+		volume:   defaultCheckpointVolume,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	d.volume.Store(c.volume)
+	defer d.volume.Store(0)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.wake:
+		case <-ctx.Done():
+			return nil
+		}
+
+		err := d.checkpoint(c.remove)
+		if err != nil {
+			return err
+		}
+
+		ticker.Reset(c.interval)
+	}
+}
+
+// checkpoint checkpoints the database and calls remove with the segments
+// that are no longer needed, if it is set.
+func (d *DB) checkpoint(remove func(segment uint64) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	err := d.log.Checkpoint()
+	if err != nil {
+		return fmt.Errorf("failed to checkpoint: %w", err)
+	}
+
+	if remove == nil {
+		return nil
+	}
+
+	err = d.log.Truncate(remove)
+	if err != nil {
+		return fmt.Errorf("failed to truncate log: %w", err)
+	}
+
+	return nil
+}
+
+// logged wakes the checkpointer once the log outgrows the volume threshold.
+// The caller holds d.mu.
+func (d *DB) logged() {
+	volume := d.volume.Load()
+	if volume == 0 || d.log.Volume() < volume {
+		return
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,239 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"wal"
+	"wal/internal/db"
+	"wal/internal/log"
+	"wal/internal/replay"
+	"wal/internal/storage"
+	"wal/internal/tx"
+
+	"github.com/sergei-durkin/armtracer"
+)
+
+// DB is a key-value store that writes every change to the log before
+// applying it to the tree, so a crash never leaves a half-written tree behind.
+// Changes are made by transactions, see Begin.
+type DB struct {
+	tree  *db.Tree
+	pager *db.Pager
+	log   *log.Log
+	txm   *tx.Manager
+
+	mu sync.Mutex // guards the log
+
+	wake   chan struct{} // the log outgrew volume, see RunCheckpointer
+	volume atomic.Uint64
+}
+
+// Open opens the database stored in f and recovers it from the log segments
+// since the last checkpoint: committed transactions are redone and the ones
+// left in flight are rolled back, see log.Log.Recover. New log entries go to
+// pb, a page reaches f only after the log records of its changes. Pages are
+// written to journal before f, so a crash never leaves f torn, see
+// db.WithDoubleWrite. Options such as the page size apply when f is a new file.
+func Open(f, journal wal.WriterReaderSeekerCloser, size uint64, pb *storage.PageBuffer, segments []wal.ReaderCloser, opts ...db.PagerOption) (*DB, error) {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	if journal == nil {
+		return nil, errNoJournal
+	}
+
+	a := &treeApplier{}
+	l := log.NewLog(pb, a)
+
+	pg, err := db.NewPager(f, size, append(opts, db.WithDoubleWrite(journal), db.WithFlushLog(l.Flush))...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pager: %w", err)
+	}
+
+	tree, err := db.NewTree(pg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tree: %w", err)
+	}
+
+	a.tree, a.pager = tree, pg
+
+	d := &DB{
+		tree:  tree,
+		pager: pg,
+		log:   l,
+		txm:   tx.NewManager(),
+		wake:  make(chan struct{}, 1),
+	}
+
+	entries, err := replay.NewReplay(segments).Replay()
+	if err != nil {
+		return nil, fmt.Errorf("failed to replay log: %w", err)
+	}
+
+	err = d.log.Recover(entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to recover: %w", err)
+	}
+
+	return d, nil
+}
+
+func (d *DB) Insert(k db.Key, v []byte) error {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	return d.update(func(t *Tx) error {
+		_, err := t.Get(k)
+		if err == nil {
+			return db.ErrAlreadyExists
+		}
+
+		if !errors.Is(err, db.ErrNotFound) {
+			return err
+		}
+
+		return t.Put(k, v)
+	})
+}
+
+// Update inserts the key or replaces its value.
+func (d *DB) Update(k db.Key, v []byte) error {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	return d.update(func(t *Tx) error {
+		return t.Put(k, v)
+	})
+}
+
+func (d *DB) Delete(k db.Key) error {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	return d.update(func(t *Tx) error {
+		return t.Delete(k)
+	})
+}
+
+func (d *DB) Find(k db.Key) ([]byte, error) {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	t := d.Begin()
+	defer t.Rollback()
+
+	return t.Get(k)
+}
+
+// Checkpoint syncs the tree to disk and marks the log up to this point as applied.
+func (d *DB) Checkpoint() error {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	return d.checkpoint(nil)
+}
+
+// update runs fn in a transaction and commits it, the transaction is retried
+// while it conflicts with others or is chosen as a deadlock victim.
+func (d *DB) update(fn func(t *Tx) error) error {
+	for {
+		t := d.Begin()
+
+		err := fn(t)
+		if err == nil {
+			err = t.Commit()
+		}
+
+		if err != nil {
+			_ = t.Rollback()
+		}
+
+		if !errors.Is(err, ErrConflict) && !errors.Is(err, tx.ErrDeadlock) {
+			return err
+		}
+	}
+}
+
+// treeApplier applies logged entries to the tree, stamping the changed
+// leaves with the LSN they are applied as of. Entries whose leaf is stamped
+// with that LSN or a later one are already in the tree and are skipped.
+type treeApplier struct {
+	tree  *db.Tree
+	pager *db.Pager
+}
+
+func (a *treeApplier) Apply(lsn uint64, entries []log.Entry) error {
+	// the leaves of the entries share the stamp, so they reach the file together
+	a.pager.Hold()
+
+	err := a.apply(lsn, entries)
+	if err != nil {
+		_ = a.pager.Release()
+		return err
+	}
+
+	return a.pager.Release()
+}
+
+func (a *treeApplier) apply(lsn uint64, entries []log.Entry) error {
+	// decided before anything is applied, the entries share the stamp
+	applied := make([]bool, len(entries))
+	for i, e := range entries {
+		switch e.Type() {
+		case log.WriteEntry, log.DeleteEntry, log.CompensationEntry:
+			stamp, err := a.tree.LSN(db.Key(e.Key))
+			if err != nil {
+				return fmt.Errorf("failed to read lsn of %q: %w", e.Key, err)
+			}
+
+			applied[i] = stamp >= lsn
+		}
+	}
+
+	for i, e := range entries {
+		if applied[i] {
+			continue
+		}
+
+		switch e.Type() {
+		case log.WriteEntry:
+			err := a.tree.UpdateAt(lsn, db.Key(e.Key), e.Data)
+			if err != nil {
+				return fmt.Errorf("failed to apply write of %q: %w", e.Key, err)
+			}
+
+		case log.DeleteEntry:
+			err := a.tree.DeleteAt(lsn, db.Key(e.Key))
+			if err != nil && !errors.Is(err, db.ErrNotFound) {
+				return fmt.Errorf("failed to apply delete of %q: %w", e.Key, err)
+			}
+
+		case log.CompensationEntry:
+			err := a.undo(lsn, e)
+			if err != nil {
+				return fmt.Errorf("failed to apply compensation of %q: %w", e.Key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// undo sets the key of the compensation record back to its before-image.
+func (a *treeApplier) undo(lsn uint64, e log.Entry) error {
+	value, exists := e.Before()
+	if exists {
+		return a.tree.UpdateAt(lsn, db.Key(e.Key), value)
+	}
+
+	err := a.tree.DeleteAt(lsn, db.Key(e.Key))
+	if errors.Is(err, db.ErrNotFound) {
+		return nil
+	}
+
+	return err
+}
+
+func (a *treeApplier) Sync() error {
+	return a.pager.Sync()
+}
+
+func (a *treeApplier) LSN() uint64 {
+	return a.pager.LSN()
+}
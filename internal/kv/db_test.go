@@ -0,0 +1,650 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"sync"
+	"testing"
+	"time"
+	"wal"
+	"wal/internal/db"
+	"wal/internal/log"
+	"wal/internal/storage"
+
+	"github.com/sergei-durkin/armtracer"
+)
+
+// segment keeps everything the page buffer has synced.
+type segment struct {
+	mu    sync.Mutex
+	data  []byte
+	syncs int
+}
+
+func (s *segment) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data = append(s.data, b...)
+
+	return len(b), nil
+}
+
+func (s *segment) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.syncs++
+
+	return nil
+}
+
+func (s *segment) Close() error {
+	return nil
+}
+
+// wait waits for two more syncs, so everything written before the call is on disk.
+func (s *segment) wait() {
+	s.mu.Lock()
+	target := s.syncs + 2
+	s.mu.Unlock()
+
+	for {
+		s.mu.Lock()
+		done := s.syncs >= target
+		s.mu.Unlock()
+
+		if done {
+			return
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (s *segment) snapshot() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]byte{}, s.data...)
+}
+
+func (s *segment) reader() wal.ReaderCloser {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return io.NopCloser(bytes.NewReader(append([]byte{}, s.data...)))
+}
+
+// readers splits the data by the page buffer segments it is written for, a
+// page buffer writing every segment to s fills it with more than one.
+func (s *segment) readers() []wal.ReaderCloser {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		res  []wal.ReaderCloser
+		cur  []byte
+		last = ^uint64(0)
+	)
+
+	for off := 0; off+storage.PageSize <= len(s.data); off += storage.PageSize {
+		var p storage.Page
+		_ = p.FromBytes(s.data[off : off+storage.PageSize])
+
+		if p.Segment() != last && len(cur) > 0 {
+			res = append(res, io.NopCloser(bytes.NewReader(cur)))
+			cur = nil
+		}
+
+		last = p.Segment()
+		cur = append(cur, s.data[off:off+storage.PageSize]...)
+	}
+
+	return append(res, io.NopCloser(bytes.NewReader(cur)))
+}
+
+// file keeps pages written to the database file, only synced pages survive a
+// crash unless the file persists every write at once, as the writes of a
+// killed process do.
+type file struct {
+	cur     int64
+	durable map[int64][]byte
+	pending map[int64][]byte
+
+	persist bool
+	disk    *disk
+	lost    map[int64][]byte // written after the process died
+}
+
+// disk is shared by the files of a process that dies after budget writes:
+// later writes are read back until the crash but never reach the disk, and
+// neither does the log written after the death.
+type disk struct {
+	budget int // negative for no limit
+	writes int
+
+	log    *segment
+	logged []byte // the log as of the death
+}
+
+func newFile(durable map[int64][]byte) *file {
+	return &file{
+		durable: durable,
+		pending: make(map[int64][]byte),
+		lost:    make(map[int64][]byte),
+	}
+}
+
+func (f *file) Seek(offset int64, _ int) (int64, error) {
+	f.cur = offset
+
+	return offset, nil
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	if p, ok := f.lost[f.cur]; ok {
+		return copy(b, p), nil
+	}
+
+	if p, ok := f.pending[f.cur]; ok {
+		return copy(b, p), nil
+	}
+
+	return copy(b, f.durable[f.cur]), nil
+}
+
+func (f *file) Write(b []byte) (int, error) {
+	b = append([]byte{}, b...)
+
+	if f.disk != nil {
+		f.disk.writes++
+
+		if f.disk.budget == 0 {
+			if f.disk.logged == nil {
+				f.disk.logged = f.disk.log.snapshot()
+			}
+
+			f.lost[f.cur] = b
+			return len(b), nil
+		}
+
+		f.disk.budget--
+	}
+
+	if f.persist {
+		f.durable[f.cur] = b
+		delete(f.pending, f.cur)
+	} else {
+		f.pending[f.cur] = b
+	}
+
+	return len(b), nil
+}
+
+func (f *file) Sync() error {
+	for off, p := range f.pending {
+		f.durable[off] = p
+	}
+	clear(f.pending)
+
+	return nil
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+// crash returns the file as it is seen after a restart.
+func (f *file) crash() (*file, uint64) {
+	durable := make(map[int64][]byte, len(f.durable))
+
+	size := int64(0)
+	for off, p := range f.durable {
+		durable[off] = p
+		size = max(size, off+int64(len(p)))
+	}
+
+	return newFile(durable), uint64(size)
+}
+
+func newPageBuffer(ctx context.Context, s *segment) *storage.PageBuffer {
+	pb, err := storage.NewPageBuffer(ctx, 10*time.Millisecond, func(uint64) (wal.WriterCloser, error) {
+		return s, nil
+	})
+	if err != nil {
+		panic(fmt.Sprintf("failed to create page buffer: %v", err))
+	}
+
+	return pb
+}
+
+func TestDBRecover(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	seg := &segment{}
+
+	f := newFile(make(map[int64][]byte))
+	journal := newFile(make(map[int64][]byte))
+
+	d, err := Open(f, journal, 0, newPageBuffer(ctx, seg), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const cnt = 300
+
+	for i := range cnt {
+		err = d.Insert(db.Key(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("value_%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < cnt; i += 3 {
+		err = d.Delete(db.Key(fmt.Sprintf("key_%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 1; i < cnt; i += 3 {
+		err = d.Update(db.Key(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("updated_%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = d.Insert(db.Key("key_1"), []byte("duplicate"))
+	if !errors.Is(err, db.ErrAlreadyExists) {
+		t.Fatalf("insert of an existing key should fail, got %v", err)
+	}
+
+	// a transaction that never committed must not be redone
+	d.mu.Lock()
+	_ = d.log.Append(log.NewBegin(1 << 32))
+	_ = d.log.Append(log.NewWrite(1<<32, "ghost", []byte("ghost")))
+	d.mu.Unlock()
+
+	seg.wait()
+
+	// crash: pages written after the last checkpoint are lost, the log survives
+	f, size := f.crash()
+	journal, _ = journal.crash()
+
+	d, err = Open(f, journal, size, newPageBuffer(ctx, &segment{}), seg.readers())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range cnt {
+		k := db.Key(fmt.Sprintf("key_%d", i))
+
+		v, err := d.Find(k)
+		switch i % 3 {
+		case 0:
+			if !errors.Is(err, db.ErrNotFound) {
+				t.Fatalf("%q should be deleted, got %v", k, err)
+			}
+		case 1:
+			if err != nil || string(v) != fmt.Sprintf("updated_%d", i) {
+				t.Fatalf("%q should be updated, got %q, %v", k, v, err)
+			}
+		case 2:
+			if err != nil || string(v) != fmt.Sprintf("value_%d", i) {
+				t.Fatalf("%q should be inserted, got %q, %v", k, v, err)
+			}
+		}
+	}
+
+	_, err = d.Find(db.Key("ghost"))
+	if !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("uncommitted write should not be applied, got %v", err)
+	}
+}
+
+func TestDBRecoverUndo(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	seg := &segment{}
+
+	f := newFile(make(map[int64][]byte))
+	journal := newFile(make(map[int64][]byte))
+
+	d, err := Open(f, journal, 0, newPageBuffer(ctx, seg), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.Insert(db.Key("kept"), []byte("before"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a transaction in flight at the crash, its changes must be rolled back
+	d.mu.Lock()
+	_ = d.log.Append(log.NewBegin(100))
+	_ = d.log.Append(log.NewWrite(100, "kept", []byte("lost")).WithBefore([]byte("before"), true))
+	_ = d.log.Append(log.NewWrite(100, "fresh", []byte("lost")).WithBefore(nil, false))
+	_ = d.log.Append(log.NewDelete(100, "kept").WithBefore([]byte("lost"), true))
+	d.mu.Unlock()
+
+	seg.wait()
+
+	check := func(d *DB) {
+		t.Helper()
+
+		v, err := d.Find(db.Key("kept"))
+		if err != nil || string(v) != "before" {
+			t.Fatalf("%q should be rolled back, got %q, %v", "kept", v, err)
+		}
+
+		_, err = d.Find(db.Key("fresh"))
+		if !errors.Is(err, db.ErrNotFound) {
+			t.Fatalf("%q should be rolled back, got %v", "fresh", err)
+		}
+	}
+
+	f, size := f.crash()
+	journal, _ = journal.crash()
+
+	undo := &segment{}
+	d, err = Open(f, journal, size, newPageBuffer(ctx, undo), seg.readers())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(d)
+
+	undo.wait()
+
+	// recovery is idempotent, the compensation records are redone at most once
+	f, size = f.crash()
+	journal, _ = journal.crash()
+
+	d, err = Open(f, journal, size, newPageBuffer(ctx, &segment{}), append(seg.readers(), undo.readers()...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(d)
+}
+
+// TestDBRecoverKilled kills the process after every few writes to the
+// database file and its journal. Writes reach the disk as they are made, and
+// the small cache makes the pager write pages back between splits and merges,
+// so recovery has to cope with a file written back halfway. The database must
+// come back as of some commit.
+func TestDBRecoverKilled(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const (
+		cnt = 200
+		ops = 600
+	)
+
+	type op struct {
+		key, value string
+		del        bool
+	}
+
+	// the same commits every run, deletes only hit existing keys
+	var history []op
+	{
+		state := make(map[string]bool)
+		for i := range cnt {
+			k := fmt.Sprintf("key_%d", i)
+			history = append(history, op{key: k, value: fmt.Sprintf("value_%d", i)})
+			state[k] = true
+		}
+
+		rnd := rand.New(rand.NewPCG(1, 2))
+		for i := range ops {
+			k := fmt.Sprintf("key_%d", rnd.IntN(cnt))
+
+			if state[k] && rnd.IntN(2) == 0 {
+				history = append(history, op{key: k, del: true})
+				state[k] = false
+			} else {
+				history = append(history, op{key: k, value: fmt.Sprintf("updated_%d", i)})
+				state[k] = true
+			}
+		}
+	}
+
+	run := func(budget int) int {
+		t.Helper()
+
+		seg := &segment{}
+		dsk := &disk{budget: budget, log: seg}
+
+		f := newFile(make(map[int64][]byte))
+		f.persist, f.disk = true, dsk
+
+		journal := newFile(make(map[int64][]byte))
+		journal.persist, journal.disk = true, dsk
+
+		d, err := Open(f, journal, 0, newPageBuffer(ctx, seg), nil, db.WithCacheSize(3))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, o := range history {
+			if o.del {
+				err = d.Delete(db.Key(o.key))
+			} else {
+				err = d.Update(db.Key(o.key), []byte(o.value))
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if i == cnt {
+				err = d.Checkpoint()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		if dsk.logged == nil {
+			seg.wait()
+			dsk.logged = seg.snapshot()
+		}
+
+		f, size := f.crash()
+		journal, _ = journal.crash()
+
+		d, err = Open(f, journal, size, newPageBuffer(ctx, &segment{}), (&segment{data: dsk.logged}).readers(), db.WithCacheSize(3))
+		if err != nil {
+			t.Fatalf("killed after %d writes: %v", budget, err)
+		}
+
+		got := make(map[string]string)
+		for i := range cnt {
+			k := fmt.Sprintf("key_%d", i)
+
+			v, err := d.Find(db.Key(k))
+			switch {
+			case err == nil:
+				got[k] = string(v)
+
+			case !errors.Is(err, db.ErrNotFound):
+				t.Fatalf("killed after %d writes: failed to find %q: %v", budget, k, err)
+			}
+		}
+
+		// a process that was not killed comes back as of the last commit
+		want := make(map[string]string)
+		found := budget >= 0 && maps.Equal(got, want)
+
+		for _, o := range history {
+			if o.del {
+				delete(want, o.key)
+			} else {
+				want[o.key] = o.value
+			}
+
+			found = found || budget >= 0 && maps.Equal(got, want)
+		}
+
+		if !found && !maps.Equal(got, want) {
+			t.Fatalf("killed after %d writes: the database is not as of any commit", budget)
+		}
+
+		return dsk.writes
+	}
+
+	writes := run(-1)
+
+	for budget := 1; budget < writes; budget += max(1, writes/50) {
+		run(budget)
+	}
+}
+
+// segments hands out a new segment every time the page buffer fills up.
+type segments struct {
+	mu      sync.Mutex
+	all     []*segment
+	removed int
+}
+
+func (s *segments) open(uint64) (wal.WriterCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seg := &segment{}
+	s.all = append(s.all, seg)
+
+	return seg, nil
+}
+
+func (s *segments) remove(segment uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.all[:segment] {
+		s.all[i] = nil
+	}
+	s.removed = max(s.removed, int(segment))
+
+	return nil
+}
+
+func (s *segments) readers() []wal.ReaderCloser {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var res []wal.ReaderCloser
+	for _, seg := range s.all {
+		if seg != nil {
+			res = append(res, seg.reader())
+		}
+	}
+
+	return res
+}
+
+func (s *segments) last() *segment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.all[len(s.all)-1]
+}
+
+func TestDBCheckpointer(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	segs := &segments{}
+
+	pb, err := storage.NewPageBuffer(ctx, 10*time.Millisecond, segs.open)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := newFile(make(map[int64][]byte))
+	journal := newFile(make(map[int64][]byte))
+
+	d, err := Open(f, journal, 0, pb, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runCtx, stop := context.WithCancel(ctx)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- d.RunCheckpointer(runCtx,
+			WithCheckpointInterval(time.Hour),
+			WithCheckpointVolume(256<<10),
+			WithTruncate(segs.remove),
+		)
+	}()
+
+	const cnt = 3000
+
+	value := bytes.Repeat([]byte("v"), 1<<10)
+	for i := range cnt {
+		err = d.Update(db.Key(fmt.Sprintf("key_%d", i%500)), append([]byte(fmt.Sprintf("%d_", i)), value...))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stop()
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if segs.removed == 0 {
+		t.Fatalf("no segment was removed out of %d", len(segs.all))
+	}
+
+	segs.last().wait()
+
+	// the remaining segments are enough to recover
+	f, size := f.crash()
+	journal, _ = journal.crash()
+
+	d, err = Open(f, journal, size, newPageBuffer(ctx, &segment{}), segs.readers())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := cnt - 500; i < cnt; i++ {
+		k := db.Key(fmt.Sprintf("key_%d", i%500))
+
+		v, err := d.Find(k)
+		if err != nil || !bytes.HasPrefix(v, []byte(fmt.Sprintf("%d_", i))) {
+			t.Fatalf("%q should be updated by %d, got %.10q, %v", k, i, v, err)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package kv
+
+import "fmt"
+
+var (
+	ErrConflict = fmt.Errorf("key was changed after the transaction started")
+	ErrTxDone   = fmt.Errorf("transaction is already committed or rolled back")
+
+	errKeyTooLarge = fmt.Errorf("key too large")
+	errNoJournal   = fmt.Errorf("database needs a journal file")
+)
@@ -0,0 +1,322 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"wal/internal/db"
+	"wal/internal/log"
+	"wal/internal/tx"
+
+	"github.com/sergei-durkin/armtracer"
+)
+
+// Tx is a transaction of DB. It reads the data committed before it began
+// together with its own writes. Writes lock their keys until the transaction
+// ends, are logged as they are made and reach the tree on Commit.
+// A Tx is not safe for concurrent use.
+type Tx struct {
+	d   *DB
+	tx  *tx.Tx
+	ctx context.Context // bounds lock waits
+
+	writes map[string]write // the last write of every key
+	order  []string         // keys in the order of their first write
+
+	logged bool // the begin record is in the log
+	done   bool
+}
+
+type write struct {
+	value   []byte
+	deleted bool
+}
+
+// Begin starts a transaction, it must end with Commit or Rollback.
+func (d *DB) Begin() *Tx {
+	return d.BeginTx(context.Background())
+}
+
+// BeginTx starts a transaction whose writes wait for locks held by other
+// transactions until ctx is done.
+func (d *DB) BeginTx(ctx context.Context) *Tx {
+	return &Tx{
+		d:   d,
+		tx:  d.txm.Begin(),
+		ctx: ctx,
+
+		writes: make(map[string]write),
+	}
+}
+
+// Get returns the value of k, it never waits for other transactions.
+func (t *Tx) Get(k db.Key) ([]byte, error) {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	if t.done {
+		return nil, ErrTxDone
+	}
+
+	if w, ok := t.writes[string(k)]; ok {
+		if w.deleted {
+			return nil, db.ErrNotFound
+		}
+
+		return append([]byte{}, w.value...), nil
+	}
+
+	return t.d.read(t.tx, k)
+}
+
+// Put inserts the key or replaces its value.
+func (t *Tx) Put(k db.Key, v []byte) error {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	return t.write(k, write{value: append([]byte{}, v...)})
+}
+
+// Delete removes the key, it fails with db.ErrNotFound if the key is not visible.
+func (t *Tx) Delete(k db.Key) error {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	_, err := t.Get(k)
+	if err != nil {
+		return err
+	}
+
+	return t.write(k, write{deleted: true})
+}
+
+// LockRange keeps other transactions from writing the keys k with
+// from <= k < to, a nil to leaves the range unbounded. It waits for the
+// transactions already writing to the range and holds until the transaction
+// ends, so a range read twice returns the same keys. It fails with
+// ErrConflict if a key of the range was written since the transaction began.
+func (t *Tx) LockRange(from, to db.Key) error {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	if t.done {
+		return ErrTxDone
+	}
+
+	r := tx.KeyRange{From: from, To: to}
+
+	err := t.tx.LockRange(t.ctx, r, tx.LockRead)
+	if err != nil {
+		return fmt.Errorf("failed to lock [%q, %q): %w", from, to, err)
+	}
+
+	// the snapshot reads of the range miss keys committed before the lock
+	if key, ok := t.tx.Changed(r); ok {
+		return fmt.Errorf("%w: %q", ErrConflict, key)
+	}
+
+	return nil
+}
+
+// Commit applies the writes to the tree and releases the locks. Transactions
+// started before the commit keep reading the overwritten values.
+func (t *Tx) Commit() error {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	if t.done {
+		return ErrTxDone
+	}
+
+	// a deadlock victim lost its locks, its writes must not reach the tree
+	err := t.tx.Prepare()
+	if err != nil {
+		_ = t.Rollback()
+
+		if !errors.Is(err, tx.ErrDeadlock) {
+			err = ErrTxDone
+		}
+
+		return fmt.Errorf("failed to commit tx %d: %w", t.tx.ID(), err)
+	}
+	t.done = true
+
+	if !t.logged {
+		t.tx.Commit()
+		return nil
+	}
+
+	lsn, err := t.d.commit(t)
+	if err != nil {
+		t.tx.Abort()
+		return err
+	}
+
+	// locks are kept until the commit record is durable, so nobody acts on
+	// changes a crash can still take back; concurrent commits share the sync
+	err = t.d.log.WaitDurable(lsn)
+	t.tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to make tx %d durable: %w", t.tx.ID(), err)
+	}
+
+	return nil
+}
+
+// Rollback drops the writes and releases the locks.
+func (t *Tx) Rollback() error {
+	defer armtracer.EndTrace(armtracer.BeginTrace(""))
+
+	if t.done {
+		return ErrTxDone
+	}
+	t.done = true
+
+	defer t.tx.Abort()
+
+	if !t.logged {
+		return nil
+	}
+
+	t.d.mu.Lock()
+	defer t.d.mu.Unlock()
+
+	err := t.d.log.Append(log.NewRollback(uint64(t.tx.ID())))
+	if err != nil {
+		return fmt.Errorf("failed to roll back tx %d: %w", t.tx.ID(), err)
+	}
+
+	return nil
+}
+
+func (t *Tx) write(k db.Key, w write) error {
+	if t.done {
+		return ErrTxDone
+	}
+
+	if !k.Valid() {
+		return fmt.Errorf("%w: %d bytes", errKeyTooLarge, len(k))
+	}
+
+	err := t.lock(k)
+	if err != nil {
+		return err
+	}
+
+	key := string(k)
+	txid := uint64(t.tx.ID())
+
+	entry := log.NewWrite(txid, key, w.value)
+	if w.deleted {
+		entry = log.NewDelete(txid, key)
+	}
+
+	// the tree keeps the committed value until the commit, it is the
+	// before-image recovery undoes the change with
+	before, err := t.d.tree.Find(k)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return fmt.Errorf("failed to read %q: %w", k, err)
+	}
+	entry = entry.WithBefore(before, err == nil)
+
+	err = t.d.append(t, entry)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := t.writes[key]; !ok {
+		t.order = append(t.order, key)
+	}
+	t.writes[key] = w
+
+	return nil
+}
+
+// lock takes the write lock of k and checks that k was not changed by a
+// transaction committed after this one began.
+func (t *Tx) lock(k db.Key) error {
+	err := t.tx.LockKey(t.ctx, k, tx.LockWrite)
+	if err != nil {
+		return fmt.Errorf("failed to lock %q: %w", k, err)
+	}
+
+	if _, _, ok := t.tx.Version(string(k)); ok {
+		return fmt.Errorf("%w: %q", ErrConflict, k)
+	}
+
+	return nil
+}
+
+// read returns the value of k visible to trx. The tree is read before the
+// saved versions, so a commit in between is not missed.
+func (d *DB) read(trx *tx.Tx, k db.Key) ([]byte, error) {
+	v, err := d.tree.Find(k)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return nil, err
+	}
+
+	if old, exists, ok := trx.Version(string(k)); ok {
+		if !exists {
+			return nil, db.ErrNotFound
+		}
+
+		return old, nil
+	}
+
+	return v, err
+}
+
+// append logs the entry of t, the first one is preceded by the begin record.
+func (d *DB) append(t *Tx, entry log.Entry) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	txid := t.tx.ID()
+
+	if !t.logged {
+		err := d.log.Append(log.NewBegin(uint64(txid)))
+		if err != nil {
+			return fmt.Errorf("failed to begin tx %d: %w", txid, err)
+		}
+
+		t.logged = true
+	}
+
+	err := d.log.Append(entry)
+	if err != nil {
+		return fmt.Errorf("failed to log tx %d: %w", txid, err)
+	}
+	d.logged()
+
+	return nil
+}
+
+// commit saves the values t overwrites for older transactions and logs the
+// commit record, which applies the writes to the tree. It returns the LSN of
+// the record.
+func (d *DB) commit(t *Tx) (uint64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	txid := t.tx.ID()
+
+	changes := make([]log.Entry, 0, len(t.order))
+	for _, key := range t.order {
+		v, err := d.tree.Find(db.Key(key))
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return 0, fmt.Errorf("failed to read %q: %w", key, err)
+		}
+
+		t.tx.Save(key, v, err == nil)
+
+		w := t.writes[key]
+		if w.deleted {
+			changes = append(changes, log.NewDelete(uint64(txid), key))
+		} else {
+			changes = append(changes, log.NewWrite(uint64(txid), key, w.value))
+		}
+	}
+
+	err := d.log.Commit(log.NewCommit(uint64(txid)), changes)
+	if err != nil {
+		return 0, fmt.Errorf("failed to commit tx %d: %w", txid, err)
+	}
+	d.logged()
+
+	return d.log.LSN(), nil
+}
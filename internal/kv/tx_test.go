@@ -0,0 +1,392 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+	"wal/internal/db"
+	"wal/internal/tx"
+
+	"github.com/sergei-durkin/armtracer"
+)
+
+func TestTx(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	seg := &segment{}
+	f := newFile(make(map[int64][]byte))
+	journal := newFile(make(map[int64][]byte))
+
+	d, err := Open(f, journal, 0, newPageBuffer(ctx, seg), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.Insert(db.Key("a"), []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := d.Begin()
+
+	trx := d.Begin()
+	if err = trx.Put(db.Key("a"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err = trx.Put(db.Key("b"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := trx.Get(db.Key("a")); err != nil || string(v) != "2" {
+		t.Fatalf("transaction should read its own write, got %q, %v", v, err)
+	}
+
+	if v, err := d.Find(db.Key("a")); err != nil || string(v) != "1" {
+		t.Fatalf("uncommitted write should not be visible, got %q, %v", v, err)
+	}
+
+	err = trx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := reader.Get(db.Key("a")); err != nil || string(v) != "1" {
+		t.Fatalf("reader should see its snapshot, got %q, %v", v, err)
+	}
+
+	if _, err := reader.Get(db.Key("b")); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("reader should not see b, got %v", err)
+	}
+
+	// a was changed after the reader began
+	err = reader.Put(db.Key("a"), []byte("3"))
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("write of a changed key should conflict, got %v", err)
+	}
+
+	err = reader.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = reader.Commit(); !errors.Is(err, ErrTxDone) {
+		t.Fatalf("ended transaction should not commit, got %v", err)
+	}
+
+	trx = d.Begin()
+	if err = trx.Delete(db.Key("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err = trx.Put(db.Key("c"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := trx.Get(db.Key("b")); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("transaction should not see its deleted key, got %v", err)
+	}
+
+	err = trx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := d.Find(db.Key("b")); err != nil || string(v) != "1" {
+		t.Fatalf("rolled back delete should not be applied, got %q, %v", v, err)
+	}
+
+	if _, err := d.Find(db.Key("c")); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("rolled back write should not be applied, got %v", err)
+	}
+
+	seg.wait()
+
+	f, size := f.crash()
+	journal, _ = journal.crash()
+
+	d, err = Open(f, journal, size, newPageBuffer(ctx, &segment{}), seg.readers())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, want := range map[string]string{"a": "2", "b": "1"} {
+		if v, err := d.Find(db.Key(k)); err != nil || string(v) != want {
+			t.Fatalf("%q should be %q after recovery, got %q, %v", k, want, v, err)
+		}
+	}
+
+	if _, err := d.Find(db.Key("c")); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("rolled back write should not be recovered, got %v", err)
+	}
+}
+
+func TestTxConcurrent(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d, err := Open(newFile(make(map[int64][]byte)), newFile(make(map[int64][]byte)), 0, newPageBuffer(ctx, &segment{}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		accounts  = 10
+		transfers = 100
+		total     = accounts * 100
+	)
+
+	for i := range accounts {
+		err = d.Insert(db.Key(fmt.Sprintf("acc_%d", i)), []byte(fmt.Sprint(total/accounts)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// sum reads every account in one snapshot
+	sum := func() int {
+		trx := d.Begin()
+		defer trx.Rollback()
+
+		res := 0
+		for i := range accounts {
+			v, err := trx.Get(db.Key(fmt.Sprintf("acc_%d", i)))
+			if err != nil {
+				t.Error(err)
+				return 0
+			}
+
+			var n int
+			fmt.Sscan(string(v), &n)
+			res += n
+		}
+
+		return res
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := range transfers {
+			from, to := db.Key(fmt.Sprintf("acc_%d", i%accounts)), db.Key(fmt.Sprintf("acc_%d", (i+1)%accounts))
+
+			err := d.update(func(trx *Tx) error {
+				for j, k := range []db.Key{from, to} {
+					v, err := trx.Get(k)
+					if err != nil {
+						return err
+					}
+
+					var n int
+					fmt.Sscan(string(v), &n)
+
+					delta := 1
+					if j == 0 {
+						delta = -1
+					}
+
+					err = trx.Put(k, []byte(fmt.Sprint(n+delta)))
+					if err != nil {
+						return err
+					}
+				}
+
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			if s := sum(); s != total {
+				t.Fatalf("sum should be %d, got %d", total, s)
+			}
+
+			return
+		default:
+		}
+
+		if s := sum(); s != total {
+			t.Fatalf("snapshot sum should be %d, got %d", total, s)
+		}
+	}
+}
+
+func TestTxLockRange(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d, err := Open(newFile(make(map[int64][]byte)), newFile(make(map[int64][]byte)), 0, newPageBuffer(ctx, &segment{}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := d.Begin()
+	if err = reader.LockRange(db.Key("b"), db.Key("d")); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout, cancelTimeout := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancelTimeout()
+
+	writer := d.BeginTx(timeout)
+
+	// a phantom of the range
+	err = writer.Put(db.Key("c"), []byte("1"))
+	if !errors.Is(err, tx.ErrLockTimeout) {
+		t.Fatalf("insert into a locked range should wait, got %v", err)
+	}
+
+	err = writer.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.Insert(db.Key("d"), []byte("1"))
+	if err != nil {
+		t.Fatalf("key out of the range should be written, got %v", err)
+	}
+
+	insertedCh := make(chan error)
+	go func() {
+		insertedCh <- d.Insert(db.Key("c"), []byte("1"))
+	}()
+
+	select {
+	case err = <-insertedCh:
+		t.Fatalf("insert should wait for the reader, got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	err = reader.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-insertedCh
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := d.Find(db.Key("c")); err != nil || string(v) != "1" {
+		t.Fatalf("c should be inserted, got %q, %v", v, err)
+	}
+}
+
+func TestTxBulk(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	seg := &segment{}
+	f := newFile(make(map[int64][]byte))
+	journal := newFile(make(map[int64][]byte))
+
+	d, err := Open(f, journal, 0, newPageBuffer(ctx, seg), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const cnt = 5000
+
+	trx := d.Begin()
+	for i := range cnt {
+		err = trx.Put(db.Key(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("value_%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// recovery reads the records of the transaction from before the checkpoint
+		if i == cnt/2 {
+			err = d.Checkpoint()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	err = trx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seg.wait()
+
+	f, size := f.crash()
+	journal, _ = journal.crash()
+
+	d, err = Open(f, journal, size, newPageBuffer(ctx, &segment{}), seg.readers())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range cnt {
+		k := db.Key(fmt.Sprintf("key_%d", i))
+
+		v, err := d.Find(k)
+		if err != nil || string(v) != fmt.Sprintf("value_%d", i) {
+			t.Fatalf("%q should be committed, got %q, %v", k, v, err)
+		}
+	}
+}
+
+func TestTxLockRangeAfterInsert(t *testing.T) {
+	armtracer.Begin()
+	defer armtracer.End()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d, err := Open(newFile(make(map[int64][]byte)), newFile(make(map[int64][]byte)), 0, newPageBuffer(ctx, &segment{}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := d.Begin()
+
+	// committed before the range is locked, the snapshot of reader misses it
+	err = d.Insert(db.Key("c"), []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = reader.LockRange(db.Key("d"), nil)
+	if err != nil {
+		t.Fatalf("range without new keys should be locked, got %v", err)
+	}
+
+	err = reader.LockRange(db.Key("b"), db.Key("d"))
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("range with a key committed after the snapshot should conflict, got %v", err)
+	}
+
+	err = reader.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader = d.Begin()
+	defer reader.Rollback()
+
+	err = reader.LockRange(db.Key("b"), db.Key("d"))
+	if err != nil {
+		t.Fatalf("range should be locked by a later snapshot, got %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package log
+
+import (
+	"wal/internal/binary/pack"
+	"wal/internal/binary/unpack"
+)
+
+const activeTxSize = 16 // txid and last LSN
+
+// ActiveTx is a transaction in flight at a checkpoint.
+type ActiveTx struct {
+	TxID    uint64
+	LastLSN uint64 // of the last record of the transaction
+}
+
+// newCheckpoint returns the checkpoint record with the minimum recovery LSN
+// and the active transactions packed into Data.
+func newCheckpoint(redo uint64, active []ActiveTx) Entry {
+	e := NewCheckpoint()
+	e.Data = make([]byte, 8+4+len(active)*activeTxSize)
+
+	ptr := pack.Uint64(e.Data, redo, 0)
+	ptr = pack.Uint32(e.Data, uint32(len(active)), ptr)
+
+	for _, tx := range active {
+		ptr = pack.Uint64(e.Data, tx.TxID, ptr)
+		ptr = pack.Uint64(e.Data, tx.LastLSN, ptr)
+	}
+
+	return e
+}
+
+// Checkpoint returns the content of a checkpoint record: redo is the minimum
+// recovery LSN, the oldest record recovery reads, and active the transactions
+// in flight at the checkpoint, their records start at redo or later. Redo is
+// the LSN of the record itself when nothing was in flight or the record was
+// made by NewCheckpoint.
+func (e Entry) Checkpoint() (redo uint64, active []ActiveTx) {
+	if e.typ != CheckpointEntry || len(e.Data) < 12 {
+		return e.lsn, nil
+	}
+
+	redo, ptr := unpack.Uint64(e.Data, 0)
+	if redo == 0 {
+		redo = e.lsn
+	}
+	n, ptr := unpack.Uint32(e.Data, ptr)
+	if len(e.Data) < ptr+int(n)*activeTxSize {
+		return redo, nil
+	}
+
+	active = make([]ActiveTx, 0, n)
+	for range n {
+		var tx ActiveTx
+		tx.TxID, ptr = unpack.Uint64(e.Data, ptr)
+		tx.LastLSN, ptr = unpack.Uint64(e.Data, ptr)
+
+		active = append(active, tx)
+	}
+
+	return redo, active
+}
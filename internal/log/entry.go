@@ -15,23 +15,39 @@ const (
 	CommitEntry     EntryType = 4
 	RollbackEntry   EntryType = 5
 	CheckpointEntry EntryType = 6
+
+	// CompensationEntry sets a key back to the before-image of an undone
+	// write or delete, it is redone but never undone itself.
+	CompensationEntry EntryType = 7
+)
+
+const (
+	flagExisted uint8 = 1 << iota // the key had the before-image value
 )
 
 type header struct {
-	typ  EntryType
-	txid uint64
+	typ   EntryType
+	flags uint8
+	txid  uint64
+	prev  uint64 // LSN of the previous record of the transaction
+	next  uint64 // LSN of the next record to undo, compensation records only
 }
 
 const (
 	headerSize = int(unsafe.Sizeof(header{}))
 	keySize    = 4 // uint32 for key length
+	dataSize   = 4 // uint32 for data length
 )
 
 type Entry struct {
 	header
 
+	lsn uint64 // position of the record in the log, see storage.LSN
+
 	Key  string
 	Data []byte
+
+	before []byte // value of Key before the change, see Before
 }
 
 func (e Entry) Type() EntryType {
@@ -42,6 +58,41 @@ func (e Entry) TxID() uint64 {
 	return e.txid
 }
 
+// LSN returns the log sequence number of the record, zero until it is
+// appended or read from the log.
+func (e Entry) LSN() uint64 {
+	return e.lsn
+}
+
+// Prev returns the LSN of the previous record of the transaction, zero for the first one.
+func (e Entry) Prev() uint64 {
+	return e.prev
+}
+
+// UndoNext returns the LSN of the next record of the transaction to undo
+// after a compensation record, zero when the undo is complete.
+func (e Entry) UndoNext() uint64 {
+	return e.next
+}
+
+// Before returns the value the key had before a write or delete, exists is
+// false if there was no key. A compensation record sets the key back to it.
+func (e Entry) Before() (value []byte, exists bool) {
+	return e.before, e.flags&flagExisted != 0
+}
+
+// WithBefore returns the write or delete record carrying the before-image the
+// change is undone with.
+func (e Entry) WithBefore(value []byte, exists bool) Entry {
+	e.before = value
+	e.flags &^= flagExisted
+	if exists {
+		e.flags |= flagExisted
+	}
+
+	return e
+}
+
 func NewBegin(txid uint64) Entry {
 	return Entry{
 		header: header{
@@ -90,6 +141,21 @@ func NewDelete(txid uint64, key string) Entry {
 	}
 }
 
+// NewCompensation returns the record undoing a change of the transaction by
+// setting key back to value, undoNext is the Prev of the undone record.
+func NewCompensation(txid uint64, key string, value []byte, exists bool, undoNext uint64) Entry {
+	e := Entry{
+		header: header{
+			typ:  CompensationEntry,
+			txid: txid,
+			next: undoNext,
+		},
+		Key: key,
+	}
+
+	return e.WithBefore(value, exists)
+}
+
 func NewCheckpoint() Entry {
 	return Entry{
 		header: header{
@@ -101,7 +167,7 @@ func NewCheckpoint() Entry {
 
 // Pack packs the Entry into a byte slice.
 func (e *Entry) Pack() []byte {
-	serialized := make([]byte, headerSize+keySize+len(e.Key)+len(e.Data))
+	serialized := make([]byte, headerSize+keySize+len(e.Key)+dataSize+len(e.Data)+len(e.before))
 
 	// Header
 	ptr := 0
@@ -109,8 +175,15 @@ func (e *Entry) Pack() []byte {
 	// Type
 	ptr = pack.Uint8(serialized, uint8(e.typ), ptr)
 
+	// Flags
+	ptr = pack.Uint8(serialized, e.flags, ptr)
+
 	// Transaction ID
-	_ = pack.Uint64(serialized, e.txid, ptr)
+	ptr = pack.Uint64(serialized, e.txid, ptr)
+
+	// LSNs
+	ptr = pack.Uint64(serialized, e.prev, ptr)
+	_ = pack.Uint64(serialized, e.next, ptr)
 
 	// Key
 	ptr = headerSize
@@ -121,12 +194,26 @@ func (e *Entry) Pack() []byte {
 	// Key data
 	ptr += copy(serialized[ptr:], e.Key)
 
+	// Data length
+	ptr = pack.Uint32(serialized, uint32(len(e.Data)), ptr)
+
 	// Data
-	copy(serialized[ptr:], e.Data)
+	ptr += copy(serialized[ptr:], e.Data)
+
+	// Before-image
+	copy(serialized[ptr:], e.before)
 
 	return serialized
 }
 
+// NewFromBytesAt unpacks the entry read from the log at lsn.
+func NewFromBytesAt(lsn uint64, data []byte) Entry {
+	e := NewFromBytes(data)
+	e.lsn = lsn
+
+	return e
+}
+
 func NewFromBytes(data []byte) Entry {
 	var e Entry
 
@@ -138,9 +225,15 @@ func NewFromBytes(data []byte) Entry {
 	typ, ptr := unpack.Uint8(data, ptr)
 	e.typ = EntryType(typ)
 
+	// Flags
+	e.flags, ptr = unpack.Uint8(data, ptr)
+
 	// Transaction ID
-	txid, ptr := unpack.Uint64(data, ptr)
-	e.txid = txid
+	e.txid, ptr = unpack.Uint64(data, ptr)
+
+	// LSNs
+	e.prev, ptr = unpack.Uint64(data, ptr)
+	e.next, _ = unpack.Uint64(data, ptr)
 
 	ptr = headerSize
 
@@ -153,9 +246,18 @@ func NewFromBytes(data []byte) Entry {
 	e.Key = string(data[ptr : ptr+int(keyLen)])
 	ptr += int(keyLen)
 
+	// Data length
+	dataLen, ptr := unpack.Uint32(data, ptr)
+
 	// Data
-	e.Data = make([]byte, len(data)-ptr)
-	copy(e.Data, data[ptr:])
+	e.Data = make([]byte, dataLen)
+	ptr += copy(e.Data, data[ptr:ptr+int(dataLen)])
+
+	// Before-image
+	if ptr < len(data) {
+		e.before = make([]byte, len(data)-ptr)
+		copy(e.before, data[ptr:])
+	}
 
 	return e
 }
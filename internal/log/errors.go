@@ -3,5 +3,5 @@ package log
 import "fmt"
 
 var (
-	ErrLogFull = fmt.Errorf("log is full")
+	errBrokenChain = fmt.Errorf("record chain of the transaction is broken")
 )
@@ -1,34 +1,62 @@
 package log
 
 import (
+	"cmp"
 	"fmt"
+	"slices"
+	"sync/atomic"
 	"wal/internal/storage"
 )
 
-const (
-	entriesCount = 1024
-)
+// Applier applies committed transactions to the database.
+type Applier interface {
+	// Apply applies entries of a single committed transaction in log order, or
+	// a compensation record, as of lsn. Changes the database already holds as
+	// of lsn or later are skipped, so entries can be applied again after a crash.
+	Apply(lsn uint64, entries []Entry) error
+
+	// Sync makes applied transactions durable, it is called before every checkpoint.
+	Sync() error
+
+	// LSN returns the highest LSN the database holds changes of.
+	LSN() uint64
+}
 
+// Log writes records to the page buffer and applies transactions once they
+// commit. Every record gets the next LSN and links to the previous record of
+// its transaction. Only the LSN range of an in-flight transaction is kept, so
+// transactions may be of any size: Commit is handed the changes to apply, and
+// recovery reads the records back from the replayed log. Append and Commit are
+// not safe for concurrent use, Flush is.
 type Log struct {
-	cur     int
-	entries [1024]Entry
+	txs      map[uint64]span // of every in-flight transaction
+	replayed []Entry         // the log recovery reads records back from, see record
+	volume   uint64          // bytes of records appended since the last checkpoint
+	segment  uint64          // page buffer segment holding the last checkpoint record
+
+	lsn     atomic.Uint64 // of the last written record
+	flushed atomic.Uint64 // records up to it were on disk before the start
 
 	pb *storage.PageBuffer
+	a  Applier
 }
 
-func NewLog(pb *storage.PageBuffer) *Log {
-	return &Log{
-		pb: pb,
-	}
+// span is the LSN range of the records of a transaction.
+type span struct {
+	first uint64
+	last  uint64
 }
 
-type Transaction struct {
-	committed  bool
-	rolledback bool
+func NewLog(pb *storage.PageBuffer, a Applier) *Log {
+	return &Log{
+		txs: make(map[uint64]span),
+		pb:  pb,
+		a:   a,
+	}
 }
 
 func (l *Log) Append(entry Entry) error {
-	err := l.pb.Write(entry.Pack())
+	err := l.write(&entry)
 	if err != nil {
 		return err
 	}
@@ -36,60 +64,313 @@ func (l *Log) Append(entry Entry) error {
 	return l.append(entry)
 }
 
-func (l *Log) append(entry Entry) error {
-	if l.cur < entriesCount {
-		l.entries[l.cur] = entry
-		l.cur++
+// Commit writes the commit record and applies changes, the writes and
+// deletes of the transaction in log order, to the database as of it.
+func (l *Log) Commit(entry Entry, changes []Entry) error {
+	err := l.write(&entry)
+	if err != nil {
+		return err
+	}
+
+	l.end(entry.txid)
 
+	if l.a == nil || len(changes) == 0 {
 		return nil
 	}
 
-	activeEntries := make([]Entry, 0, entriesCount)
-	txMap := make(map[uint64]*Transaction)
-	for i := l.cur - 1; i >= 0; i-- {
-		e := l.entries[i]
+	return l.a.Apply(entry.lsn, changes)
+}
+
+// LSN returns the LSN of the last written record.
+func (l *Log) LSN() uint64 {
+	return l.lsn.Load()
+}
+
+// Flush makes records up to lsn durable, records written later may be synced
+// along with them.
+func (l *Log) Flush(lsn uint64) error {
+	if lsn <= l.flushed.Load() {
+		return nil
+	}
+
+	return l.pb.Flush(lsn)
+}
+
+// WaitDurable waits until records up to lsn are durable as the durability
+// mode of the page buffer requires, see storage.Durability.
+func (l *Log) WaitDurable(lsn uint64) error {
+	return l.pb.WaitDurable(lsn)
+}
+
+// Recover brings the database to the state of the log after a crash in three
+// passes over the entries found by replay:
+//   - analysis finds the last LSN and the transactions in flight;
+//   - redo applies committed transactions and compensation records the
+//     database misses, in log order;
+//   - undo rolls back transactions left in flight, logging every undone change
+//     as a compensation record, see undo.
+//
+// Records of a transaction are read back from entries when it commits or is
+// undone, entries must be in LSN order as replay returns them.
+func (l *Log) Recover(entries []Entry) error {
+	last := uint64(0)
+	if l.a != nil {
+		last = l.a.LSN()
+	}
+
+	for i := 0; i < len(entries); i++ {
+		last = max(last, entries[i].lsn)
+	}
+
+	// replayed records are on disk already, new ones go to a later segment
+	l.lsn.Store(last)
+	l.flushed.Store(last)
 
-		if _, ok := txMap[e.txid]; !ok {
-			txMap[e.txid] = &Transaction{}
+	if last > 0 {
+		segment, _ := storage.Position(last)
+		err := l.pb.Advance(segment + 1)
+		if err != nil {
+			return err
 		}
+	}
 
-		tx := txMap[e.txid]
+	l.replayed = entries
 
-		if e.typ == CommitEntry {
-			tx.committed = true
-			continue
+	for i := 0; i < len(entries); i++ {
+		err := l.append(entries[i])
+		if err != nil {
+			return err
 		}
+	}
+
+	err := l.undo()
+	if err != nil {
+		return err
+	}
+
+	l.reset()
+
+	return l.Checkpoint()
+}
+
+// undo rolls back the in-flight transactions, newest change first. A change
+// is undone by a compensation record setting the key back to its
+// before-image, the record points to the next change to undo, so an undo cut
+// short by another crash resumes where it stopped instead of starting over.
+// The transaction then ends with a rollback record.
+func (l *Log) undo() error {
+	for _, txid := range l.inFlight() {
+		next := l.lastLSN(txid)
+		for next != 0 {
+			e, err := l.record(txid, next)
+			if err != nil {
+				return err
+			}
+
+			switch e.typ {
+			case CompensationEntry:
+				next = e.next
+
+			case WriteEntry, DeleteEntry:
+				value, exists := e.Before()
 
-		if e.typ == RollbackEntry {
-			tx.rolledback = true
-			continue
+				err := l.Append(NewCompensation(txid, e.Key, value, exists, e.prev))
+				if err != nil {
+					return err
+				}
+
+				next = e.prev
+
+			default:
+				next = e.prev
+			}
 		}
 
-		if tx.rolledback {
-			continue
+		err := l.Append(NewRollback(txid))
+		if err != nil {
+			return err
 		}
+	}
 
-		if tx.committed {
-			// implement apply on database
-			fmt.Printf("Applying transaction %d with %v entries\n", e.txid, e)
-			continue
+	return nil
+}
+
+// Checkpoint makes applied transactions durable and writes a checkpoint record
+// holding the in-flight transactions and the minimum recovery LSN, see
+// Entry.Checkpoint. Transactions keep running across it, replay reads the log
+// from the minimum recovery LSN so it sees their records, and segments before
+// the one holding it are no longer needed.
+func (l *Log) Checkpoint() error {
+	if l.a != nil {
+		err := l.a.Sync()
+		if err != nil {
+			return err
 		}
+	}
+
+	txids := l.inFlight()
+
+	// records of in-flight transactions are the oldest ones replay needs,
+	// zero stands for the checkpoint record itself
+	redo := uint64(0)
+	active := make([]ActiveTx, 0, len(txids))
+	for _, txid := range txids {
+		first := l.txs[txid].first
+		if redo == 0 || first < redo {
+			redo = first
+		}
+
+		active = append(active, ActiveTx{TxID: txid, LastLSN: l.lastLSN(txid)})
+	}
+
+	cp := newCheckpoint(redo, active)
+	err := l.write(&cp)
+	if err != nil {
+		return err
+	}
 
-		activeEntries = append(activeEntries, e)
+	// the record is durable before segments are removed
+	err = l.Flush(cp.lsn)
+	if err != nil {
+		return err
 	}
 
-	cp := NewCheckpoint()
-	err := l.pb.Write(cp.Pack())
+	redo, _ = cp.Checkpoint()
+
+	l.volume = 0
+	l.segment, _ = storage.Position(redo)
+
+	return nil
+}
+
+// Volume returns the number of bytes written since the last checkpoint.
+func (l *Log) Volume() uint64 {
+	return l.volume
+}
+
+// Truncate calls remove with the page buffer segment holding the minimum
+// recovery LSN of the last checkpoint, the segments before it are not needed
+// for recovery.
+func (l *Log) Truncate(remove func(segment uint64) error) error {
+	return remove(l.segment)
+}
+
+// write writes the entry to the page buffer and stamps it with its LSN, the
+// position it is written at.
+func (l *Log) write(entry *Entry) error {
+	if entry.typ != CheckpointEntry {
+		entry.prev = l.lastLSN(entry.txid)
+	}
+
+	data := entry.Pack()
+
+	lsn, err := l.pb.Write(data)
 	if err != nil {
 		return err
 	}
 
-	if len(activeEntries) >= entriesCount {
-		return ErrLogFull
+	entry.lsn = lsn
+	l.lsn.Store(lsn)
+	l.volume += uint64(len(data))
+
+	return nil
+}
+
+func (l *Log) append(entry Entry) error {
+	switch entry.typ {
+	case CommitEntry:
+		return l.commit(entry)
+	case RollbackEntry:
+		l.end(entry.txid)
+		return nil
+	case CheckpointEntry:
+		return nil
+	case CompensationEntry:
+		if l.a != nil {
+			err := l.a.Apply(entry.lsn, []Entry{entry})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	tx, ok := l.txs[entry.txid]
+	if !ok {
+		tx.first = entry.lsn
 	}
+	tx.last = entry.lsn
 
-	activeEntries = append(activeEntries, entry)
-	l.cur = len(activeEntries)
+	l.txs[entry.txid] = tx
 
 	return nil
 }
+
+// commit applies the records of the transaction read back from the log to the
+// database as of the commit record.
+func (l *Log) commit(entry Entry) error {
+	if l.a == nil {
+		l.end(entry.txid)
+		return nil
+	}
+
+	var tx []Entry
+	for next := l.lastLSN(entry.txid); next != 0; {
+		e, err := l.record(entry.txid, next)
+		if err != nil {
+			return err
+		}
+
+		tx = append(tx, e)
+		next = e.prev
+	}
+	slices.Reverse(tx)
+
+	l.end(entry.txid)
+	if len(tx) == 0 {
+		return nil
+	}
+
+	return l.a.Apply(entry.lsn, tx)
+}
+
+// record reads the record of the transaction at lsn back from the replayed log.
+func (l *Log) record(txid, lsn uint64) (Entry, error) {
+	i, ok := slices.BinarySearchFunc(l.replayed, lsn, func(e Entry, lsn uint64) int {
+		return cmp.Compare(e.lsn, lsn)
+	})
+	if !ok || l.replayed[i].txid != txid {
+		return Entry{}, fmt.Errorf("%w: record %d of tx %d", errBrokenChain, lsn, txid)
+	}
+
+	return l.replayed[i], nil
+}
+
+// end forgets the transaction.
+func (l *Log) end(txid uint64) {
+	delete(l.txs, txid)
+}
+
+func (l *Log) reset() {
+	clear(l.txs)
+	l.replayed = nil
+}
+
+// lastLSN returns the LSN of the last record of the transaction, zero if it
+// has none.
+func (l *Log) lastLSN(txid uint64) uint64 {
+	return l.txs[txid].last
+}
+
+// inFlight returns the in-flight transactions in the order they began.
+func (l *Log) inFlight() []uint64 {
+	txids := make([]uint64, 0, len(l.txs))
+	for txid := range l.txs {
+		txids = append(txids, txid)
+	}
+
+	slices.SortFunc(txids, func(a, b uint64) int {
+		return cmp.Compare(l.txs[a].first, l.txs[b].first)
+	})
+
+	return txids
+}
@@ -0,0 +1,7 @@
+package replay
+
+import "fmt"
+
+var (
+	errHeadlessChunk = fmt.Errorf("headless chunk without endless chunk")
+)
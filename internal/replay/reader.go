@@ -48,7 +48,8 @@ const (
 )
 
 type logItem struct {
-	typ  uint8 // Type of chunk 1 = headless, 2 = endless, 3 = full
+	typ  uint8  // Type of chunk 1 = headless, 2 = endless, 3 = full
+	lsn  uint64 // of the first chunk
 	data []byte
 }
 
@@ -67,14 +68,16 @@ func (ch *logItem) IsFull() bool {
 func (lr *logReader) Read() []logItem {
 	var result []logItem
 
-	for i := 0; i <= storage.CountPages; i++ {
+	for i := 0; i < storage.CountPages; i++ {
 		if lr.pages[i].Len() == 0 {
 			break
 		}
 
 		pageChunk := lr.pages[i].GetSegments()
 		for _, ch := range pageChunk {
-			bufferChunk := logItem{}
+			bufferChunk := logItem{
+				lsn: storage.LSN(lr.pages[i].Segment(), uint32(i)*storage.PageSize+ch.Offset()),
+			}
 
 			// Full chunk
 			if !ch.IsPart() {
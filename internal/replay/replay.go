@@ -1,7 +1,9 @@
 package replay
 
 import (
+	"cmp"
 	"fmt"
+	"slices"
 	"wal"
 	"wal/internal/log"
 )
@@ -16,7 +18,47 @@ func NewReplay(readers []wal.ReaderCloser) *Replay {
 	}
 }
 
+// Replay returns the entries recovery needs: the ones from the minimum
+// recovery LSN of the last checkpoint on, see log.Entry.Checkpoint.
 func (r *Replay) Replay() ([]log.Entry, error) {
+	res, err := r.read()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(res) - 1; i >= 0; i-- {
+		if res[i].Type() == log.CheckpointEntry {
+			redo, _ := res[i].Checkpoint()
+
+			return from(res, redo), nil
+		}
+	}
+
+	return res, nil
+}
+
+// ReplayFrom returns the entries from the one at lsn on, or from the first
+// later one if there is no entry at lsn.
+func (r *Replay) ReplayFrom(lsn uint64) ([]log.Entry, error) {
+	res, err := r.read()
+	if err != nil {
+		return nil, err
+	}
+
+	return from(res, lsn), nil
+}
+
+// from returns the entries with LSNs from lsn on, entries are in LSN order.
+func from(entries []log.Entry, lsn uint64) []log.Entry {
+	i, _ := slices.BinarySearchFunc(entries, lsn, func(e log.Entry, lsn uint64) int {
+		return cmp.Compare(e.LSN(), lsn)
+	})
+
+	return entries[i:]
+}
+
+// read reads every entry of the segments in the order of the readers.
+func (r *Replay) read() ([]log.Entry, error) {
 	res := []log.Entry{}
 
 	var endless *logItem
@@ -24,7 +66,7 @@ func (r *Replay) Replay() ([]log.Entry, error) {
 	for len(r.readers) > 0 {
 		lr, err := NewLogReader(r.readers[0])
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("failed to read log segment: %w", err)
 		}
 
 		r.readers[0].Close()
@@ -37,7 +79,7 @@ func (r *Replay) Replay() ([]log.Entry, error) {
 		chs := lr.Read()
 		for i := 0; i < len(chs); i++ {
 			if chs[i].IsFull() {
-				res = append(res, log.NewFromBytes(chs[i].data))
+				res = append(res, log.NewFromBytesAt(chs[i].lsn, chs[i].data))
 
 				continue
 			}
@@ -46,20 +88,21 @@ func (r *Replay) Replay() ([]log.Entry, error) {
 				if endless != nil {
 					endless.data = append(endless.data, chs[i].data...)
 					if !chs[i].IsEndless() {
-						res = append(res, log.NewFromBytes(endless.data))
+						res = append(res, log.NewFromBytesAt(endless.lsn, endless.data))
 						endless = nil
 					}
 
 					continue
 				}
 
-				panic("Headless chunk without endless chunk, something is wrong")
+				return nil, errHeadlessChunk
 			}
 
 			if chs[i].IsEndless() {
 				if endless == nil {
 					endless = &logItem{
 						typ:  chs[i].typ,
+						lsn:  chs[i].lsn,
 						data: chs[i].data,
 					}
 
@@ -72,17 +115,7 @@ func (r *Replay) Replay() ([]log.Entry, error) {
 		}
 	}
 
-	if endless != nil {
-		panic(fmt.Sprintf("Endless chunk without end, something is wrong, len=%d", len(endless.data)))
-	}
-
-	cp := 0
-	for i := len(res) - 1; i >= 0; i-- {
-		if res[i].Type() == log.CheckpointEntry {
-			cp = i
-			break
-		}
-	}
-
-	return res[cp:], nil
+	// An endless chunk left at the end is an entry torn by a crash in the
+	// middle of the write, it was never acknowledged so it is dropped
+	return res, nil
 }
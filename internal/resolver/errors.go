@@ -0,0 +1,7 @@
+package resolver
+
+import "fmt"
+
+var (
+	errUnknownSegment = fmt.Errorf("segment was not opened")
+)
@@ -0,0 +1,112 @@
+package resolver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"wal"
+)
+
+// Segments opens the log segments of a page buffer as files named
+// <prefix>_<timestamp>_<segment>.log and removes the ones recovery no longer
+// needs. The timestamp is taken once, so the names of a run sort by segment
+// and come after the ones of earlier runs.
+type Segments struct {
+	prefix  string
+	archive string
+	run     string // timestamp of the first segment
+
+	mu     sync.Mutex
+	opened map[uint64]string // by segment number
+}
+
+type SegmentsOption func(*Segments)
+
+// WithArchive moves segments that are no longer needed to dir instead of
+// removing them.
+func WithArchive(dir string) SegmentsOption {
+	return func(s *Segments) {
+		s.archive = dir
+	}
+}
+
+func NewSegments(prefix string, opts ...SegmentsOption) *Segments {
+	s := &Segments{
+		prefix: prefix,
+		opened: make(map[uint64]string),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Open creates the file of the segment, it is the writer provider of a
+// single page buffer.
+func (s *Segments) Open(segment uint64) (wal.WriterCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.run == "" {
+		s.run = time.Now().Format(TIME_FORMAT)
+	}
+
+	name := fmt.Sprintf(FILENAME_FORMAT, s.prefix, fmt.Sprintf(SEGMENT_FORMAT, s.run, segment))
+
+	// an existing file is never truncated, it may hold records of another run
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s.opened[segment] = name
+
+	return f, nil
+}
+
+// Remove removes or archives the segments older than the given one, both the
+// ones opened by s and the ones left by earlier runs. It is meant for
+// log.Log.Truncate.
+func (s *Segments) Remove(segment uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keep, ok := s.opened[segment]
+	if !ok {
+		return fmt.Errorf("%w: %d", errUnknownSegment, segment)
+	}
+
+	// names sort in the order the segments were written
+	names, err := filepath.Glob(fmt.Sprintf(FILENAME_FORMAT, s.prefix, "*"))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if name >= keep {
+			continue
+		}
+
+		if s.archive != "" {
+			err = os.Rename(name, filepath.Join(s.archive, filepath.Base(name)))
+		} else {
+			err = os.Remove(name)
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to remove segment %s: %w", name, err)
+		}
+	}
+
+	for n := range s.opened {
+		if n < segment {
+			delete(s.opened, n)
+		}
+	}
+
+	return nil
+}
@@ -1,38 +1,29 @@
 package resolver
 
 import (
-	"fmt"
 	"os"
-	"time"
 	"wal"
 	"wal/internal/cmd"
 )
 
 const (
 	FILENAME_FORMAT = "%s_%s.log"
-	TIME_FORMAT     = "20060102-150405.000"
+	SEGMENT_FORMAT  = "%s_%020d" // timestamp of the run and segment number
+	TIME_FORMAT     = "20060102-150405.000000000"
 
 	LOG_FILE  = "logfile"
 	MOCK_FILE = "mockfile"
 	STDOUT    = "stdout"
 )
 
-func NewWriter(args []cmd.Arg) func() (wal.WriterCloser, error) {
+func NewWriter(args []cmd.Arg) func(uint64) (wal.WriterCloser, error) {
 	for _, arg := range args {
 		if arg.Name == LOG_FILE && arg.Value != "" {
-			return func() (wal.WriterCloser, error) {
-				timestamp := time.Now().Format(TIME_FORMAT)
-				f, err := os.OpenFile(fmt.Sprintf(FILENAME_FORMAT, arg.Value, timestamp), os.O_CREATE|os.O_WRONLY, 0644)
-				if err != nil {
-					return nil, err
-				}
-
-				return f, nil
-			}
+			return NewSegments(arg.Value).Open
 		}
 
 		if arg.Name == MOCK_FILE {
-			return func() (wal.WriterCloser, error) {
+			return func(uint64) (wal.WriterCloser, error) {
 				return &stubFile{}, nil
 			}
 		}
@@ -43,7 +34,7 @@ func NewWriter(args []cmd.Arg) func() (wal.WriterCloser, error) {
 	}
 
 	f := os.Stdout
-	return func() (wal.WriterCloser, error) {
+	return func(uint64) (wal.WriterCloser, error) {
 		return &stdoutFile{f: f}, nil
 	}
 }
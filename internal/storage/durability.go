@@ -0,0 +1,95 @@
+package storage
+
+import "time"
+
+// Durability tells when WaitDurable returns.
+type Durability uint8
+
+const (
+	// DurabilitySync syncs the records of every caller, concurrent callers
+	// share a sync.
+	DurabilitySync Durability = iota
+
+	// DurabilityGroup waits up to the group delay for more callers before the
+	// shared sync, trading latency for fewer syncs under load.
+	DurabilityGroup
+
+	// DurabilityAsync returns at once, the records become durable with the
+	// next periodic sync and can be lost on power failure until then.
+	DurabilityAsync
+)
+
+// WithDurability sets the durability mode, DurabilitySync by default.
+func WithDurability(mode Durability) PageBufferOption {
+	return func(pb *PageBuffer) {
+		pb.durability = mode
+	}
+}
+
+// WithGroupCommit sets DurabilityGroup with the given maximum delay of a sync.
+func WithGroupCommit(maxDelay time.Duration) PageBufferOption {
+	return func(pb *PageBuffer) {
+		pb.durability = DurabilityGroup
+		pb.groupDelay = maxDelay
+	}
+}
+
+// Flush makes records up to lsn durable, records written later may be synced
+// along with them. Concurrent callers share a sync.
+func (pb *PageBuffer) Flush(lsn uint64) error {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	return pb.flush(lsn, 0)
+}
+
+// WaitDurable waits until records up to lsn are durable as the durability
+// mode requires, see Durability.
+func (pb *PageBuffer) WaitDurable(lsn uint64) error {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	switch pb.durability {
+	case DurabilityAsync:
+		return pb.err
+	case DurabilityGroup:
+		return pb.flush(lsn, pb.groupDelay)
+	default:
+		return pb.flush(lsn, 0)
+	}
+}
+
+// flush syncs until records up to lsn are durable. The first caller leads
+// the sync, the ones coming while it waits for the delay or syncs wait for
+// it instead of syncing on their own. The caller holds pb.mu.
+func (pb *PageBuffer) flush(lsn uint64, delay time.Duration) error {
+	// nothing past the last record is ever synced
+	lsn = min(lsn, pb.last)
+
+	for pb.durable < lsn {
+		if pb.err != nil {
+			return pb.err
+		}
+
+		if pb.flushing {
+			pb.flushed.Wait()
+			continue
+		}
+
+		pb.flushing = true
+
+		if delay > 0 {
+			pb.mu.Unlock()
+			time.Sleep(delay)
+			pb.mu.Lock()
+		}
+
+		err := pb.sync()
+		pb.flushing = false
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,14 @@
+package storage
+
+// LSN returns the log sequence number of the record written at offset of the
+// given segment. LSNs grow with every record written by a page buffer and
+// are never zero: the first page of a segment starts after its header.
+func LSN(segment uint64, offset uint32) uint64 {
+	return segment<<32 | uint64(offset)
+}
+
+// Position returns the segment and the offset in it of the record at lsn.
+// The offset counts from the first page the segment file holds.
+func Position(lsn uint64) (segment uint64, offset uint32) {
+	return lsn >> 32, uint32(lsn)
+}
@@ -30,14 +30,16 @@ type header struct {
 	typ     uint16
 	version uint16
 	head    uint32
+	segment uint64 // the page buffer segment the page belongs to
 
-	_ [48]byte // padding to 64 bytes
+	_ [40]byte // padding to 64 bytes
 }
 
 type Segment struct {
 	typ segmentType
 	ln  uint32
 	rem uint32
+	off uint32 // of the segment metadata in the page
 
 	data []byte
 }
@@ -46,6 +48,11 @@ func (s *Segment) Data() []byte {
 	return s.data
 }
 
+// Offset returns the position of the segment in the page.
+func (s *Segment) Offset() uint32 {
+	return s.off
+}
+
 func (s *Segment) IsPart() bool {
 	return s.typ != 1
 }
@@ -64,6 +71,8 @@ func (p *Page) GetSegments() []Segment {
 			break
 		}
 
+		off := uint32(headerSize) + uint32(ptr)
+
 		var (
 			typ uint8
 			ln  uint32
@@ -82,6 +91,7 @@ func (p *Page) GetSegments() []Segment {
 		s.typ = segmentType(typ)
 		s.ln = ln
 		s.rem = rem
+		s.off = off
 		s.data = data[ptr : ptr+int(ln)]
 		ptr += int(ln)
 
@@ -117,6 +127,17 @@ func (p *Page) Len() uint32 {
 	return p.Header().head
 }
 
+// Segment returns the number of the page buffer segment the page belongs to.
+func (p *Page) Segment() uint64 {
+	return p.Header().segment
+}
+
+// SetSegment sets the number of the page buffer segment, it is set before
+// the first write so the checksum covers it.
+func (p *Page) SetSegment(segment uint64) {
+	p.Header().segment = segment
+}
+
 // Pack packs the page into the given buffer.
 func (p *Page) Pack() []byte {
 	return p[:]
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"time"
 	"wal"
@@ -18,14 +19,42 @@ type PageBuffer struct {
 	dirty [CountPages]bool
 	w     wal.WriterCloser
 
+	segment uint64 // number of the file w
+	first   int    // page the file w starts with
+
+	last       uint64     // LSN of the last record written
+	durable    uint64     // records up to it are synced
+	flushing   bool       // a flush leads a sync, see flush
+	syncing    bool       // a sync writes to w without pb.mu, see sync
+	flushed    *sync.Cond // broadcast after every sync
+	durability Durability
+	groupDelay time.Duration
+
+	err     error       // the first I/O failure, every later call returns it
+	onError func(error) // called once with err
+
 	bufferPool sync.Pool
-	newFile    func() (wal.WriterCloser, error)
+	newFile    func(segment uint64) (wal.WriterCloser, error)
 
 	mu sync.Mutex
 }
 
-func NewPageBuffer(ctx context.Context, syncInterval time.Duration, writerProvider func() (wal.WriterCloser, error)) (*PageBuffer, error) {
-	w, err := writerProvider()
+type PageBufferOption func(*PageBuffer)
+
+// WithErrorHandler sets the function called in its own goroutine with the
+// first I/O failure, from then on the page buffer only returns the error.
+func WithErrorHandler(fn func(error)) PageBufferOption {
+	return func(pb *PageBuffer) {
+		pb.onError = fn
+	}
+}
+
+// NewPageBuffer returns the page buffer writing to the files got from
+// writerProvider, one per segment, the first one is segment zero. Written
+// pages are synced every syncInterval and whenever a caller waits for its
+// records, see WaitDurable.
+func NewPageBuffer(ctx context.Context, syncInterval time.Duration, writerProvider func(segment uint64) (wal.WriterCloser, error), opts ...PageBufferOption) (*PageBuffer, error) {
+	w, err := writerProvider(0)
 	if err != nil {
 		return nil, err
 	}
@@ -34,6 +63,7 @@ func NewPageBuffer(ctx context.Context, syncInterval time.Duration, writerProvid
 		cur:   0,
 		pages: [CountPages]Page{},
 		w:     w,
+		first: 1, // the first write moves past the empty page
 		bufferPool: sync.Pool{
 			New: func() any {
 				return make([]byte, PageSize)
@@ -41,6 +71,11 @@ func NewPageBuffer(ctx context.Context, syncInterval time.Duration, writerProvid
 		},
 		newFile: writerProvider,
 	}
+	pageBuffer.flushed = sync.NewCond(&pageBuffer.mu)
+
+	for _, opt := range opts {
+		opt(pageBuffer)
+	}
 
 	go func(pb *PageBuffer, interval time.Duration) {
 		ticker := time.NewTicker(interval)
@@ -52,9 +87,10 @@ func NewPageBuffer(ctx context.Context, syncInterval time.Duration, writerProvid
 
 		for {
 			select {
+			// failures are kept in pb.err for the callers
 			case <-ticker.C:
 				if pb.mu.TryLock() {
-					pb.sync()
+					_ = pb.sync()
 					pb.mu.Unlock()
 					continue
 				}
@@ -62,13 +98,20 @@ func NewPageBuffer(ctx context.Context, syncInterval time.Duration, writerProvid
 				unsuccessfulSyncs++
 				if unsuccessfulSyncs >= 3 {
 					pb.mu.Lock()
-					pb.sync()
+					_ = pb.sync()
 					pb.mu.Unlock()
 				}
 
 			case <-ctx.Done():
 				pb.mu.Lock()
-				pb.w.Close()
+				for pb.syncing {
+					pb.flushed.Wait()
+				}
+
+				err := pb.w.Close()
+				if err != nil {
+					_ = pb.fail(fmt.Errorf("failed to close segment %d: %w", pb.segment, err))
+				}
 				pb.mu.Unlock()
 
 				return
@@ -80,43 +123,131 @@ func NewPageBuffer(ctx context.Context, syncInterval time.Duration, writerProvid
 	return pageBuffer, nil
 }
 
-// Write concurrent writes data to the disk
-func (pb *PageBuffer) Write(data []byte) (err error) {
+// Write concurrent writes data to the disk and returns the LSN of the
+// record, the position of its first segment.
+func (pb *PageBuffer) Write(data []byte) (lsn uint64, err error) {
 	pb.mu.Lock()
 	defer pb.mu.Unlock()
 
+	if pb.err != nil {
+		return 0, pb.err
+	}
+
 	if len(data)+int(metaSize) < int(PageDataSize) {
 		// If current page has space, write to it
-		err = pb.write(data, -1)
+		lsn, err = pb.write(data, -1)
 		if nil == err {
-			return nil
+			pb.last = lsn
+			return lsn, nil
 		} else if err != errTooLarge {
-			return err
+			return 0, err
 		}
 	}
 
 	// If data is larger than a page, split it into segments
+	lsn = 0
 	for len(data) > 0 {
 		psize := min(len(data), int(PageDataSize-metaSize))
 		segment := data[0:psize]
 		data = data[psize:]
 
-		err = pb.write(segment, int32(len(data)))
+		at, err := pb.write(segment, int32(len(data)))
 		if err != nil {
-			return err
+			return 0, err
+		}
+
+		if lsn == 0 {
+			lsn = at
 		}
 	}
+	pb.last = lsn
 
-	return nil
+	return lsn, nil
 }
 
-// sync writes all unsynced pages to the disk
-func (pb *PageBuffer) sync() {
-	ln := min(pb.cur, CountPages-1)
+// Sync writes every page written so far to the disk and waits for it.
+func (pb *PageBuffer) Sync() error {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	return pb.sync()
+}
+
+// Err returns the I/O failure that stopped the page buffer, nil while it is
+// healthy. Records written before it may not be durable.
+func (pb *PageBuffer) Err() error {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	return pb.err
+}
+
+// fail stops the page buffer with err unless it is stopped already and
+// returns the error it is stopped with. Waiters for a sync are woken up.
+func (pb *PageBuffer) fail(err error) error {
+	if pb.err == nil {
+		pb.err = err
+
+		if pb.onError != nil {
+			go pb.onError(err)
+		}
+	}
+
+	pb.flushed.Broadcast()
+
+	return pb.err
+}
+
+// Segment returns the number of the file being written, the page buffer moves
+// to the next file every time it fills up.
+func (pb *PageBuffer) Segment() uint64 {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	return pb.segment
+}
+
+// Advance moves to a new file numbered segment unless the current one is
+// numbered segment or later, so LSNs keep growing after a restart.
+func (pb *PageBuffer) Advance(segment uint64) error {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	if pb.segment >= segment {
+		return nil
+	}
+
+	err := pb.sync()
+	if err != nil {
+		return err
+	}
+
+	return pb.reset(segment)
+}
+
+// sync writes all unsynced pages to the disk. A file implementing
+// wal.WriterAt gets every page at its offset, so the last page is written
+// again as it fills up instead of leaving the rest of it empty. The pages are
+// copied under pb.mu, which is released while they are written and synced, so
+// records keep coming in meanwhile. The caller holds pb.mu.
+func (pb *PageBuffer) sync() error {
+	// one sync at a time, the pages of the next one go after these
+	for pb.syncing {
+		pb.flushed.Wait()
+	}
 
-	buff := pb.bufferPool.Get().([]byte)
-	defer pb.bufferPool.Put(buff)
+	if pb.err != nil {
+		return pb.err
+	}
+
+	type pending struct {
+		data []byte
+		off  int64
+	}
 
+	var pages []pending
+
+	ln := min(pb.cur, CountPages-1)
 	for i := 0; i <= ln; i++ {
 		if !pb.dirty[i] {
 			continue
@@ -128,24 +259,67 @@ func (pb *PageBuffer) sync() {
 
 		pb.dirty[i] = false
 
-		n, err := pb.w.Write(pb.pages[i].Pack())
-		if err != nil {
-			panic(err)
+		buff := pb.bufferPool.Get().([]byte)
+		copy(buff, pb.pages[i].Pack())
+
+		pages = append(pages, pending{data: buff, off: int64(i-pb.first) * PageSize})
+	}
+
+	w, segment, last := pb.w, pb.segment, pb.last
+
+	pb.syncing = true
+	pb.mu.Unlock()
+
+	err := func() error {
+		for _, p := range pages {
+			var (
+				n   int
+				err error
+			)
+
+			if at, ok := w.(wal.WriterAt); ok {
+				n, err = at.WriteAt(p.data, p.off)
+			} else {
+				n, err = w.Write(p.data)
+			}
+
+			if err != nil {
+				return fmt.Errorf("failed to write segment %d: %w", segment, err)
+			}
+
+			if n != len(p.data) {
+				return fmt.Errorf("failed to write segment %d: %w", segment, errShortWrite)
+			}
 		}
 
-		if n != len(buff) {
-			panic(errShortWrite)
+		err := w.Sync()
+		if err != nil {
+			return fmt.Errorf("failed to sync segment %d: %w", segment, err)
 		}
+
+		return nil
+	}()
+
+	pb.mu.Lock()
+	pb.syncing = false
+
+	for _, p := range pages {
+		pb.bufferPool.Put(p.data)
 	}
 
-	err := pb.w.Sync()
 	if err != nil {
-		panic(err)
+		return pb.fail(err)
 	}
+
+	pb.durable = max(pb.durable, last)
+	pb.flushed.Broadcast()
+
+	return nil
 }
 
-// reset resets the page buffer to its initial state
-func (pb *PageBuffer) reset() {
+// reset resets the page buffer to its initial state writing to the file of
+// the given segment
+func (pb *PageBuffer) reset(segment uint64) error {
 	pb.cur = 0
 	for i := range pb.pages {
 		pb.pages[i].Reset()
@@ -154,35 +328,71 @@ func (pb *PageBuffer) reset() {
 
 	err := pb.w.Close()
 	if err != nil {
-		panic(err)
+		return pb.fail(fmt.Errorf("failed to close segment %d: %w", pb.segment, err))
 	}
 
-	pb.w, err = pb.newFile()
+	w, err := pb.newFile(segment)
 	if err != nil {
-		panic(err)
+		return pb.fail(fmt.Errorf("failed to create segment %d: %w", segment, err))
 	}
+	pb.w = w
+	pb.segment = segment
+	pb.first = 1
+
+	return nil
 }
 
-// write writes data to the current page, if the current page is full, it moves to the next page
-func (pb *PageBuffer) write(data []byte, remaining int32) error {
-	if !pb.dirty[pb.cur] || !pb.pages[pb.cur].HasSpace(uint32(len(data))) {
+// write writes data to the current page, if the current page is full, it
+// moves to the next page. It returns the LSN data is written at.
+func (pb *PageBuffer) write(data []byte, remaining int32) (uint64, error) {
+	if !pb.open() || !pb.pages[pb.cur].HasSpace(uint32(len(data))) {
 		pb.cur++
 		if pb.cur >= CountPages {
-			pb.sync() // If no more pages, force sync to disk and reset
-			pb.reset()
+			// If no more pages, force sync to disk and reset
+			err := pb.sync()
+			if err != nil {
+				return 0, err
+			}
+
+			err = pb.reset(pb.segment + 1)
+			if err != nil {
+				return 0, err
+			}
+			pb.first = 0
 		}
 	}
 
-	n, err := pb.pages[pb.cur].Write(data, remaining)
+	p := &pb.pages[pb.cur]
+	if p.Len() == 0 {
+		p.SetSegment(pb.segment)
+	}
+
+	// pages go to the file in order
+	offset := uint32(pb.cur-pb.first)*PageSize + uint32(headerSize) + p.Len()
+
+	n, err := p.Write(data, remaining)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	if n != len(data) {
-		panic(errShortWrite)
+		return 0, errShortWrite
 	}
 
 	pb.dirty[pb.cur] = true
 
-	return nil
+	return LSN(pb.segment, offset), nil
+}
+
+// open reports whether records may still go to the current page: it is not
+// synced yet or it is rewritten in place by the next sync. The empty page the
+// file starts after is never open.
+func (pb *PageBuffer) open() bool {
+	if pb.dirty[pb.cur] {
+		return true
+	}
+
+	_, ok := pb.w.(wal.WriterAt)
+
+	return ok && pb.cur >= pb.first && pb.pages[pb.cur].Len() > 0
 }
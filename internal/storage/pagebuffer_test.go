@@ -3,6 +3,8 @@ package storage_test
 import (
 	"bytes"
 	"context"
+	"errors"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -34,7 +36,7 @@ func TestSyncPageBuffer(t *testing.T) {
 		}
 	}()
 
-	provider := func() (wal.WriterCloser, error) {
+	provider := func(uint64) (wal.WriterCloser, error) {
 		return NewMockFile(
 			func(b []byte) (n int, err error) {
 				actualData = append(actualData, b...)
@@ -54,7 +56,7 @@ func TestSyncPageBuffer(t *testing.T) {
 		t.Fatal("failed to create PageBuffer:", err)
 	}
 
-	err = pb.Write([]byte("Hello, World!"))
+	_, err = pb.Write([]byte("Hello, World!"))
 	if err != nil {
 		t.Error("failed to write to PageBuffer:", err)
 	}
@@ -74,7 +76,7 @@ func TestWritePageBuffer(t *testing.T) {
 	ctx := context.Background()
 	syncInterval := 1 * time.Hour
 
-	provider := func() (wal.WriterCloser, error) {
+	provider := func(uint64) (wal.WriterCloser, error) {
 		return NewMockFile(
 			func(b []byte) (n int, err error) {
 				return len(b), nil
@@ -89,7 +91,7 @@ func TestWritePageBuffer(t *testing.T) {
 		t.Fatal("failed to create PageBuffer:", err)
 	}
 
-	err = pb.Write([]byte("Hello, World!"))
+	_, err = pb.Write([]byte("Hello, World!"))
 	if err != nil {
 		t.Error("failed to write to PageBuffer:", err)
 	}
@@ -100,7 +102,7 @@ func TestWrite1MBPageBuffer(t *testing.T) {
 	syncInterval := 1 * time.Hour
 
 	i := 0
-	provider := func() (wal.WriterCloser, error) {
+	provider := func(uint64) (wal.WriterCloser, error) {
 		return NewMockFile(
 			func(b []byte) (n int, err error) {
 				i++
@@ -117,7 +119,7 @@ func TestWrite1MBPageBuffer(t *testing.T) {
 	}
 
 	b1m := make([]byte, storage.PageBufferSize)
-	err = pb.Write(b1m)
+	_, err = pb.Write(b1m)
 	if err != nil {
 		t.Error("failed to write to PageBuffer:", err)
 	}
@@ -156,3 +158,344 @@ func (m *MockFile) Close() error {
 func (m *MockFile) Sync() error {
 	return m.sync()
 }
+
+func TestPageBufferLSN(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var segments []uint64
+	provider := func(segment uint64) (wal.WriterCloser, error) {
+		segments = append(segments, segment)
+
+		return NewMockFile(
+			func(b []byte) (n int, err error) {
+				return len(b), nil
+			},
+			func() error { return nil },
+			func() error { return nil },
+		), nil
+	}
+
+	pb, err := storage.NewPageBuffer(ctx, time.Hour, provider)
+	if err != nil {
+		t.Fatal("failed to create PageBuffer:", err)
+	}
+
+	last := uint64(0)
+	for _, size := range []int{10, 100, storage.PageSize * 3, 10} {
+		lsn, err := pb.Write(make([]byte, size))
+		if err != nil {
+			t.Fatal("failed to write to PageBuffer:", err)
+		}
+
+		if lsn <= last {
+			t.Fatalf("LSN %d of a %d bytes record should be after %d", lsn, size, last)
+		}
+		last = lsn
+	}
+
+	pb.Advance(5)
+
+	lsn, err := pb.Write([]byte("Hello, World!"))
+	if err != nil {
+		t.Fatal("failed to write to PageBuffer:", err)
+	}
+
+	if segment, _ := storage.Position(lsn); segment != 5 || lsn <= last {
+		t.Fatalf("LSN %d should be in segment 5 after %d, got segment %d", lsn, last, segment)
+	}
+
+	if len(segments) != 2 || segments[1] != 5 {
+		t.Fatalf("expected files of segments 0 and 5, got %v", segments)
+	}
+}
+
+func TestPageBufferWaitDurable(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		opt   storage.PageBufferOption
+		check func(t *testing.T, syncs int32)
+	}{
+		{
+			name: "sync",
+			opt:  storage.WithDurability(storage.DurabilitySync),
+			check: func(t *testing.T, syncs int32) {
+				if syncs == 0 {
+					t.Error("expected a sync")
+				}
+			},
+		},
+		{
+			name: "group",
+			opt:  storage.WithGroupCommit(20 * time.Millisecond),
+			check: func(t *testing.T, syncs int32) {
+				if syncs == 0 || syncs > 5 {
+					t.Errorf("expected the callers to share a few syncs, got %d", syncs)
+				}
+			},
+		},
+		{
+			name: "async",
+			opt:  storage.WithDurability(storage.DurabilityAsync),
+			check: func(t *testing.T, syncs int32) {
+				if syncs != 0 {
+					t.Errorf("expected no syncs, got %d", syncs)
+				}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			syncs := int32(0)
+			provider := func(uint64) (wal.WriterCloser, error) {
+				return NewMockFile(
+					func(b []byte) (n int, err error) {
+						return len(b), nil
+					},
+					func() error { return nil },
+					func() error {
+						atomic.AddInt32(&syncs, 1)
+						return nil
+					},
+				), nil
+			}
+
+			pb, err := storage.NewPageBuffer(ctx, time.Hour, provider, tc.opt)
+			if err != nil {
+				t.Fatal("failed to create PageBuffer:", err)
+			}
+
+			const callers = 50
+
+			var wg sync.WaitGroup
+			wg.Add(callers)
+			for range callers {
+				go func() {
+					defer wg.Done()
+
+					lsn, err := pb.Write([]byte("Hello, World!"))
+					if err != nil {
+						t.Error("failed to write to PageBuffer:", err)
+						return
+					}
+
+					err = pb.WaitDurable(lsn)
+					if err != nil {
+						t.Error("failed to wait for PageBuffer:", err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			tc.check(t, atomic.LoadInt32(&syncs))
+		})
+	}
+}
+
+// atFile keeps what is written at every offset, like a file implementing
+// wal.WriterAt.
+type atFile struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (f *atFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.data = append(f.data, b...)
+
+	return len(b), nil
+}
+
+func (f *atFile) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if end := int(off) + len(b); end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+
+	return copy(f.data[off:], b), nil
+}
+
+func (f *atFile) Sync() error {
+	return nil
+}
+
+func (f *atFile) Close() error {
+	return nil
+}
+
+func TestPageBufferRewrite(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := &atFile{}
+	provider := func(uint64) (wal.WriterCloser, error) {
+		return f, nil
+	}
+
+	pb, err := storage.NewPageBuffer(ctx, time.Hour, provider, storage.WithDurability(storage.DurabilitySync))
+	if err != nil {
+		t.Fatal("failed to create PageBuffer:", err)
+	}
+
+	const cnt = 1000
+
+	for range cnt {
+		lsn, err := pb.Write([]byte("Hello, World!"))
+		if err != nil {
+			t.Fatal("failed to write to PageBuffer:", err)
+		}
+
+		err = pb.WaitDurable(lsn)
+		if err != nil {
+			t.Fatal("failed to wait for PageBuffer:", err)
+		}
+	}
+
+	// every sync rewrites the last page instead of starting a new one
+	if len(f.data) != 3*storage.PageSize {
+		t.Fatalf("expected %d records in 3 pages, got %d bytes", cnt, len(f.data))
+	}
+
+	records := 0
+	for off := 0; off < len(f.data); off += storage.PageSize {
+		var p storage.Page
+		_ = p.FromBytes(f.data[off : off+storage.PageSize])
+
+		records += len(p.GetSegments())
+	}
+
+	if records != cnt {
+		t.Fatalf("expected %d records, got %d", cnt, records)
+	}
+}
+
+func TestPageBufferWriteDuringSync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	var once sync.Once
+	provider := func(uint64) (wal.WriterCloser, error) {
+		return NewMockFile(
+			func(b []byte) (n int, err error) {
+				return len(b), nil
+			},
+			func() error { return nil },
+			func() error {
+				once.Do(func() { close(started) })
+				<-release
+
+				return nil
+			},
+		), nil
+	}
+
+	pb, err := storage.NewPageBuffer(ctx, time.Hour, provider)
+	if err != nil {
+		t.Fatal("failed to create PageBuffer:", err)
+	}
+
+	lsn, err := pb.Write([]byte("Hello, World!"))
+	if err != nil {
+		t.Fatal("failed to write to PageBuffer:", err)
+	}
+
+	flushed := make(chan error)
+	go func() {
+		flushed <- pb.Flush(lsn)
+	}()
+
+	<-started
+
+	// records are appended while the sync is in progress
+	written := make(chan error)
+	go func() {
+		_, err := pb.Write([]byte("Hello, World!"))
+		written <- err
+	}()
+
+	select {
+	case err = <-written:
+		if err != nil {
+			t.Fatal("failed to write to PageBuffer:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write should not wait for the sync")
+	}
+
+	close(release)
+
+	if err = <-flushed; err != nil {
+		t.Fatal("failed to flush PageBuffer:", err)
+	}
+}
+
+func TestPageBufferError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errDiskFull := errors.New("disk full")
+
+	provider := func(uint64) (wal.WriterCloser, error) {
+		return NewMockFile(
+			func(b []byte) (n int, err error) {
+				return 0, errDiskFull
+			},
+			func() error { return nil },
+			func() error { return nil },
+		), nil
+	}
+
+	handled := make(chan error, 2)
+	pb, err := storage.NewPageBuffer(ctx, time.Hour, provider, storage.WithErrorHandler(func(err error) {
+		handled <- err
+	}))
+	if err != nil {
+		t.Fatal("failed to create PageBuffer:", err)
+	}
+
+	if err = pb.Err(); err != nil {
+		t.Fatalf("new page buffer should be healthy, got %v", err)
+	}
+
+	lsn, err := pb.Write([]byte("Hello, World!"))
+	if err != nil {
+		t.Fatal("failed to write to PageBuffer:", err)
+	}
+
+	err = pb.WaitDurable(lsn)
+	if !errors.Is(err, errDiskFull) {
+		t.Fatalf("expected the write failure, got %v", err)
+	}
+
+	_, err = pb.Write([]byte("Hello, World!"))
+	if !errors.Is(err, errDiskFull) {
+		t.Fatalf("write after a failure should fail, got %v", err)
+	}
+
+	if err = pb.Flush(lsn); !errors.Is(err, errDiskFull) {
+		t.Fatalf("flush after a failure should fail, got %v", err)
+	}
+
+	if err = pb.Err(); !errors.Is(err, errDiskFull) {
+		t.Fatalf("expected the write failure, got %v", err)
+	}
+
+	if err = <-handled; !errors.Is(err, errDiskFull) {
+		t.Fatalf("handler should get the write failure, got %v", err)
+	}
+
+	select {
+	case err = <-handled:
+		t.Fatalf("handler should be called once, got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
@@ -1,5 +1,7 @@
 package tx
 
+import "slices"
+
 type DeadlockDetector struct {
 	adj map[TxID][]TxID // adj graph
 	inc map[TxID][]TxID // incoming edges
@@ -12,21 +14,23 @@ func NewDeadlockDetector() *DeadlockDetector {
 	}
 }
 
-func (d *DeadlockDetector) Add(id TxID, waitFor TxID) bool {
+// Wait records that id waits for waitFor and returns the cycle the new edge
+// closes, starting at id, or nil. The edge is kept either way.
+func (d *DeadlockDetector) Wait(id TxID, waitFor TxID) []TxID {
 	if id == waitFor {
-		return true
+		return nil
+	}
+
+	for _, w := range d.adj[id] {
+		if w == waitFor {
+			return nil
+		}
 	}
 
 	d.adj[id] = append(d.adj[id], waitFor)
 	d.inc[waitFor] = append(d.inc[waitFor], id)
 
-	if d.hasPath(waitFor, id, make(map[TxID]bool)) {
-		d.Remove(id)
-
-		return false
-	}
-
-	return true
+	return d.path(waitFor, id, []TxID{id}, make(map[TxID]bool))
 }
 
 func (d *DeadlockDetector) Remove(id TxID) {
@@ -67,22 +71,101 @@ func (d *DeadlockDetector) Remove(id TxID) {
 	delete(d.inc, id)
 }
 
-func (d *DeadlockDetector) hasPath(from, to TxID, used map[TxID]bool) bool {
+// path returns walked extended with a path from -> to or nil if there is none.
+func (d *DeadlockDetector) path(from, to TxID, walked []TxID, used map[TxID]bool) []TxID {
 	if from == to {
-		return true
+		return walked
 	}
 
 	if used[from] {
-		return false
+		return nil
 	}
 
 	used[from] = true
 
 	for i := 0; i < len(d.adj[from]); i++ {
-		if d.hasPath(d.adj[from][i], to, used) {
-			return true
+		if p := d.path(d.adj[from][i], to, append(walked, from), used); p != nil {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// detect looks for cycles of transactions waiting for each other and aborts a
+// victim of every cycle. It runs when a lock wait lasts longer than the
+// deadlock timeout, waits are recorded when they begin, so a wait that is
+// about to end may still be taken for a deadlock.
+func (m *Manager) detect() {
+	if !m.detecting.TryLock() {
+		return // the running detection sees the same waits
+	}
+	defer m.detecting.Unlock()
+
+	var victims []*Tx
+	aborted := make(map[TxID]bool)
+
+	active := make(map[TxID]*Tx)
+	m.active.Range(func(id, t any) bool {
+		active[id.(TxID)] = t.(*Tx)
+		return true
+	})
+
+	d := NewDeadlockDetector()
+	for _, t := range active {
+		if aborted[t.id] {
+			continue
 		}
+
+		t.mu.Lock()
+		waitFor := append([]TxID{}, t.waitFor...)
+		t.mu.Unlock()
+
+		for _, o := range waitFor {
+			if _, ok := active[o]; !ok || aborted[o] {
+				continue
+			}
+
+			cycle := d.Wait(t.id, o)
+			if cycle == nil {
+				continue
+			}
+
+			victim := m.pickVictim(active, cycle)
+			victims = append(victims, victim)
+			aborted[victim.id] = true
+			d.Remove(victim.id)
+
+			if victim == t {
+				break
+			}
+		}
+	}
+
+	for _, victim := range victims {
+		m.finish(victim, false, true)
+	}
+}
+
+// pickVictim applies the victim policy to the transactions of cycle, holding
+// them still while it runs.
+func (m *Manager) pickVictim(active map[TxID]*Tx, cycle []TxID) *Tx {
+	ids := slices.Sorted(slices.Values(cycle))
+
+	txs := make([]*Tx, 0, len(cycle))
+	for _, id := range cycle {
+		txs = append(txs, active[id])
+	}
+
+	for _, id := range ids {
+		active[id].mu.Lock()
+	}
+
+	victim := m.victim(txs)
+
+	for _, id := range ids {
+		active[id].mu.Unlock()
 	}
 
-	return false
+	return victim
 }
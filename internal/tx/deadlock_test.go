@@ -1,162 +1,123 @@
 package tx
 
 import (
+	"slices"
 	"testing"
 )
 
 func TestDeadlockDetector(t *testing.T) {
 	d := NewDeadlockDetector()
-	ok := d.Add(1, 2)
-	if !ok {
-		t.Fatal("ok should be true")
-	}
 
-	ok = d.Add(2, 1)
-	if ok {
-		t.Fatal("ok should be false")
+	if cycle := d.Wait(1, 2); cycle != nil {
+		t.Fatalf("unexpected cycle %v", cycle)
 	}
 
-	ok = d.Add(2, 1)
-	if !ok {
-		t.Fatal("ok should be true")
+	cycle := d.Wait(2, 1)
+	if !slices.Equal(cycle, []TxID{2, 1}) {
+		t.Fatalf("expected cycle [2 1], got %v", cycle)
 	}
 
 	d.Remove(1)
 
-	ok = d.Add(2, 1)
-	if !ok {
-		t.Fatal("ok should be true")
-	}
-
-	ok = d.Add(2, 1)
-	if !ok {
-		t.Fatal("ok should be true")
+	if cycle := d.Wait(2, 1); cycle != nil {
+		t.Fatalf("unexpected cycle %v", cycle)
 	}
 }
 
 func TestDeadlockDetectorLongCycle(t *testing.T) {
 	d := NewDeadlockDetector()
 
-	// 1->2
-	ok := d.Add(1, 2)
-	if !ok {
-		t.Fatal("ok should be true")
+	// 1->2->...->9
+	for id := TxID(1); id < 9; id++ {
+		if cycle := d.Wait(id, id+1); cycle != nil {
+			t.Fatalf("unexpected cycle %v", cycle)
+		}
 	}
 
-	// 2->3
-	ok = d.Add(2, 3)
-	if !ok {
-		t.Fatal("ok should be true")
-	}
-
-	// 3->4
-	ok = d.Add(3, 4)
-	if !ok {
-		t.Fatal("ok should be true")
+	// 9->1: cycle
+	cycle := d.Wait(9, 1)
+	if !slices.Equal(cycle, []TxID{9, 1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Fatalf("expected cycle of 9 transactions, got %v", cycle)
 	}
 
-	// 4->5
-	ok = d.Add(4, 5)
-	if !ok {
-		t.Fatal("ok should be true")
-	}
+	d.Remove(9)
 
-	// 5->6
-	ok = d.Add(5, 6)
-	if !ok {
-		t.Fatal("ok should be true")
+	// 9->1: no cycle, since Tx 9 was removed in the previous step
+	if cycle := d.Wait(9, 1); cycle != nil {
+		t.Fatalf("unexpected cycle %v", cycle)
 	}
 
-	// 6->7
-	ok = d.Add(6, 7)
-	if !ok {
-		t.Fatal("ok should be true")
+	// double, no cycle
+	if cycle := d.Wait(9, 1); cycle != nil {
+		t.Fatalf("unexpected cycle %v", cycle)
 	}
 
-	// 7->8
-	ok = d.Add(7, 8)
-	if !ok {
-		t.Fatal("ok should be true")
+	// 1->9: cycle
+	if cycle := d.Wait(1, 9); !slices.Equal(cycle, []TxID{1, 9}) {
+		t.Fatalf("expected cycle [1 9], got %v", cycle)
 	}
+}
 
-	// 8->9
-	ok = d.Add(8, 9)
-	if !ok {
-		t.Fatal("ok should be true")
-	}
+func TestDeadlockDetectorComplexCycle(t *testing.T) {
+	d := NewDeadlockDetector()
 
-	// 9->1: cycle
-	ok = d.Add(9, 1)
-	if ok {
-		t.Fatal("ok should be false")
+	for _, e := range [][2]TxID{{1, 2}, {1, 3}, {1, 4}, {2, 3}, {2, 4}, {3, 4}, {4, 5}, {5, 6}} {
+		if cycle := d.Wait(e[0], e[1]); cycle != nil {
+			t.Fatalf("unexpected cycle %v", cycle)
+		}
 	}
 
-	// 9->1: no cycle, since Tx 9 was removed in the previous step
-	ok = d.Add(9, 1)
-	if !ok {
-		t.Fatal("ok should be true")
+	if cycle := d.Wait(6, 1); cycle == nil {
+		t.Fatal("6->1 should close a cycle")
 	}
 
-	// double, no cycle
-	ok = d.Add(9, 1)
-	if !ok {
-		t.Fatal("ok should be true")
-	}
+	d.Remove(6)
+	d.Remove(2)
 
-	// 1->9: cycle
-	ok = d.Add(1, 9)
-	if ok {
-		t.Fatal("ok should be false")
+	if cycle := d.Wait(2, 1); cycle != nil {
+		t.Fatalf("unexpected cycle %v", cycle)
 	}
 }
 
-func TestDeadlockDetectorComplexCycle(t *testing.T) {
+func TestDeadlockDetectorWait(t *testing.T) {
 	d := NewDeadlockDetector()
 
-	ok := d.Add(1, 2)
-	if !ok {
-		t.Fatal("ok should be true")
+	if cycle := d.Wait(1, 2); cycle != nil {
+		t.Fatalf("unexpected cycle %v", cycle)
 	}
 
-	ok = d.Add(1, 3)
-	if !ok {
-		t.Fatal("ok should be true")
+	if cycle := d.Wait(2, 3); cycle != nil {
+		t.Fatalf("unexpected cycle %v", cycle)
 	}
 
-	ok = d.Add(1, 4)
-	if !ok {
-		t.Fatal("ok should be true")
+	// waiting twice for the same transaction adds no edge
+	if cycle := d.Wait(2, 3); cycle != nil {
+		t.Fatalf("unexpected cycle %v", cycle)
 	}
-
-	ok = d.Add(2, 3)
-	if !ok {
-		t.Fatal("ok should be true")
+	if len(d.adj[2]) != 1 || len(d.inc[3]) != 1 {
+		t.Fatalf("duplicate edge %v %v", d.adj[2], d.inc[3])
 	}
 
-	ok = d.Add(2, 4)
-	if !ok {
-		t.Fatal("ok should be true")
+	cycle := d.Wait(3, 1)
+	if !slices.Equal(cycle, []TxID{3, 1, 2}) {
+		t.Fatalf("expected cycle [3 1 2], got %v", cycle)
 	}
 
-	ok = d.Add(3, 4)
-	if !ok {
-		t.Fatal("ok should be true")
-	}
+	// 3 is the victim, the cycle is broken but 1 still waits for 2
+	d.Remove(3)
 
-	ok = d.Add(4, 5)
-	if !ok {
-		t.Fatal("ok should be true")
+	if len(d.adj[3]) != 0 || len(d.adj[2]) != 0 || len(d.inc[3]) != 0 {
+		t.Fatalf("edges of 3 should be removed %v %v", d.adj[2], d.inc[3])
 	}
-
-	ok = d.Add(5, 6)
-	if !ok {
-		t.Fatal("ok should be true")
+	if !slices.Equal(d.adj[1], []TxID{2}) || !slices.Equal(d.inc[2], []TxID{1}) {
+		t.Fatalf("edge 1->2 should be kept %v %v", d.adj[1], d.inc[2])
 	}
 
-	d.Remove(2)
+	// waiting again closes a cycle
+	d.Wait(2, 3)
 
-	ok = d.Add(2, 1)
-	if !ok {
-		t.Fatal("ok should be true")
+	cycle = d.Wait(3, 1)
+	if !slices.Equal(cycle, []TxID{3, 1, 2}) {
+		t.Fatalf("expected cycle [3 1 2], got %v", cycle)
 	}
 }
@@ -3,5 +3,24 @@ package tx
 import "fmt"
 
 var (
-	errDeadlock = fmt.Errorf("deadlock detected")
+	ErrDeadlock  = fmt.Errorf("deadlock detected")
+	errNotActive = fmt.Errorf("transaction is not active")
+
+	ErrLockTimeout = fmt.Errorf("lock wait timed out")
 )
+
+// LockTimeoutError is returned when the context of a lock wait is done before
+// the lock is released.
+type LockTimeoutError struct {
+	Tx    TxID
+	Entry EntryID
+	Err   error // the error of the context
+}
+
+func (e *LockTimeoutError) Error() string {
+	return fmt.Sprintf("%s: tx %d waiting for %x: %s", ErrLockTimeout, e.Tx, e.Entry, e.Err)
+}
+
+func (e *LockTimeoutError) Unwrap() []error {
+	return []error{ErrLockTimeout, e.Err}
+}
@@ -0,0 +1,182 @@
+package tx
+
+import "context"
+
+const defaultEscalation = 1 << 12
+
+// Root is the id of the database, the ancestor of every resource locked with
+// a Path as well as of the keys and ranges locked with LockKey and LockRange.
+var Root = EntryID{}
+
+// Path names a resource by the ids of its ancestors, from Root down, followed
+// by its own id, e.g. Path{Root, tree, page, KeyID(key)}.
+type Path []EntryID
+
+// children are the locks a transaction took with LockPath under a parent.
+type children struct {
+	ids  map[EntryID]struct{}
+	mode LockMode // the modes the children were locked in joined
+
+	retry int // number of children escalation is tried again at after a conflict
+}
+
+// LockPath takes the lock of the last resource of path in the given mode
+// after locking its ancestors in the matching intention mode, IS for reads
+// and IX for writes, so locks on a resource and on a whole subtree exclude
+// each other. A resource under an ancestor already locked in a covering mode
+// is not locked again.
+//
+// Once a transaction holds more than the escalation limit of locks under one
+// parent, the parent is locked in S or X in their place if no other
+// transaction is in the way. Otherwise escalation is tried again only once
+// the number of children doubles.
+func (t *Tx) LockPath(ctx context.Context, path Path, mode LockMode) error {
+	for i, id := range path {
+		if t.m.covered(t, id, mode) {
+			return nil
+		}
+
+		m := mode
+		if i < len(path)-1 {
+			m = mode.intention()
+		}
+
+		err := t.Lock(ctx, id, m)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, parent := range t.m.track(t, path, mode) {
+		t.m.escalate(t, parent)
+	}
+
+	return nil
+}
+
+// covered reports whether tx holds the lock of id in a mode covering mode.
+func (m *Manager) covered(tx *Tx, id EntryID, mode LockMode) bool {
+	return m.held(tx, id).Covers(mode)
+}
+
+// track records the locks of path taken by tx under each of their parents and
+// returns the parents due for escalation, deepest first.
+func (m *Manager) track(tx *Tx, path Path, mode LockMode) []EntryID {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.ended {
+		return nil
+	}
+
+	if tx.children == nil {
+		tx.children = make(map[EntryID]*children)
+	}
+
+	var due []EntryID
+	for i := len(path) - 1; i > 0; i-- {
+		held := mode
+		if i < len(path)-1 {
+			held = mode.intention()
+		}
+
+		c, ok := tx.children[path[i-1]]
+		if !ok {
+			c = &children{ids: make(map[EntryID]struct{}), mode: held}
+			tx.children[path[i-1]] = c
+		}
+
+		c.ids[path[i]] = struct{}{}
+		c.mode = c.mode.join(held)
+
+		if m.escalation > 0 && len(c.ids) > m.escalation && len(c.ids) >= c.retry {
+			due = append(due, path[i-1])
+		}
+	}
+
+	return due
+}
+
+// escalate locks parent in place of the locks tx holds under it. It never
+// waits: while other transactions hold parent in an incompatible mode tx keeps
+// the child locks and escalation is put off until their number doubles.
+//
+// A parent LockKey locked keys under stands for a range of keys, the range is
+// locked like LockRange does in place of the keys of tx in it.
+func (m *Manager) escalate(tx *Tx, parent EntryID) {
+	m.predicates.Lock()
+	defer m.predicates.Unlock()
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	c, ok := tx.children[parent]
+	if tx.ended || !ok {
+		return // released by the escalation of an ancestor
+	}
+
+	mode := c.mode.escalated()
+
+	r, ranged := tx.bounds[parent]
+	if ranged {
+		if waitFor, _ := m.blockers(tx, r, mode, true); len(waitFor) > 0 {
+			c.retry = 2 * len(c.ids)
+			return
+		}
+	}
+
+	_, conflicts := m.acquire(tx, parent, mode)
+	if len(conflicts) > 0 {
+		c.retry = 2 * len(c.ids)
+		return
+	}
+
+	released := make(map[EntryID]struct{})
+	m.releaseChildren(tx, parent, released)
+
+	cur := 0
+	for _, id := range tx.locks {
+		if _, ok := released[id]; !ok {
+			tx.locks[cur] = id
+			cur++
+		}
+	}
+	tx.locks = tx.locks[:cur]
+
+	if !ranged {
+		return
+	}
+
+	for id := range released {
+		delete(tx.bounds, id)
+	}
+
+	for k := range tx.keys {
+		if r.Contains([]byte(k)) {
+			delete(tx.keys, k)
+		}
+	}
+
+	tx.ranges = append(tx.ranges, predicate{r: r, mode: mode})
+	m.ranged[tx.id] = tx
+}
+
+func (m *Manager) releaseChildren(tx *Tx, parent EntryID, released map[EntryID]struct{}) {
+	c, ok := tx.children[parent]
+	if !ok {
+		return
+	}
+
+	for child := range c.ids {
+		if _, ok := released[child]; ok {
+			continue
+		}
+
+		m.releaseChildren(tx, child, released)
+
+		m.release(tx, child)
+		released[child] = struct{}{}
+	}
+
+	delete(tx.children, parent)
+}
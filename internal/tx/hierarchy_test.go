@@ -0,0 +1,256 @@
+package tx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTxManagerLockPath(t *testing.T) {
+	m := NewManager()
+	ctx := context.Background()
+
+	tree := KeyID([]byte("tree"))
+	key := KeyID([]byte("key"))
+	key2 := KeyID([]byte("key_2"))
+
+	reader := m.Begin()
+	err := reader.LockPath(ctx, Path{Root, tree}, LockRead)
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	if mode := m.held(reader, Root); mode != LockIntentRead {
+		t.Fatalf("root should be locked in IS, got %d", mode)
+	}
+
+	// covered by the lock of the tree
+	err = reader.LockPath(ctx, Path{Root, tree, key}, LockRead)
+	if err != nil || len(reader.locks) != 2 {
+		t.Fatalf("key under a read tree should not be locked, got %v, %d locks", err, len(reader.locks))
+	}
+
+	reader2 := m.Begin()
+	err = reader2.LockPath(ctx, Path{Root, tree, key}, LockRead)
+	if err != nil {
+		t.Fatalf("readers should share the tree, got %v", err)
+	}
+	reader2.Commit()
+
+	writer := m.Begin()
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	err = writer.LockPath(timeout, Path{Root, tree, key}, LockWrite)
+	if !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("write under a read tree should wait, got %v", err)
+	}
+
+	// the reader writes a key of its tree
+	err = reader.LockPath(ctx, Path{Root, tree, key2}, LockWrite)
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	if mode := m.held(reader, tree); mode != LockReadIntentWrite {
+		t.Fatalf("tree should be locked in SIX, got %d", mode)
+	}
+
+	reader.Commit()
+
+	err = writer.LockPath(ctx, Path{Root, tree, key}, LockWrite)
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+	writer.Commit()
+
+	if lockCount(m) != 0 {
+		t.Fatalf("every lock should be released, got %d", lockCount(m))
+	}
+}
+
+func TestTxManagerEscalation(t *testing.T) {
+	m := NewManager(WithEscalation(2))
+	ctx := context.Background()
+
+	tree := KeyID([]byte("tree"))
+	tree2 := KeyID([]byte("tree_2"))
+	keys := []EntryID{KeyID([]byte("a")), KeyID([]byte("b")), KeyID([]byte("c"))}
+
+	writer := m.Begin()
+	err := writer.LockPath(ctx, Path{Root, tree2, KeyID([]byte("w"))}, LockWrite)
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	reader := m.Begin()
+	for _, key := range keys {
+		err = reader.LockPath(ctx, Path{Root, tree, key}, LockRead)
+		if err != nil {
+			t.Fatalf("unexpected err %v", err)
+		}
+	}
+
+	if mode := m.held(reader, tree); mode != LockRead {
+		t.Fatalf("tree should be locked in S, got %d", mode)
+	}
+
+	// root and tree
+	if len(reader.locks) != 2 {
+		t.Fatalf("key locks should be released, got %d locks of tx", len(reader.locks))
+	}
+
+	for _, key := range keys {
+		if mode := m.held(reader, key); mode != 0 {
+			t.Fatalf("key lock should be released, got %d", mode)
+		}
+	}
+
+	// tree2 is not locked in S while the writer holds IX on it
+	others := []EntryID{KeyID([]byte("d")), KeyID([]byte("e")), KeyID([]byte("f"))}
+	for _, key := range others {
+		err = reader.LockPath(ctx, Path{Root, tree2, key}, LockRead)
+		if err != nil {
+			t.Fatalf("unexpected err %v", err)
+		}
+	}
+
+	if mode := m.held(reader, tree2); mode != LockIntentRead {
+		t.Fatalf("tree2 should stay in IS, got %d", mode)
+	}
+
+	if len(reader.children[tree2].ids) != 3 {
+		t.Fatalf("reader should keep the keys, got %d", len(reader.children[tree2].ids))
+	}
+
+	writer.Commit()
+	reader.Commit()
+
+	if lockCount(m) != 0 {
+		t.Fatalf("every lock should be released, got %d", lockCount(m))
+	}
+}
+
+func TestTxManagerKeyEscalation(t *testing.T) {
+	m := NewManager(WithEscalation(64))
+	ctx := context.Background()
+
+	// another writer holds IX on root
+	writer := m.Begin()
+	err := writer.LockKey(ctx, []byte("other"), LockWrite)
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	bulk := m.Begin()
+	for i := range 1000 {
+		err = bulk.LockKey(ctx, fmt.Appendf(nil, "key_%d", i), LockWrite)
+		if err != nil {
+			t.Fatalf("unexpected err %v", err)
+		}
+	}
+
+	if mode := m.held(bulk, Root); mode != LockIntentWrite {
+		t.Fatalf("root should stay in IX, got %d", mode)
+	}
+
+	// root and the range of "key_"
+	if len(bulk.locks) != 2 || len(bulk.keys) != 0 || len(bulk.ranges) != 1 {
+		t.Fatalf("keys should be escalated to their range, got %d locks, %d keys, %d ranges", len(bulk.locks), len(bulk.keys), len(bulk.ranges))
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	err = writer.LockKey(timeout, []byte("key_new"), LockWrite)
+	if !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("key in the escalated range should wait, got %v", err)
+	}
+
+	err = writer.LockKey(ctx, []byte("other_2"), LockWrite)
+	if err != nil {
+		t.Fatalf("key out of the escalated range should be locked, got %v", err)
+	}
+
+	bulk.Commit()
+
+	// the range is in use, escalation is put off until the keys double
+	bulk = m.Begin()
+	for i := range 1000 {
+		err = bulk.LockKey(ctx, fmt.Appendf(nil, "othe_%d", i), LockWrite)
+		if err != nil {
+			t.Fatalf("unexpected err %v", err)
+		}
+	}
+
+	if len(bulk.keys) != 1000 {
+		t.Fatalf("keys should be kept, got %d", len(bulk.keys))
+	}
+
+	for id, c := range bulk.children {
+		if id != Root && c.retry <= 1000 {
+			t.Fatalf("escalation should be put off, retried at %d", c.retry)
+		}
+	}
+
+	writer.Commit()
+	bulk.Commit()
+
+	if lockCount(m) != 0 {
+		t.Fatalf("every lock should be released, got %d", lockCount(m))
+	}
+}
+
+func TestTxManagerRootStripes(t *testing.T) {
+	m := NewManager()
+	ctx := context.Background()
+
+	writers := make([]*Tx, 4)
+	for i := range writers {
+		writers[i] = m.Begin()
+
+		err := writers[i].LockKey(ctx, fmt.Appendf(nil, "key_%d", i), LockWrite)
+		if err != nil {
+			t.Fatalf("writers of distinct keys should share root, got %v", err)
+		}
+	}
+
+	trx := m.Begin()
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	err := trx.LockPath(timeout, Path{Root}, LockRead)
+	if !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("S on root should wait for the writers, got %v", err)
+	}
+
+	for _, w := range writers {
+		w.Commit()
+	}
+
+	err = trx.LockPath(ctx, Path{Root}, LockWrite)
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	writer := m.Begin()
+
+	timeout, cancel = context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	err = writer.LockKey(timeout, []byte("key_0"), LockWrite)
+	if !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("writer should wait for X on root, got %v", err)
+	}
+
+	trx.Commit()
+	writer.Commit()
+
+	if lockCount(m) != 0 {
+		t.Fatalf("every lock should be released, got %d", lockCount(m))
+	}
+}
@@ -1,26 +1,62 @@
 package tx
 
 import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	lockShards = 64
+
+	defaultDeadlockTimeout = 10 * time.Millisecond
+)
+
+// Manager locks entries and keeps the versions transactions read at their
+// snapshots. The lock table is split into shards by EntryID, so transactions
+// locking distinct entries do not wait for each other's bookkeeping. The
+// locks of Root and of the ranges LockKey groups keys by are taken by most
+// transactions, they are split further into a stripe per shard, see
+// acquireStriped. Deadlocks are looked for only once a lock wait lasts longer
+// than the deadlock timeout.
 type Manager struct {
 	seq    *Sequence
-	dld    *DeadlockDetector
-	active map[TxID]struct{}
-	locks  map[EntryID]lock
+	victim VictimPolicy
+	active sync.Map // TxID to *Tx of the transactions in progress
+	shards [lockShards]shard
+
+	escalation      int           // child locks a transaction holds under a parent before locking the parent instead
+	rangePrefix     int           // length of the key prefix LockKey groups keys into ranges by
+	deadlockTimeout time.Duration // lock wait after which deadlocks are looked for
+
+	detecting sync.Mutex // held by the deadlock detection running
+
+	// held shared to lock keys and exclusively to lock ranges, so keys are
+	// locked without waiting for each other
+	predicates sync.RWMutex
+	ranged     map[TxID]*Tx // transactions holding ranges, guarded by predicates
+
+	clock     uint64                   // timestamp of the last commit
+	snapshots map[uint64]*atomic.Int64 // transactions in progress reading at each timestamp
+	oldest    atomic.Uint64            // no transaction in progress reads before it
+	versions  *versions
+
+	mu sync.Mutex // guards the clock, the snapshots and the versions
+}
+
+type shard struct {
+	locks map[EntryID]lock
 
 	mu sync.Mutex
 }
 
 type lock struct {
-	rcnt  int
-	wlock bool
-
-	owners map[TxID]struct{}
+	owners map[TxID]LockMode
 
-	done chan struct{}
+	changed chan struct{} // closed and replaced whenever an owner releases the lock
 }
 
 type TxID uint64
@@ -29,220 +65,604 @@ type TxEntry []byte
 
 type EntryID [12]byte
 
+// KeyID returns the id keys are locked by, distinct keys may share it.
+func KeyID(key []byte) (id EntryID) {
+	h := fnv.New128a()
+	h.Write(key)
+
+	copy(id[:], h.Sum(nil))
+	id[len(id)-1] &^= stripedBit
+
+	return id
+}
+
 type Tx struct {
 	m *Manager
 
 	id      TxID
 	entries []TxEntry
 	locks   []EntryID
+	ranges  []predicate         // guarded by m.predicates
+	keys    map[string]LockMode // keys locked with LockKey, changed under m.predicates shared
+
+	children map[EntryID]*children // locks taken by LockPath under each parent
+	bounds   map[EntryID]KeyRange  // keys of the parents LockKey locked keys under
+
+	snapshot uint64
+	readers  *atomic.Int64 // transactions in progress reading at the snapshot
+	saved    []*version
+
+	work       int           // granted lock requests
+	waitFor    []TxID        // owners of the lock the transaction waits for
+	ended      bool          // committed or aborted, the locks are being released
+	committing bool          // past Prepare, it is not chosen as a deadlock victim
+	deadlocked chan struct{} // closed when the transaction is aborted as a deadlock victim
+	done       chan struct{} // closed once the transaction has released its locks
+
+	mu sync.Mutex // guards the locks and the wait of the transaction
+}
+
+// ID returns the id the transaction is logged with.
+func (t *Tx) ID() TxID {
+	return t.id
 }
 
 func (t *Tx) Commit() bool {
 	return t.m.commit(t)
 }
 
-func (t *Tx) Upgrade(id EntryID) (bool, error) {
-	tick := time.NewTicker(123 * time.Millisecond)
-
-	cnt := 0
-	ok, err := t.m.upgrade(t, id)
-	if err != nil {
-		return false, err
-	}
-	for !ok && cnt < 11 {
-		<-tick.C
-		ok, err = t.m.upgrade(t, id)
-		if err != nil {
-			return false, err
+// Prepare readies the transaction to commit, it takes no locks afterwards.
+// It fails with ErrDeadlock if the transaction was aborted as a deadlock
+// victim, the deadlock detector may pick a transaction that no longer waits.
+// From then on the transaction is never chosen as a victim.
+func (t *Tx) Prepare() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.ended {
+		select {
+		case <-t.deadlocked:
+			return ErrDeadlock
+		default:
+			return errNotActive
 		}
-
-		cnt++
 	}
 
-	return ok, nil
+	t.committing = true
+
+	return nil
 }
 
-func (t *Tx) Read(id EntryID) (bool, error) {
-	ch, ok, err := t.m.read(t, id)
-	if err != nil {
-		return false, err
-	}
+// Lock takes the lock of id in the given mode. It waits while other
+// transactions hold the lock in an incompatible mode, or returns an error once
+// ctx is done. A lock already held in a covering mode is not taken again and
+// a weaker one is upgraded in place.
+func (t *Tx) Lock(ctx context.Context, id EntryID, mode LockMode) error {
+	for {
+		ch, ok, err := t.m.lock(t, id, mode)
+		if err != nil || ok {
+			return err
+		}
 
-	if !ok {
-		<-ch
-		return false, nil
+		err = t.wait(ctx, id, ch)
+		if err != nil {
+			return err
+		}
 	}
+}
+
+// Read takes a read lock, see Lock.
+func (t *Tx) Read(ctx context.Context, id EntryID) error {
+	return t.Lock(ctx, id, LockRead)
+}
 
-	return true, nil
+// Write takes a write lock or upgrades a read lock, see Lock.
+func (t *Tx) Write(ctx context.Context, id EntryID) error {
+	return t.Lock(ctx, id, LockWrite)
 }
 
 func (t *Tx) Abort() {
 	t.m.abort(t)
 }
 
-func (t *Tx) Write(id EntryID) (bool, error) {
-	ch, ok, err := t.m.write(t, id)
-	if err != nil {
-		return false, err
+// Snapshot returns the commit timestamp the transaction reads at.
+func (t *Tx) Snapshot() uint64 {
+	return t.snapshot
+}
+
+// Save keeps the committed value of key the transaction is about to overwrite
+// for transactions started before it commits. The caller holds the write lock
+// on key and saves the value before changing it.
+func (t *Tx) Save(key string, value []byte, exists bool) {
+	t.m.save(t, key, value, exists)
+}
+
+// Version returns the value of key as of the snapshot of the transaction if
+// another transaction has overwritten it since, otherwise ok is false and the
+// latest committed value is visible. The latest value is read before calling
+// Version, so a writer that changes it in between is not missed.
+func (t *Tx) Version(key string) (value []byte, exists bool, ok bool) {
+	return t.m.version(t, key)
+}
+
+// Changed returns a key of r another transaction has written since the
+// snapshot of the transaction, as Version does for a single key. Checked once
+// r is locked, it tells whether the snapshot misses keys of the range.
+func (t *Tx) Changed(r KeyRange) (key string, ok bool) {
+	return t.m.changed(t, r)
+}
+
+// wait blocks until ch is closed, the transaction is chosen as a deadlock
+// victim or ctx is done. Deadlocks are looked for every deadlock timeout of
+// the wait.
+func (t *Tx) wait(ctx context.Context, id EntryID, ch chan struct{}) error {
+	timer := time.NewTimer(t.m.deadlockTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ch:
+			return nil
+		case <-t.deadlocked:
+			return ErrDeadlock
+		case <-ctx.Done():
+			t.m.stopWaiting(t)
+			return &LockTimeoutError{Tx: t.id, Entry: id, Err: ctx.Err()}
+		case <-timer.C:
+			t.m.detect()
+			timer.Reset(t.m.deadlockTimeout)
+		}
 	}
-	if !ok {
-		<-ch
-		return false, nil
+}
+
+type ManagerOption func(m *Manager)
+
+// WithVictimPolicy sets how the transaction aborted to break a deadlock is
+// chosen, Youngest by default.
+func WithVictimPolicy(p VictimPolicy) ManagerOption {
+	return func(m *Manager) {
+		m.victim = p
 	}
+}
 
-	return true, nil
+// WithEscalation sets how many child locks a transaction takes with LockPath
+// under one parent before the parent is locked in their place, n <= 0 turns
+// escalation off.
+func WithEscalation(n int) ManagerOption {
+	return func(m *Manager) {
+		m.escalation = n
+	}
 }
 
-func NewManager() *Manager {
-	return &Manager{
-		dld:    NewDeadlockDetector(),
-		seq:    NewSeq(),
-		active: make(map[TxID]struct{}),
-		locks:  make(map[EntryID]lock),
+// WithRangePrefix sets the length of the key prefix LockKey groups keys by,
+// so escalation locks the keys sharing it rather than the whole database.
+// n <= 0 locks keys right under Root.
+func WithRangePrefix(n int) ManagerOption {
+	return func(m *Manager) {
+		m.rangePrefix = n
 	}
 }
 
-func (m *Manager) abort(tx *Tx) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// WithDeadlockTimeout sets how long a lock wait lasts before deadlocks are
+// looked for, 10ms by default.
+func WithDeadlockTimeout(d time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.deadlockTimeout = d
+	}
+}
 
-	if _, ok := m.active[tx.id]; !ok {
-		return
+func NewManager(opts ...ManagerOption) *Manager {
+	m := &Manager{
+		seq:    NewSeq(),
+		victim: Youngest,
+
+		escalation:      defaultEscalation,
+		rangePrefix:     defaultRangePrefix,
+		deadlockTimeout: defaultDeadlockTimeout,
+
+		ranged: make(map[TxID]*Tx),
+
+		snapshots: make(map[uint64]*atomic.Int64),
+		versions:  newVersions(),
+	}
+
+	for i := range m.shards {
+		m.shards[i].locks = make(map[EntryID]lock)
 	}
 
-	for i := 0; i < len(tx.locks); i++ {
-		m.release(tx, tx.locks[i])
+	for _, opt := range opts {
+		opt(m)
 	}
 
-	delete(m.active, tx.id)
+	return m
 }
 
-func (m *Manager) begin() *Tx {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+func (m *Manager) abort(tx *Tx) {
+	m.finish(tx, false, false)
+}
 
+// Begin starts a transaction that reads the data committed before it.
+func (m *Manager) Begin() *Tx {
 	t := &Tx{
 		m:  m,
 		id: m.seq.Next(),
+
+		deadlocked: make(chan struct{}),
+		done:       make(chan struct{}),
 	}
-	m.active[t.id] = struct{}{}
+
+	m.mu.Lock()
+	t.snapshot = m.clock
+
+	t.readers = m.snapshots[t.snapshot]
+	if t.readers == nil {
+		t.readers = new(atomic.Int64)
+		m.snapshots[t.snapshot] = t.readers
+	}
+	t.readers.Add(1)
+	m.mu.Unlock()
+
+	m.active.Store(t.id, t)
 
 	return t
 }
 
 func (m *Manager) commit(tx *Tx) bool {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	return m.finish(tx, true, false)
+}
 
-	if _, ok := m.active[tx.id]; !ok {
+// finish ends tx once: the versions it saved are committed or dropped, then
+// its locks are released. A deadlock victim learns it was aborted from a
+// failed lock wait. Only writers and the last reader of the oldest snapshot
+// take m.mu.
+func (m *Manager) finish(tx *Tx, commit bool, deadlocked bool) bool {
+	tx.mu.Lock()
+	if tx.ended || deadlocked && tx.committing {
+		tx.mu.Unlock()
 		return false
 	}
 
-	for i := 0; i < len(tx.locks); i++ {
-		m.release(tx, tx.locks[i])
+	tx.ended = true
+	if deadlocked {
+		close(tx.deadlocked)
 	}
 
-	delete(m.active, tx.id)
+	locks, saved := tx.locks, tx.saved
+	tx.locks, tx.children, tx.bounds, tx.waitFor, tx.saved = nil, nil, nil, nil, nil
+	tx.mu.Unlock()
+
+	m.active.Delete(tx.id)
+	m.releasePredicates(tx)
+
+	left := tx.readers.Add(-1)
+
+	if len(saved) > 0 || left == 0 && tx.snapshot == m.oldest.Load() {
+		m.mu.Lock()
+		switch {
+		case !commit:
+			m.versions.drop(saved)
+		case len(saved) > 0:
+			m.clock++
+			m.versions.commit(saved, m.clock)
+		}
+
+		m.collect()
+		m.mu.Unlock()
+	}
+
+	for _, id := range locks {
+		m.release(tx, id)
+	}
+
+	close(tx.done)
 
 	return true
 }
 
-func (m *Manager) read(tx *Tx, id EntryID) (chan struct{}, bool, error) {
+// collect drops versions no snapshot can read anymore. The caller holds m.mu.
+func (m *Manager) collect() {
+	oldest := m.oldest.Load()
+	for ; oldest < m.clock; oldest++ {
+		if r, ok := m.snapshots[oldest]; ok && r.Load() > 0 {
+			break
+		}
+
+		delete(m.snapshots, oldest)
+	}
+
+	m.oldest.Store(oldest)
+	m.versions.collect(oldest)
+}
+
+func (m *Manager) save(tx *Tx, key string, value []byte, exists bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	l, ok := m.locks[id]
-	if !ok {
-		m.locks[id] = lock{rcnt: 1, done: make(chan struct{}), owners: map[TxID]struct{}{tx.id: {}}}
-		tx.locks = append(tx.locks, id)
-		return nil, true, nil
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.ended {
+		panic("trying to save a version in a finished transaction")
 	}
 
-	if l.wlock {
-		for o := range l.owners {
-			if !m.dld.Add(tx.id, o) {
-				return nil, false, errDeadlock
-			}
+	for _, v := range tx.saved {
+		if v.key == key {
+			return // the committed value is saved by the first write
 		}
+	}
 
-		return l.done, false, nil
+	v := &version{
+		key:    key,
+		value:  append([]byte{}, value...),
+		exists: exists,
+		owner:  tx.id,
 	}
 
-	l.rcnt++
-	l.owners[tx.id] = struct{}{}
-	m.locks[id] = l
-	tx.locks = append(tx.locks, id)
+	m.versions.save(v)
+	tx.saved = append(tx.saved, v)
+}
 
-	return nil, true, nil
+func (m *Manager) version(tx *Tx, key string) ([]byte, bool, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v := m.versions.find(key, tx.id, tx.snapshot)
+	if v == nil {
+		return nil, false, false
+	}
+
+	return append([]byte{}, v.value...), v.exists, true
 }
 
-func (m *Manager) upgrade(tx *Tx, id EntryID) (bool, error) {
+func (m *Manager) changed(tx *Tx, r KeyRange) (string, bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	l, ok := m.locks[id]
-	if !ok || l.wlock {
-		panic("trying to upgrade unlocked or already upgraded entry")
+	for key := range m.versions.chains {
+		if r.Contains([]byte(key)) && m.versions.find(key, tx.id, tx.snapshot) != nil {
+			return key, true
+		}
 	}
 
-	if l.rcnt == 1 {
-		l.rcnt = 0
-		l.wlock = true
+	return "", false
+}
+
+func (m *Manager) shard(id EntryID) *shard {
+	return &m.shards[binary.LittleEndian.Uint64(id[:8])%lockShards]
+}
 
-		m.locks[id] = l
+// lock grants the lock of id in mode to tx, otherwise it returns the channel
+// closed when the lock changes.
+func (m *Manager) lock(tx *Tx, id EntryID, mode LockMode) (chan struct{}, bool, error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
 
-		return true, nil
+	err := tx.check()
+	if err != nil {
+		return nil, false, err
 	}
 
-	for o := range l.owners {
-		if !m.dld.Add(tx.id, o) {
-			return false, errDeadlock
-		}
+	ch, conflicts := m.acquire(tx, id, mode)
+	if len(conflicts) > 0 {
+		return tx.await(conflicts, ch)
 	}
 
-	return false, nil
+	return nil, true, nil
 }
 
-func (m *Manager) write(tx *Tx, id EntryID) (chan struct{}, bool, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// acquire grants the lock of id to tx unless other transactions hold it in an
+// incompatible mode, then it returns them with the channel closed once the
+// lock changes. The caller holds tx.mu.
+func (m *Manager) acquire(tx *Tx, id EntryID, mode LockMode) (chan struct{}, []TxID) {
+	if striped(id) {
+		return m.acquireStriped(tx, id, mode)
+	}
 
-	l, ok := m.locks[id]
-	if !ok {
-		m.locks[id] = lock{wlock: true, done: make(chan struct{}), owners: map[TxID]struct{}{tx.id: {}}}
+	s := m.shard(id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch, conflicts, added := s.acquire(tx, id, mode)
+	if len(conflicts) > 0 {
+		return ch, conflicts
+	}
+
+	if added {
 		tx.locks = append(tx.locks, id)
-		return nil, true, nil
+	}
+	tx.work++
+
+	return nil, nil
+}
+
+// acquireStriped takes the lock of a striped id. Intention modes lock the
+// stripe of tx only, so transactions taking them do not share a shard, the
+// other modes lock every stripe at once and exclude intention locks of any
+// transaction. The caller holds tx.mu.
+func (m *Manager) acquireStriped(tx *Tx, id EntryID, mode LockMode) (chan struct{}, []TxID) {
+	held := m.held(tx, id)
+	if held != 0 {
+		mode = held.join(mode)
 	}
 
-	for o := range l.owners {
-		if !m.dld.Add(tx.id, o) {
-			return nil, false, errDeadlock
+	if LockIntentWrite.Covers(mode) {
+		own := stripe(id, tx.stripe())
+		s := m.shard(own)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		ch, conflicts, _ := s.acquire(tx, own, mode)
+		if len(conflicts) > 0 {
+			return ch, conflicts
+		}
+	} else {
+		for i := range m.shards {
+			m.shards[i].mu.Lock()
+			defer m.shards[i].mu.Unlock()
+		}
+
+		for i := range m.shards {
+			l := m.shards[i].locks[stripe(id, i)]
+			if conflicts := l.conflicts(tx.id, mode); len(conflicts) > 0 {
+				return l.changed, conflicts
+			}
 		}
+
+		for i := range m.shards {
+			m.shards[i].acquire(tx, stripe(id, i), mode)
+		}
+	}
+
+	if held == 0 {
+		tx.locks = append(tx.locks, id)
 	}
+	tx.work++
 
-	return l.done, false, nil
+	return nil, nil
+}
+
+// acquire grants the lock of id to tx and reports whether tx did not own it
+// before, see Manager.acquire. The caller holds s.mu.
+func (s *shard) acquire(tx *Tx, id EntryID, mode LockMode) (chan struct{}, []TxID, bool) {
+	l, ok := s.locks[id]
+	if !ok {
+		s.locks[id] = lock{owners: map[TxID]LockMode{tx.id: mode}, changed: make(chan struct{})}
+		return nil, nil, true
+	}
+
+	held, owner := l.owners[tx.id]
+	if owner && held.Covers(mode) {
+		return nil, nil, false
+	}
+
+	if owner {
+		mode = held.join(mode)
+	}
+
+	if conflicts := l.conflicts(tx.id, mode); len(conflicts) > 0 {
+		return l.changed, conflicts, false
+	}
+
+	l.owners[tx.id] = mode
+
+	return nil, nil, !owner
+}
+
+// conflicts returns the owners of l other than tx holding it in a mode
+// incompatible with mode.
+func (l lock) conflicts(tx TxID, mode LockMode) []TxID {
+	var res []TxID
+	for o, om := range l.owners {
+		if o != tx && !Compatible(om, mode) {
+			res = append(res, o)
+		}
+	}
+
+	return res
+}
+
+// held returns the mode tx holds the lock of id in, zero if it does not.
+func (m *Manager) held(tx *Tx, id EntryID) LockMode {
+	if striped(id) {
+		id = stripe(id, tx.stripe()) // every stripe but the own one is locked in the same mode
+	}
+
+	s := m.shard(id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.locks[id].owners[tx.id]
+}
+
+// stripedBit marks the ids of ranges in their last byte, KeyID clears it.
+const stripedBit = 0x80
+
+// striped reports whether the lock of id is split into a stripe per shard.
+func striped(id EntryID) bool {
+	return id == Root || id[len(id)-1]&stripedBit != 0
+}
+
+// stripe returns the id of the i-th stripe of id, it falls into the i-th shard.
+func stripe(id EntryID, i int) EntryID {
+	id[0] = id[0]&^(lockShards-1) | byte(i)
+
+	return id
+}
+
+// stripe returns the stripe of striped locks t takes intention locks on.
+func (t *Tx) stripe() int {
+	return int(uint64(t.id) % lockShards)
+}
+
+// check fails if t has ended, and forgets whom it waited for until it is
+// known to conflict again. The caller holds t.mu.
+func (t *Tx) check() error {
+	if t.ended {
+		select {
+		case <-t.deadlocked:
+			return ErrDeadlock
+		default:
+			return errNotActive
+		}
+	}
+
+	t.waitFor = t.waitFor[:0]
+
+	return nil
+}
+
+// await records that t waits for the owners of the conflicting locks and
+// returns ch to wait on. The caller holds t.mu.
+func (t *Tx) await(owners []TxID, ch chan struct{}) (chan struct{}, bool, error) {
+	t.waitFor = append(t.waitFor, owners...)
+
+	return ch, false, nil
+}
+
+func (m *Manager) stopWaiting(tx *Tx) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	tx.waitFor = tx.waitFor[:0]
 }
 
 func (m *Manager) release(tx *Tx, id EntryID) {
-	l := m.locks[id]
-	delete(l.owners, tx.id)
+	if !striped(id) {
+		m.shard(id).release(tx, id)
+		return
+	}
 
-	if l.wlock {
-		delete(m.locks, id)
-		close(l.done)
+	own := stripe(id, tx.stripe())
+	if LockIntentWrite.Covers(m.held(tx, id)) {
+		m.shard(own).release(tx, own)
 		return
 	}
 
-	if l.rcnt <= 0 {
+	for i := range m.shards {
+		m.shards[i].release(tx, stripe(id, i))
+	}
+}
+
+func (s *shard) release(tx *Tx, id EntryID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := s.locks[id]
+	if _, ok := l.owners[tx.id]; !ok {
 		panic("inconsistent lock state")
 	}
 
-	l.rcnt--
-	if l.rcnt == 0 {
-		delete(m.locks, id)
-		close(l.done)
+	delete(l.owners, tx.id)
+	close(l.changed)
+
+	if len(l.owners) == 0 {
+		delete(s.locks, id)
 		return
 	}
 
-	m.locks[id] = l
+	l.changed = make(chan struct{})
+	s.locks[id] = l
 }
@@ -1,102 +1,515 @@
 package tx
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestTxManager(t *testing.T) {
 	m := NewManager()
+	ctx := context.Background()
 
 	key := [12]byte{}
 	copy(key[:], []byte("test"))
 
-	trx := m.begin()
-	ok, err := trx.Read(key)
-	if !ok {
-		t.Fatal("ok should be true")
+	trx := m.Begin()
+	err := trx.Read(ctx, key)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err.Error())
 	}
+
+	trx2 := m.Begin()
+	err = trx2.Read(ctx, key)
 	if err != nil {
 		t.Fatalf("unexpected err %s", err.Error())
 	}
 
-	trx2 := m.begin()
-	ok, err = trx2.Read(key)
+	ok := trx2.Commit()
 	if !ok {
 		t.Fatal("ok should be true")
 	}
+
+	err = trx.Write(ctx, key)
 	if err != nil {
 		t.Fatalf("unexpected err %s", err.Error())
 	}
 
-	ok = trx2.Commit()
+	ok = trx.Commit()
 	if !ok {
 		t.Fatal("ok should be true")
 	}
+}
 
-	ok, err = trx.Upgrade(key)
-	if !ok {
-		t.Fatal("ok should be true")
+func TestTxManagerReentrant(t *testing.T) {
+	m := NewManager()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	key := [12]byte{}
+	copy(key[:], []byte("test"))
+
+	trx := m.Begin()
+
+	for _, mode := range []LockMode{LockRead, LockRead, LockWrite, LockWrite, LockRead} {
+		err := trx.Lock(ctx, key, mode)
+		if err != nil {
+			t.Fatalf("lock %d should be taken again, got %v", mode, err)
+		}
 	}
+
+	if len(trx.locks) != 1 {
+		t.Fatalf("lock should be held once, got %d", len(trx.locks))
+	}
+
+	if mode := m.held(trx, key); mode != LockWrite {
+		t.Fatalf("lock should be upgraded to %d, got %d", LockWrite, mode)
+	}
+
+	trx.Commit()
+
+	if lockCount(m) != 0 {
+		t.Fatalf("locks should be released, got %d", lockCount(m))
+	}
+}
+
+func TestTxManagerRetry(t *testing.T) {
+	m := NewManager()
+	ctx := context.Background()
+
+	key := [12]byte{}
+	copy(key[:], []byte("test"))
+
+	trx := m.Begin()
+	err := trx.Write(ctx, key)
 	if err != nil {
-		t.Fatalf("unexpected err %s", err.Error())
+		t.Fatal(err)
 	}
 
-	ok = trx.Commit()
-	if !ok {
-		t.Fatal("ok should be true")
+	readers := make(chan error)
+	for range 3 {
+		go func() {
+			reader := m.Begin()
+			defer reader.Commit()
+
+			readers <- reader.Read(ctx, key)
+		}()
+	}
+
+	trx.Commit()
+
+	// every reader is woken and takes the lock without retrying by hand
+	for range 3 {
+		select {
+		case err := <-readers:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("reader should take the lock after the writer commits")
+		}
+	}
+}
+
+func TestLockModeCompatible(t *testing.T) {
+	const (
+		is  = LockIntentRead
+		ix  = LockIntentWrite
+		s   = LockRead
+		six = LockReadIntentWrite
+		x   = LockWrite
+	)
+
+	// rows are held, columns requested
+	want := map[LockMode][]bool{
+		is:  {true, true, true, true, false},
+		ix:  {true, true, false, false, false},
+		s:   {true, false, true, false, false},
+		six: {true, false, false, false, false},
+		x:   {false, false, false, false, false},
+	}
+
+	modes := []LockMode{is, ix, s, six, x}
+	for held, row := range want {
+		for i, requested := range modes {
+			if Compatible(held, requested) != row[i] {
+				t.Fatalf("%d and %d should be compatible: %v", held, requested, row[i])
+			}
+
+			// compatibility is symmetric
+			if Compatible(requested, held) != row[i] {
+				t.Fatalf("%d and %d should be compatible: %v", requested, held, row[i])
+			}
+		}
+	}
+
+	if !LockWrite.Covers(LockRead) || LockRead.Covers(LockWrite) {
+		t.Fatal("write lock should cover read lock")
+	}
+
+	joins := []struct {
+		a, b, want LockMode
+	}{
+		{is, ix, ix},
+		{s, ix, six},
+		{is, s, s},
+		{six, s, six},
+		{s, x, x},
+		{ix, ix, ix},
+	}
+
+	for _, tt := range joins {
+		if got := tt.a.join(tt.b); got != tt.want {
+			t.Fatalf("join of %d and %d should be %d, got %d", tt.a, tt.b, tt.want, got)
+		}
 	}
 }
 
 func TestTxManagerDeadlock(t *testing.T) {
 	m := NewManager()
+	ctx := context.Background()
 
 	key := [12]byte{}
 	copy(key[:], []byte("test"))
 	key2 := [12]byte{}
-	copy(key[:], []byte("test_2"))
+	copy(key2[:], []byte("test_2"))
 
-	trx := m.begin()
-	trx2 := m.begin()
+	trx := m.Begin()
+	trx2 := m.Begin()
 
-	ok, err := trx.Read(key)
-	if !ok {
-		t.Fatal("ok should be true")
-	}
+	err := trx.Read(ctx, key)
 	if err != nil {
 		t.Fatalf("unexpected err %s", err.Error())
 	}
 
-	ok, err = trx2.Read(key2)
-	if !ok {
-		t.Fatal("ok should be true")
-	}
+	err = trx2.Read(ctx, key2)
 	if err != nil {
 		t.Fatalf("unexpected err %s", err.Error())
 	}
 
 	deadlockCh := make(chan error)
 	go func() {
-		_, err := trx2.Write(key)
+		// wait until trx waits for trx2
+		for !waiting(trx) {
+			time.Sleep(time.Millisecond)
+		}
+
+		err := trx2.Write(ctx, key)
 		trx2.Abort()
 
 		deadlockCh <- err
 	}()
 
-	ok, err = trx.Write(key2)
+	err = trx.Write(ctx, key2)
 	if err != nil {
 		t.Fatalf("unexpected err %s", err.Error())
 	}
-	if ok {
-		t.Fatal("ok should be false")
-	}
 
-	ok = trx.Commit()
+	ok := trx.Commit()
 	if !ok {
 		t.Fatal("ok should be true")
 	}
 
 	err = <-deadlockCh
-	if err != errDeadlock {
+	if err != ErrDeadlock {
 		t.Fatalf("unexpected err %s", err.Error())
 	}
 }
+
+func TestTxManagerTimeout(t *testing.T) {
+	m := NewManager()
+
+	key := [12]byte{}
+	copy(key[:], []byte("test"))
+
+	trx := m.Begin()
+	err := trx.Write(context.Background(), key)
+	if err != nil {
+		t.Fatalf("write lock should be taken, got %v", err)
+	}
+
+	trx2 := m.Begin()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err = trx2.Read(ctx, key)
+
+	var timeout *LockTimeoutError
+	if !errors.As(err, &timeout) || timeout.Tx != trx2.ID() || timeout.Entry != key {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	if !errors.Is(err, ErrLockTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err should be a timeout, got %v", err)
+	}
+
+	if waiting(trx2) {
+		t.Fatal("timed out tx should not wait for anyone")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+
+	err = trx2.Write(ctx, key)
+	if !errors.Is(err, ErrLockTimeout) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("err should be a cancellation, got %v", err)
+	}
+}
+
+func TestTxManagerUpgradeWakeup(t *testing.T) {
+	m := NewManager()
+	ctx := context.Background()
+
+	key := [12]byte{}
+	copy(key[:], []byte("test"))
+
+	trx := m.Begin()
+	trx2 := m.Begin()
+
+	for _, tr := range []*Tx{trx, trx2} {
+		err := tr.Read(ctx, key)
+		if err != nil {
+			t.Fatalf("read lock should be taken, got %v", err)
+		}
+	}
+
+	upgraded := make(chan error)
+	go func() {
+		upgraded <- trx.Write(ctx, key)
+	}()
+
+	select {
+	case err := <-upgraded:
+		t.Fatalf("upgrade should wait for the other reader, got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	trx2.Commit()
+
+	select {
+	case err := <-upgraded:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("upgrade should be woken by the release")
+	}
+
+	trx.Commit()
+}
+
+func TestTxManagerVictim(t *testing.T) {
+	m := NewManager(WithVictimPolicy(FewestLocks))
+	ctx := context.Background()
+
+	key := [12]byte{}
+	copy(key[:], []byte("test"))
+	key2 := [12]byte{}
+	copy(key2[:], []byte("test_2"))
+	key3 := [12]byte{}
+	copy(key3[:], []byte("test_3"))
+
+	// older, so Youngest would pick trx instead
+	trx2 := m.Begin()
+	trx := m.Begin()
+
+	for _, id := range [][12]byte{key, key3} {
+		if err := trx.Write(ctx, id); err != nil {
+			t.Fatalf("unexpected err %v", err)
+		}
+	}
+
+	if err := trx2.Write(ctx, key2); err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	victimCh := make(chan error)
+	go func() {
+		victimCh <- trx2.Write(ctx, key)
+	}()
+
+	// wait until trx2 waits for trx
+	for !waiting(trx2) {
+		time.Sleep(time.Millisecond)
+	}
+
+	err := trx.Write(ctx, key2)
+	if err != nil {
+		t.Fatalf("trx should take the lock of the victim, got %v", err)
+	}
+
+	err = <-victimCh
+	if !errors.Is(err, ErrDeadlock) {
+		t.Fatalf("victim should be notified, got %v", err)
+	}
+
+	err = trx2.Read(ctx, key3)
+	if !errors.Is(err, ErrDeadlock) {
+		t.Fatalf("aborted victim should not take locks, got %v", err)
+	}
+
+	if !trx.Commit() {
+		t.Fatal("ok should be true")
+	}
+
+	if trx2.Commit() {
+		t.Fatal("aborted victim should not commit")
+	}
+
+	if lockCount(m) != 0 {
+		t.Fatalf("every lock should be released, got %d", lockCount(m))
+	}
+}
+
+func TestTxManagerPrepare(t *testing.T) {
+	m := NewManager()
+	ctx := context.Background()
+
+	key := [12]byte{}
+	copy(key[:], []byte("test"))
+
+	// a victim picked from a stale wait-for graph is not waiting any more
+	victim := m.Begin()
+	if err := victim.Write(ctx, key); err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+	m.finish(victim, false, true)
+
+	err := victim.Prepare()
+	if !errors.Is(err, ErrDeadlock) {
+		t.Fatalf("aborted victim should not prepare, got %v", err)
+	}
+
+	trx := m.Begin()
+	if err = trx.Write(ctx, key); err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	err = trx.Prepare()
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	if m.finish(trx, false, true) {
+		t.Fatal("prepared transaction should not be aborted as a victim")
+	}
+
+	trx.Save("test", nil, false)
+
+	if !trx.Commit() {
+		t.Fatal("prepared transaction should commit")
+	}
+
+	if err = trx.Prepare(); errors.Is(err, ErrDeadlock) || err == nil {
+		t.Fatalf("committed transaction should not prepare, got %v", err)
+	}
+}
+
+func TestVictimPolicy(t *testing.T) {
+	m := NewManager()
+
+	a, b, c := m.Begin(), m.Begin(), m.Begin()
+	a.locks = make([]EntryID, 1)
+	b.locks = make([]EntryID, 3)
+	c.locks = make([]EntryID, 1)
+	a.work, b.work, c.work = 5, 2, 7
+
+	tests := []struct {
+		name   string
+		policy VictimPolicy
+		want   *Tx
+	}{
+		{name: "youngest", policy: Youngest, want: c},
+		{name: "fewest locks", policy: FewestLocks, want: c},
+		{name: "least work", policy: LeastWork, want: b},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy([]*Tx{a, b, c})
+			if got != tt.want {
+				t.Fatalf("expected tx %d, got %d", tt.want.ID(), got.ID())
+			}
+		})
+	}
+}
+
+// lockCount returns the number of entries locked by any transaction.
+func lockCount(m *Manager) (n int) {
+	for i := range m.shards {
+		m.shards[i].mu.Lock()
+		n += len(m.shards[i].locks)
+		m.shards[i].mu.Unlock()
+	}
+
+	return n
+}
+
+// waiting reports whether trx waits for a lock.
+func waiting(trx *Tx) bool {
+	trx.mu.Lock()
+	defer trx.mu.Unlock()
+
+	return len(trx.waitFor) > 0
+}
+
+// BenchmarkTxManager runs transactions locking a few keys each with LockKey,
+// compare the results of -cpu=1,4,16,32 for scaling.
+func BenchmarkTxManager(b *testing.B) {
+	const locksPerTx = 16
+
+	keys := make([][]byte, 1<<16)
+	for i := range keys {
+		keys[i] = fmt.Appendf(nil, "key_%d", i)
+	}
+
+	b.Run("distinct writes", func(b *testing.B) {
+		m := NewManager()
+		ctx := context.Background()
+
+		var next atomic.Uint64
+
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				trx := m.Begin()
+
+				base := next.Add(locksPerTx)
+				for i := range uint64(locksPerTx) {
+					err := trx.LockKey(ctx, keys[(base+i)%uint64(len(keys))], LockWrite)
+					if err != nil {
+						b.Error(err)
+					}
+				}
+
+				trx.Commit()
+			}
+		})
+	})
+
+	b.Run("shared reads", func(b *testing.B) {
+		m := NewManager()
+		ctx := context.Background()
+
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				trx := m.Begin()
+
+				for i := range locksPerTx {
+					err := trx.LockKey(ctx, keys[i], LockRead)
+					if err != nil {
+						b.Error(err)
+					}
+				}
+
+				trx.Commit()
+			}
+		})
+	})
+}
@@ -0,0 +1,112 @@
+package tx
+
+// LockMode is the way a transaction holds a lock.
+type LockMode uint8
+
+// Modes from the weakest. The intention modes are taken on the ancestors of a
+// resource, see LockPath.
+const (
+	LockIntentRead      LockMode = iota + 1 // IS, a descendant is read
+	LockIntentWrite                         // IX, a descendant is written
+	LockRead                                // S
+	LockReadIntentWrite                     // SIX, read with a descendant written
+	LockWrite                               // X
+
+	lockModes = iota + 1
+)
+
+var (
+	// compatible[held][requested] tells whether a lock held by one transaction
+	// lets another one take it in the requested mode.
+	compatible = [lockModes][lockModes]bool{
+		LockIntentRead: {
+			LockIntentRead:      true,
+			LockIntentWrite:     true,
+			LockRead:            true,
+			LockReadIntentWrite: true,
+		},
+		LockIntentWrite: {
+			LockIntentRead:  true,
+			LockIntentWrite: true,
+		},
+		LockRead: {
+			LockIntentRead: true,
+			LockRead:       true,
+		},
+		LockReadIntentWrite: {
+			LockIntentRead: true,
+		},
+		LockWrite: {},
+	}
+
+	// covers[held][requested] tells whether holding a lock implies the requested mode.
+	covers = [lockModes][lockModes]bool{
+		LockIntentRead: {
+			LockIntentRead: true,
+		},
+		LockIntentWrite: {
+			LockIntentRead:  true,
+			LockIntentWrite: true,
+		},
+		LockRead: {
+			LockIntentRead: true,
+			LockRead:       true,
+		},
+		LockReadIntentWrite: {
+			LockIntentRead:      true,
+			LockIntentWrite:     true,
+			LockRead:            true,
+			LockReadIntentWrite: true,
+		},
+		LockWrite: {
+			LockIntentRead:      true,
+			LockIntentWrite:     true,
+			LockRead:            true,
+			LockReadIntentWrite: true,
+			LockWrite:           true,
+		},
+	}
+)
+
+// Compatible reports whether a lock held in one mode by a transaction can be
+// taken in the requested mode by another one.
+func Compatible(held, requested LockMode) bool {
+	return compatible[held][requested]
+}
+
+// Covers reports whether holding a lock in mode m implies holding it in the other mode.
+func (m LockMode) Covers(other LockMode) bool {
+	return covers[m][other]
+}
+
+// join returns the weakest mode that covers both m and other, e.g. SIX for S
+// and IX.
+func (m LockMode) join(other LockMode) LockMode {
+	for j := LockIntentRead; j < lockModes; j++ {
+		if j.Covers(m) && j.Covers(other) {
+			return j
+		}
+	}
+
+	panic("unknown lock mode")
+}
+
+// intention returns the mode the ancestors of a resource locked in mode m are
+// locked in.
+func (m LockMode) intention() LockMode {
+	if LockRead.Covers(m) {
+		return LockIntentRead
+	}
+
+	return LockIntentWrite
+}
+
+// escalated returns the mode a parent is locked in to replace the locks of its
+// children held in mode m.
+func (m LockMode) escalated() LockMode {
+	if LockRead.Covers(m) {
+		return LockRead
+	}
+
+	return LockWrite
+}
@@ -0,0 +1,99 @@
+package tx
+
+// Every transaction reads the data as of its start. Writers keep locking the
+// keys they change, and before changing a key a writer saves the committed
+// value it overwrites. Readers started before the writer committed find that
+// value here instead of the new one, so they never wait for writers.
+//
+// Saved values are stamped with the commit timestamp of the writer and are
+// dropped once every active transaction has started after it.
+
+type version struct {
+	key    string
+	value  []byte
+	exists bool
+
+	owner TxID   // the writer that overwrote the value
+	ts    uint64 // commit timestamp of the writer, 0 while it is in progress
+}
+
+// visible reports whether the snapshot of tx at ts reads v instead of the
+// latest value.
+func (v *version) visible(tx TxID, ts uint64) bool {
+	if v.ts == 0 {
+		return v.owner != tx
+	}
+
+	return v.ts > ts
+}
+
+type versions struct {
+	chains map[string][]*version // saved values of every key, oldest first
+	queue  []*version            // committed values in commit order
+}
+
+func newVersions() *versions {
+	return &versions{
+		chains: make(map[string][]*version),
+	}
+}
+
+// save appends v to the chain of its key, a key has a single writer at a time
+// so the values in progress are always last.
+func (vs *versions) save(v *version) {
+	vs.chains[v.key] = append(vs.chains[v.key], v)
+}
+
+// find returns the oldest value overwritten after the snapshot of tx at ts.
+func (vs *versions) find(key string, tx TxID, ts uint64) *version {
+	for _, v := range vs.chains[key] {
+		if v.visible(tx, ts) {
+			return v
+		}
+	}
+
+	return nil
+}
+
+func (vs *versions) commit(saved []*version, ts uint64) {
+	for _, v := range saved {
+		v.ts = ts
+	}
+
+	vs.queue = append(vs.queue, saved...)
+}
+
+// drop removes values saved by an aborted writer.
+func (vs *versions) drop(saved []*version) {
+	for _, v := range saved {
+		chain := vs.chains[v.key]
+		if len(chain) == 0 || chain[len(chain)-1] != v {
+			panic("inconsistent version chain")
+		}
+
+		vs.trim(v.key, chain[:len(chain)-1])
+	}
+}
+
+// collect drops values committed at or before ts, no snapshot older than ts is left to read them.
+func (vs *versions) collect(ts uint64) {
+	n := 0
+	for ; n < len(vs.queue) && vs.queue[n].ts <= ts; n++ {
+		v := vs.queue[n]
+		vs.queue[n] = nil
+
+		// the oldest committed value is the first of its chain
+		vs.trim(v.key, vs.chains[v.key][1:])
+	}
+
+	vs.queue = vs.queue[n:]
+}
+
+func (vs *versions) trim(key string, chain []*version) {
+	if len(chain) == 0 {
+		delete(vs.chains, key)
+		return
+	}
+
+	vs.chains[key] = chain
+}
@@ -0,0 +1,147 @@
+package tx
+
+import (
+	"testing"
+)
+
+// store is the latest committed state the versions are kept for.
+type store map[string]string
+
+func (s store) read(trx *Tx, key string) (string, bool) {
+	value, exists := s[key]
+
+	if v, existed, ok := trx.Version(key); ok {
+		return string(v), existed
+	}
+
+	return value, exists
+}
+
+func (s store) write(trx *Tx, key string, value string) {
+	old, exists := s[key]
+	trx.Save(key, []byte(old), exists)
+
+	s[key] = value
+}
+
+func TestSnapshotRead(t *testing.T) {
+	m := NewManager()
+	s := store{"a": "1"}
+
+	reader := m.Begin()
+
+	writer := m.Begin()
+	s.write(writer, "a", "2")
+	s.write(writer, "b", "1")
+
+	// in progress
+	if v, _ := s.read(reader, "a"); v != "1" {
+		t.Fatalf("reader should see a = 1, got %q", v)
+	}
+
+	if v, _ := s.read(writer, "a"); v != "2" {
+		t.Fatalf("writer should see its own a = 2, got %q", v)
+	}
+
+	if !writer.Commit() {
+		t.Fatal("ok should be true")
+	}
+
+	// committed after the reader started
+	if v, _ := s.read(reader, "a"); v != "1" {
+		t.Fatalf("reader should see a = 1, got %q", v)
+	}
+
+	if _, ok := s.read(reader, "b"); ok {
+		t.Fatal("reader should not see b")
+	}
+
+	late := m.Begin()
+	if v, _ := s.read(late, "a"); v != "2" {
+		t.Fatalf("late reader should see a = 2, got %q", v)
+	}
+
+	writer = m.Begin()
+	s.write(writer, "a", "3")
+	if !writer.Commit() {
+		t.Fatal("ok should be true")
+	}
+
+	if v, _ := s.read(reader, "a"); v != "1" {
+		t.Fatalf("reader should see a = 1, got %q", v)
+	}
+
+	if v, _ := s.read(late, "a"); v != "2" {
+		t.Fatalf("late reader should see a = 2, got %q", v)
+	}
+
+	reader.Commit()
+	late.Commit()
+
+	if len(m.versions.chains) != 0 || len(m.versions.queue) != 0 {
+		t.Fatalf("versions should be collected, got %d chains", len(m.versions.chains))
+	}
+}
+
+func TestSnapshotAbort(t *testing.T) {
+	m := NewManager()
+	s := store{"a": "1"}
+
+	reader := m.Begin()
+
+	writer := m.Begin()
+	s.write(writer, "a", "2")
+
+	writer.Abort()
+	s["a"] = "1" // undone by the writer
+
+	if v, _ := s.read(reader, "a"); v != "1" {
+		t.Fatalf("reader should see a = 1, got %q", v)
+	}
+
+	if len(m.versions.chains) != 0 {
+		t.Fatalf("versions of aborted writer should be dropped, got %d chains", len(m.versions.chains))
+	}
+
+	reader.Commit()
+}
+
+func TestSnapshotCollect(t *testing.T) {
+	m := NewManager()
+	s := store{}
+
+	old := m.Begin()
+
+	for i := range 10 {
+		writer := m.Begin()
+		s.write(writer, "a", string(rune('0'+i)))
+		writer.Commit()
+	}
+
+	if n := len(m.versions.chains["a"]); n != 10 {
+		t.Fatalf("old reader should keep 10 versions, got %d", n)
+	}
+
+	mid := m.Begin()
+
+	writer := m.Begin()
+	s.write(writer, "a", "x")
+	writer.Commit()
+
+	old.Commit()
+
+	// only the value mid reads is left
+	if n := len(m.versions.chains["a"]); n != 1 {
+		t.Fatalf("mid reader should keep 1 version, got %d", n)
+	}
+
+	if v, _ := s.read(mid, "a"); v != "9" {
+		t.Fatalf("mid reader should see a = 9, got %q", v)
+	}
+
+	mid.Commit()
+
+	if len(m.versions.chains) != 0 {
+		t.Fatalf("versions should be collected, got %d chains", len(m.versions.chains))
+	}
+}
@@ -0,0 +1,331 @@
+package tx
+
+import (
+	"bytes"
+	"context"
+	"hash/fnv"
+	"slices"
+)
+
+const defaultRangePrefix = 4
+
+// KeyRange is the set of keys k with From <= k < To, a nil To leaves the
+// range unbounded.
+type KeyRange struct {
+	From []byte
+	To   []byte
+}
+
+// prefixRange returns the range of the keys starting with prefix.
+func prefixRange(prefix []byte) KeyRange {
+	to := bytes.Clone(prefix)
+	for i := len(to) - 1; i >= 0; i-- {
+		if to[i] < 0xff {
+			to[i]++
+			return KeyRange{From: bytes.Clone(prefix), To: to[:i+1]}
+		}
+	}
+
+	return KeyRange{From: bytes.Clone(prefix)}
+}
+
+// keyRange returns the range holding key only.
+func keyRange(key []byte) KeyRange {
+	key = append([]byte{}, key...)
+
+	return KeyRange{From: key, To: append(key[:len(key):len(key)], 0)}
+}
+
+// Contains reports whether key is in r.
+func (r KeyRange) Contains(key []byte) bool {
+	return bytes.Compare(r.From, key) <= 0 && (r.To == nil || bytes.Compare(key, r.To) < 0)
+}
+
+// Overlaps reports whether r and o have a key in common.
+func (r KeyRange) Overlaps(o KeyRange) bool {
+	if r.To != nil && bytes.Compare(o.From, r.To) >= 0 {
+		return false
+	}
+
+	if o.To != nil && bytes.Compare(r.From, o.To) >= 0 {
+		return false
+	}
+
+	return !r.empty() && !o.empty()
+}
+
+// covers reports whether every key of o is in r.
+func (r KeyRange) covers(o KeyRange) bool {
+	if bytes.Compare(r.From, o.From) > 0 {
+		return false
+	}
+
+	return r.To == nil || o.To != nil && bytes.Compare(o.To, r.To) <= 0
+}
+
+func (r KeyRange) empty() bool {
+	return r.To != nil && bytes.Compare(r.From, r.To) >= 0
+}
+
+// predicate is a lock on a set of keys held by a transaction until it ends.
+type predicate struct {
+	r    KeyRange
+	mode LockMode
+}
+
+// LockRange locks every key of r in the given mode, including keys that do
+// not exist yet, so no other transaction can insert into the range until the
+// transaction ends. It waits while other transactions hold an overlapping
+// range or a key of r in an incompatible mode, or returns an error once ctx
+// is done.
+//
+// Range locks only see keys locked with LockKey, locks taken by EntryID are
+// not checked against them. Root is locked in the intention mode first.
+func (t *Tx) LockRange(ctx context.Context, r KeyRange, mode LockMode) error {
+	id := KeyID(r.From)
+
+	err := t.LockPath(ctx, Path{Root}, mode.intention())
+	if err != nil {
+		return err
+	}
+
+	for {
+		ch, ok, err := t.m.lockRange(t, r, mode)
+		if err != nil || ok {
+			return err
+		}
+
+		err = t.wait(ctx, id, ch)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// LockKey takes the lock of key in the given mode like LockPath does with
+// Path{Root, range, KeyID(key)}, where range stands for the keys sharing the
+// prefix of key, see WithRangePrefix. It first waits for transactions holding
+// a range of key in an incompatible mode.
+func (t *Tx) LockKey(ctx context.Context, key []byte, mode LockMode) error {
+	id := KeyID(key)
+
+	for {
+		ch, ok, err := t.m.lockKey(t, key, mode)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			return t.LockPath(ctx, t.m.keyPath(t, key, id), mode)
+		}
+
+		err = t.wait(ctx, id, ch)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// keyPath returns the path key is locked by and records the keys of its
+// ancestors, so escalation locks them like a range.
+func (m *Manager) keyPath(tx *Tx, key []byte, id EntryID) Path {
+	if m.rangePrefix <= 0 {
+		tx.bound(Root, nil)
+		return Path{Root, id}
+	}
+
+	prefix := key[:min(len(key), m.rangePrefix)]
+
+	h := fnv.New128a()
+	h.Write([]byte("range:"))
+	h.Write(prefix)
+
+	var rid EntryID
+	h.Sum(rid[:0])
+	rid[len(rid)-1] |= stripedBit
+
+	tx.bound(rid, func() KeyRange {
+		if len(key) < m.rangePrefix {
+			return keyRange(key) // no other key falls into its range
+		}
+
+		return prefixRange(prefix)
+	})
+
+	return Path{Root, rid, id}
+}
+
+// bound records the keys under parent the first time it is locked, Root
+// stands for every key.
+func (t *Tx) bound(parent EntryID, keys func() KeyRange) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.bounds == nil {
+		t.bounds = map[EntryID]KeyRange{Root: {}}
+	}
+
+	if _, ok := t.bounds[parent]; !ok {
+		t.bounds[parent] = keys()
+	}
+}
+
+func (m *Manager) lockRange(tx *Tx, r KeyRange, mode LockMode) (chan struct{}, bool, error) {
+	m.predicates.Lock()
+	defer m.predicates.Unlock()
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	err := tx.check()
+	if err != nil {
+		return nil, false, err
+	}
+
+	// nobody else holds a range under a covering lock of root
+	if r.empty() || m.covered(tx, Root, mode) || holds(tx.ranges, r, mode) {
+		tx.work++
+		return nil, true, nil
+	}
+
+	waitFor, ch := m.blockers(tx, r, mode, true)
+	if len(waitFor) > 0 {
+		return tx.await(waitFor, ch)
+	}
+
+	r = KeyRange{From: bytes.Clone(r.From), To: bytes.Clone(r.To)}
+	tx.ranges = append(tx.ranges, predicate{r: r, mode: mode})
+	m.ranged[tx.id] = tx
+	tx.work++
+
+	return nil, true, nil
+}
+
+// lockKey records that tx is about to lock key once no range of another
+// transaction holding key is in the way. Keys are locked holding
+// m.predicates shared, so only transactions holding ranges are looked at.
+func (m *Manager) lockKey(tx *Tx, key []byte, mode LockMode) (chan struct{}, bool, error) {
+	m.predicates.RLock()
+	defer m.predicates.RUnlock()
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	err := tx.check()
+	if err != nil {
+		return nil, false, err
+	}
+
+	held := tx.keys[string(key)]
+	if held.Covers(mode) || m.covered(tx, Root, mode) {
+		return nil, true, nil
+	}
+
+	if len(tx.ranges) > 0 || len(m.ranged) > 0 {
+		r := keyRange(key)
+		if holds(tx.ranges, r, mode) {
+			return nil, true, nil
+		}
+
+		waitFor, ch := m.blockers(tx, r, mode, false)
+		if len(waitFor) > 0 {
+			return tx.await(waitFor, ch)
+		}
+	}
+
+	if held != 0 {
+		mode = held.join(mode)
+	}
+
+	if tx.keys == nil {
+		tx.keys = make(map[string]LockMode)
+	}
+	tx.keys[string(key)] = mode
+
+	return nil, true, nil
+}
+
+// blockers returns the transactions other than tx holding a range of r, and
+// a key of r too if keys is set, in a mode incompatible with mode, and a
+// channel closed once one of them ends. The caller holds m.predicates, and
+// holds it exclusively to look at keys.
+func (m *Manager) blockers(tx *Tx, r KeyRange, mode LockMode, keys bool) (waitFor []TxID, ch chan struct{}) {
+	for _, t := range m.ranged {
+		if t != tx && blocks(t.ranges, r, mode) {
+			waitFor = append(waitFor, t.id)
+			ch = t.done
+		}
+	}
+
+	if !keys {
+		return waitFor, ch
+	}
+
+	m.active.Range(func(_, v any) bool {
+		t := v.(*Tx)
+		if t != tx && !slices.Contains(waitFor, t.id) && blocksKeys(t.keys, r, mode) {
+			waitFor = append(waitFor, t.id)
+			ch = t.done
+		}
+
+		return true
+	})
+
+	return waitFor, ch
+}
+
+// holds reports whether one of ps covers r in a mode covering mode.
+func holds(ps []predicate, r KeyRange, mode LockMode) bool {
+	for _, p := range ps {
+		if p.mode.Covers(mode) && p.r.covers(r) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// blocks reports whether one of ps keeps another transaction from locking r
+// in the given mode.
+func blocks(ps []predicate, r KeyRange, mode LockMode) bool {
+	for _, p := range ps {
+		if !Compatible(p.mode, mode) && p.r.Overlaps(r) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// blocksKeys reports whether one of keys keeps another transaction from
+// locking r in the given mode.
+func blocksKeys(keys map[string]LockMode, r KeyRange, mode LockMode) bool {
+	for k, held := range keys {
+		if !Compatible(held, mode) && r.Contains([]byte(k)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// releasePredicates drops the ranges and keys of tx, the transactions waiting
+// for them wait for tx to end. Only transactions holding ranges take
+// m.predicates exclusively.
+func (m *Manager) releasePredicates(tx *Tx) {
+	m.predicates.RLock()
+	tx.mu.Lock()
+	tx.keys = nil
+	ranged := len(tx.ranges) > 0
+	tx.mu.Unlock()
+	m.predicates.RUnlock()
+
+	if !ranged {
+		return
+	}
+
+	m.predicates.Lock()
+	delete(m.ranged, tx.id)
+	tx.ranges = nil
+	m.predicates.Unlock()
+}
@@ -0,0 +1,189 @@
+package tx
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestKeyRange(t *testing.T) {
+	r := KeyRange{From: []byte("b"), To: []byte("d")}
+
+	for key, want := range map[string]bool{"a": false, "b": true, "bz": true, "c": true, "d": false} {
+		if got := r.Contains([]byte(key)); got != want {
+			t.Fatalf("contains %q: expected %v, got %v", key, want, got)
+		}
+	}
+
+	tests := []struct {
+		o    KeyRange
+		want bool
+	}{
+		{o: KeyRange{From: []byte("a"), To: []byte("b")}, want: false},
+		{o: KeyRange{From: []byte("a"), To: []byte("b\x00")}, want: true},
+		{o: KeyRange{From: []byte("c")}, want: true},
+		{o: KeyRange{From: []byte("d")}, want: false},
+		{o: KeyRange{From: []byte("c"), To: []byte("c")}, want: false},
+		{o: keyRange([]byte("c")), want: true},
+	}
+
+	for _, tt := range tests {
+		if got := r.Overlaps(tt.o); got != tt.want {
+			t.Fatalf("overlaps [%q, %q): expected %v, got %v", tt.o.From, tt.o.To, tt.want, got)
+		}
+
+		if got := tt.o.Overlaps(r); got != tt.want {
+			t.Fatalf("overlaps [%q, %q) reversed: expected %v, got %v", tt.o.From, tt.o.To, tt.want, got)
+		}
+	}
+}
+
+func TestTxManagerRangeLock(t *testing.T) {
+	m := NewManager()
+	ctx := context.Background()
+
+	reader := m.Begin()
+	err := reader.LockRange(ctx, KeyRange{From: []byte("b"), To: []byte("d")}, LockRead)
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	// the same range is held already
+	err = reader.LockRange(ctx, KeyRange{From: []byte("b"), To: []byte("c")}, LockRead)
+	if err != nil || len(reader.ranges) != 1 {
+		t.Fatalf("covered range should not be taken again, got %v %d", err, len(reader.ranges))
+	}
+
+	reader2 := m.Begin()
+	err = reader2.LockRange(ctx, KeyRange{From: []byte("a")}, LockRead)
+	if err != nil {
+		t.Fatalf("read ranges should be shared, got %v", err)
+	}
+	reader2.Commit()
+
+	writer := m.Begin()
+
+	err = writer.LockKey(ctx, []byte("d"), LockWrite)
+	if err != nil {
+		t.Fatalf("key out of the range should be locked, got %v", err)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	// a key that does not exist yet is protected as well
+	err = writer.LockKey(timeout, []byte("bb"), LockWrite)
+	if !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("insert into a read range should wait, got %v", err)
+	}
+
+	lockedCh := make(chan error)
+	go func() {
+		lockedCh <- writer.LockKey(ctx, []byte("c"), LockWrite)
+	}()
+
+	select {
+	case err = <-lockedCh:
+		t.Fatalf("key in the range should not be locked before the reader ends, got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	reader.Commit()
+
+	err = <-lockedCh
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	// ranges wait for the keys written in them too
+	reader = m.Begin()
+
+	timeout, cancel = context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	err = reader.LockRange(timeout, KeyRange{From: []byte("c"), To: []byte("e")}, LockRead)
+	if !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("range with a written key should wait, got %v", err)
+	}
+
+	err = reader.LockRange(ctx, KeyRange{From: []byte("e")}, LockRead)
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	writer.Commit()
+	reader.Commit()
+
+	if lockCount(m) != 0 {
+		t.Fatalf("every lock should be released, got %d", lockCount(m))
+	}
+}
+
+func TestTxManagerRangeDeadlock(t *testing.T) {
+	m := NewManager()
+	ctx := context.Background()
+
+	trx := m.Begin()
+	trx2 := m.Begin()
+
+	err := trx.LockRange(ctx, KeyRange{From: []byte("a"), To: []byte("b")}, LockRead)
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	err = trx2.LockRange(ctx, KeyRange{From: []byte("b"), To: []byte("c")}, LockRead)
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	lockedCh := make(chan error)
+	go func() {
+		lockedCh <- trx.LockKey(ctx, []byte("bb"), LockWrite)
+	}()
+
+	// wait until trx waits for trx2
+	for !waiting(trx) {
+		time.Sleep(time.Millisecond)
+	}
+
+	err = trx2.LockKey(ctx, []byte("aa"), LockWrite)
+	if !errors.Is(err, ErrDeadlock) {
+		t.Fatalf("youngest tx should be the victim, got %v", err)
+	}
+	trx2.Abort()
+
+	err = <-lockedCh
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	trx.Commit()
+}
+
+func TestTxManagerKeysWithoutManagerLock(t *testing.T) {
+	m := NewManager()
+	ctx := context.Background()
+
+	reader := m.Begin()
+	trx := m.Begin()
+
+	// writers of versions and snapshots hold m.mu, keys are locked and
+	// released without it
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := trx.LockKey(ctx, []byte("a"), LockWrite)
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	if !trx.Commit() {
+		t.Fatal("commit should end the transaction")
+	}
+
+	err = reader.LockKey(ctx, []byte("a"), LockRead)
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+}
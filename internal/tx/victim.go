@@ -0,0 +1,42 @@
+package tx
+
+// VictimPolicy picks the transaction aborted to break a deadlock from the
+// transactions of the cycle. The victim is aborted and its lock wait fails
+// with ErrDeadlock.
+type VictimPolicy func(cycle []*Tx) *Tx
+
+var (
+	// Youngest aborts the transaction that began last.
+	Youngest VictimPolicy = func(cycle []*Tx) *Tx {
+		return pick(cycle, func(a, b *Tx) bool {
+			return false
+		})
+	}
+
+	// FewestLocks aborts the transaction that holds the fewest locks.
+	FewestLocks VictimPolicy = func(cycle []*Tx) *Tx {
+		return pick(cycle, func(a, b *Tx) bool {
+			return len(a.locks) < len(b.locks)
+		})
+	}
+
+	// LeastWork aborts the transaction that made the fewest lock requests.
+	LeastWork VictimPolicy = func(cycle []*Tx) *Tx {
+		return pick(cycle, func(a, b *Tx) bool {
+			return a.work < b.work
+		})
+	}
+)
+
+// pick returns the transaction for which less holds against every other one,
+// ties go to the youngest.
+func pick(cycle []*Tx, less func(a, b *Tx) bool) *Tx {
+	res := cycle[0]
+	for _, t := range cycle[1:] {
+		if less(t, res) || !less(res, t) && t.id > res.id {
+			res = t
+		}
+	}
+
+	return res
+}